@@ -3,6 +3,60 @@
 //  A minimal Go implementation of the Majordomo Protocol as defined in
 //  http://rfc.zeromq.org/spec:7 and http://rfc.zeromq.org/spec:8.
 //
+//  The broker answers the Majordomo Management Interface itself. The
+//  reply to an mmi.* request is the request body with its last frame
+//  replaced by a status code, followed for all but mmi.service by a JSON
+//  frame:
+//
+//    mmi.service    200 if the service named has a waiting worker, else 404
+//    mmi.services   names of the services known, sorted
+//    mmi.workers    workers, waiting workers and requests in progress per service
+//    mmi.queue      queued requests and the oldest one's age per service
+//    mmi.stats      request, reply and error counters
+//    mmi.ratelimit  the rate limits in force, after setting the one sent
+//    mmi.queuelimit the queue limits in force, after setting the one sent
+//
+//  mmi.workers and mmi.queue report on the service the body names, or on
+//  every service if it is empty. Unknown mmi.* requests get 501.
+//
+//  Each service's queue is bounded in length and in bytes. A request that
+//  would take a queue over either limit is refused at once with the reply
+//  "QueueFull". A queued request expires at the client's deadline, if it
+//  sent one, or else after the service's queue expiry, and is dropped. A
+//  client that sent no deadline may still be waiting, so it is told with
+//  the reply "Expired".
+//
+//  An MDP/0.2 request carries trace context and a time budget in a
+//  properties frame after the service name. The broker traces the request
+//  under the client's context, and passes on its own context and what is
+//  left of the budget in the properties it sends an MDP/0.2 worker ahead
+//  of the body. MDP/0.1 clients and workers have no properties frame, so
+//  their requests are neither traced nor bounded in time.
+//
+//  Clients and workers may speak MDP/0.1 or MDP/0.2
+//  (http://rfc.zeromq.org/spec:18), in any mix. An MDP/0.2 worker may
+//  send partial replies before its final one, and keeps the request until
+//  the final one comes. An MDP/0.1 client gets them all at once, in the
+//  final reply.
+//
+//  A worker may say after its service name in READY how many requests it
+//  takes at once. The broker keeps up to that many in progress with it,
+//  tracked by request ID, and the worker waits for more work while it has
+//  room for another. The ID goes ahead of the client envelope in each
+//  request to such a worker, and it sends it back the same way in each
+//  reply. A worker that says nothing takes one request at a time and
+//  sees no IDs.
+//
+//  The broker heartbeats every worker, busy or not. A worker that said how
+//  many requests it takes answers them in the background and heartbeats
+//  throughout, so it is lost once it goes quiet. One that takes a request
+//  at a time is silent while it works on it, and is lost only if it goes
+//  quiet while waiting.
+//
+//  When a worker is lost, the requests it had in progress go back to the
+//  front of their queue for another worker, except those whose client has
+//  had partial replies, which get the reply "WorkerLost".
+//
 
 package main
 
@@ -10,10 +64,16 @@ import (
 	zmq "github.com/pebbe/zmq4"
 	"github.com/pebbe/zmq4/examples/mdapi"
 
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	llibrary "llibrary"
 	"log"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"time"
 )
 
@@ -23,18 +83,114 @@ const (
 	HEARTBEAT_LIVENESS = 3                       //  3-5 is reasonable
 	HEARTBEAT_INTERVAL = 2500 * time.Millisecond //  msecs
 	HEARTBEAT_EXPIRY   = HEARTBEAT_INTERVAL * HEARTBEAT_LIVENESS
+
+	RUN_POLL_INTERVAL = 250 * time.Millisecond //  Longest wait before checking for shutdown
+
+	//  Queue limits for services that have none of their own
+	DEFAULT_QUEUE_LENGTH = 10000       //  Requests
+	DEFAULT_QUEUE_BYTES  = 64 << 20    //  Bytes of requests
+	DEFAULT_QUEUE_EXPIRY = time.Minute //  For requests without a deadline
+
+	EXPIRY_INTERVAL = RUN_POLL_INTERVAL //  Between sweeps of the queues for expired requests
+
+	//  Stands for an MDP/0.2 partial reply, which MDP/0.1 has no command for
+	MDPW_PARTIAL = "partial"
+)
+
+//  MDP/0.2 worker commands in the terms of MDP/0.1, which the broker
+//  handles both in, and back again. A final reply is an MDP/0.1 reply.
+
+var (
+	from_mdp02 = map[string]string{
+		llibrary.MDPW_READY:      mdapi.MDPW_READY,
+		llibrary.MDPW_PARTIAL:    MDPW_PARTIAL,
+		llibrary.MDPW_FINAL:      mdapi.MDPW_REPLY,
+		llibrary.MDPW_HEARTBEAT:  mdapi.MDPW_HEARTBEAT,
+		llibrary.MDPW_DISCONNECT: mdapi.MDPW_DISCONNECT,
+	}
+	to_mdp02 = map[string]string{
+		mdapi.MDPW_REQUEST:    llibrary.MDPW_REQUEST,
+		mdapi.MDPW_HEARTBEAT:  llibrary.MDPW_HEARTBEAT,
+		mdapi.MDPW_DISCONNECT: llibrary.MDPW_DISCONNECT,
+	}
+)
+
+//  Broker metrics, served at METRICS_ADDRESS if it is set
+
+var (
+	requests_total = llibrary.DefaultRegistry.NewCounter("mdbroker_requests_total",
+		"Client requests received per service", "service")
+	replies_total = llibrary.DefaultRegistry.NewCounter("mdbroker_replies_total",
+		"Worker replies returned to clients per service", "service")
+	errors_total = llibrary.DefaultRegistry.NewCounter("mdbroker_errors_total",
+		"Invalid messages, unsupported MMI requests and lost workers, by reason", "reason")
+	queue_depth = llibrary.DefaultRegistry.NewGauge("mdbroker_queue_depth",
+		"Requests queued per service", "service")
+	waiting_workers = llibrary.DefaultRegistry.NewGauge("mdbroker_waiting_workers",
+		"Idle workers per service", "service")
+	workers_total = llibrary.DefaultRegistry.NewGauge("mdbroker_workers",
+		"Workers known to the broker")
+	rate_limited_total = llibrary.DefaultRegistry.NewCounter("mdbroker_rate_limited_total",
+		"Client requests refused for being over a rate limit per service", "service")
+	queue_full_total = llibrary.DefaultRegistry.NewCounter("mdbroker_queue_full_total",
+		"Client requests refused because their service's queue was full per service", "service")
+	queue_bytes = llibrary.DefaultRegistry.NewGauge("mdbroker_queue_bytes",
+		"Bytes of requests queued per service", "service")
+	expired_total = llibrary.DefaultRegistry.NewCounter("mdbroker_expired_total",
+		"Queued requests dropped for expiring before a worker took them per service", "service")
+	request_duration = llibrary.DefaultRegistry.NewHistogram("mdbroker_request_duration_seconds",
+		"Time from dispatching a request to a worker to its reply per service", llibrary.LATENCY_BUCKETS, "service")
 )
 
 //  The broker class defines a single broker instance:
 
 type Broker struct {
-	socket       *zmq.Socket         //  Socket for clients & workers
-	verbose      bool                //  Print activity to stdout
-	endpoint     string              //  Broker binds to this endpoint
-	services     map[string]*Service //  Hash of known services
-	workers      map[string]*Worker  //  Hash of known workers
-	waiting      []*Worker           //  List of waiting workers
-	heartbeat_at time.Time           //  When to send HEARTBEAT
+	socket       *zmq.Socket               //  Socket for clients & workers
+	verbose      bool                      //  Print activity to stdout
+	endpoint     string                    //  Broker binds to this endpoint
+	services     map[string]*Service       //  Hash of known services
+	workers      map[string]*Worker        //  Hash of known workers
+	heartbeat_at time.Time                 //  When to send HEARTBEAT
+	spans        map[string]*llibrary.Span //  Traced requests not yet dispatched
+	limiter      *llibrary.RateLimiter     //  Limits per client and service
+	stats        Stats                     //  Counters reported by mmi.stats
+	queue_limits map[string]QueueLimit     //  By service; "" for the default
+	expire_at    time.Time                 //  When to next sweep the workers and queues
+	sequence     uint64                    //  Of request IDs
+}
+
+//  Bounds a service's queue. A limit of 0 is no limit. A limit for the
+//  service "" is the default, for services with none of their own.
+
+type QueueLimit struct {
+	Service string `json:",omitempty"`
+	Length  int    //  Requests queued
+	Bytes   int    //  Bytes of requests queued
+	Expiry  int    //  Milliseconds a request without a deadline may wait
+}
+
+//  Counters kept by a broker since it started, as reported by mmi.stats
+
+type Stats struct {
+	Requests map[string]int64 //  Client requests per service
+	Replies  map[string]int64 //  Worker replies per service
+	Errors   map[string]int64 //  By reason, as in mdbroker_errors_total
+}
+
+//  What mmi.workers reports for a service
+
+type WorkerCounts struct {
+	Workers    int //  Attached to the service, idle or busy
+	Waiting    int //  With room for another request
+	InProgress int //  Requests with the workers
+}
+
+//  What mmi.queue reports for a service
+
+type QueueStats struct {
+	Depth     int   //  Requests waiting for a worker
+	Bytes     int   //  Bytes of requests waiting
+	OldestAge int64 //  Milliseconds the oldest has waited; 0 if none has
 }
 
 //  The service class defines a single service instance:
@@ -42,18 +198,41 @@ type Broker struct {
 type Service struct {
 	broker   *Broker    //  Broker instance
 	name     string     //  Service name
-	requests [][]string //  List of client requests
+	requests []*Request //  List of client requests
+	bytes    int        //  Size of the client requests
 	waiting  []*Worker  //  List of waiting workers
 }
 
+//  The request class defines a client request waiting for a worker:
+
+type Request struct {
+	msg        []string            //  Client envelope and body
+	properties llibrary.Properties //  From an MDP/0.2 client; nil from an MDP/0.1 one
+	deadline   time.Time           //  When the client stops waiting; zero if it never does
+	queued     time.Time           //  When the request arrived
+	header     string              //  The protocol the client speaks
+	size       int                 //  Bytes in the envelope and body
+	expiry     time.Time           //  When it is dropped if still queued; zero if never
+
+	id       string         //  Tells a worker's requests in progress apart
+	span     *llibrary.Span //  Traced while in progress, if at all
+	sent_at  time.Time      //  When it was sent to a worker
+	held     []string       //  Partial replies for a client that takes only one
+	streamed bool           //  Whether its client has had partial replies
+}
+
 //  The worker class defines a single worker, idle or active:
 
 type Worker struct {
-	broker    *Broker   //  Broker instance
-	id_string string    //  Identity of worker as string
-	identity  string    //  Identity frame for routing
-	service   *Service  //  Owning service, if known
-	expiry    time.Time //  Expires at unless heartbeat
+	broker    *Broker             //  Broker instance
+	id_string string              //  Identity of worker as string
+	identity  string              //  Identity frame for routing
+	header    string              //  The protocol the worker speaks
+	service   *Service            //  Owning service, if known
+	expiry    time.Time           //  Expires at unless heartbeat
+	capacity  int                 //  Requests it takes at once
+	tagged    bool                //  Whether its requests and replies carry their IDs
+	requests  map[string]*Request //  Requests in progress, by ID
 }
 
 //  Here are the constructor and destructor for the broker:
@@ -65,8 +244,21 @@ func NewBroker(verbose bool) (broker *Broker, err error) {
 		verbose:      verbose,
 		services:     make(map[string]*Service),
 		workers:      make(map[string]*Worker),
-		waiting:      make([]*Worker, 0),
 		heartbeat_at: time.Now().Add(HEARTBEAT_INTERVAL),
+		spans:        make(map[string]*llibrary.Span),
+		limiter:      llibrary.NewRateLimiter(),
+		stats: Stats{
+			Requests: make(map[string]int64),
+			Replies:  make(map[string]int64),
+			Errors:   make(map[string]int64),
+		},
+		queue_limits: map[string]QueueLimit{
+			"": {
+				Length: DEFAULT_QUEUE_LENGTH,
+				Bytes:  DEFAULT_QUEUE_BYTES,
+				Expiry: int(DEFAULT_QUEUE_EXPIRY / time.Millisecond),
+			},
+		},
 	}
 	broker.socket, err = zmq.NewSocket(zmq.ROUTER)
 
@@ -98,38 +290,63 @@ func (broker *Broker) Bind(endpoint string) (err error) {
 	return
 }
 
-//  The WorkerMsg method processes one READY, REPLY, HEARTBEAT or
-//  DISCONNECT message sent to the broker by a worker:
+//  The WorkerMsg method processes one READY, REPLY (or PARTIAL and FINAL),
+//  HEARTBEAT or DISCONNECT message sent to the broker by a worker:
 
-func (broker *Broker) WorkerMsg(sender string, msg []string) {
+func (broker *Broker) WorkerMsg(sender, header string, msg []string) {
 	//  At least, command
 	if len(msg) == 0 {
-		panic("len(msg) == 0")
+		broker.countError("invalid_message")
+		log.Printf("E: empty message from worker %q\n", sender)
+		return
 	}
 
 	command, msg := popStr(msg)
+	if header == llibrary.MDP_WORKER {
+		command = from_mdp02[command]
+	}
 	id_string := fmt.Sprintf("%q", sender)
 	_, worker_ready := broker.workers[id_string]
 	worker := broker.WorkerRequire(sender)
+	worker.header = header
 
 	switch command {
 	case mdapi.MDPW_READY:
 		if worker_ready { //  Not first command in session
 			worker.Delete(true)
+		} else if len(msg) == 0 { //  No service name
+			broker.countError("invalid_message")
+			log.Printf("E: READY without a service from worker %s\n", id_string)
+			worker.Delete(true)
 		} else if len(sender) >= 4 /*  Reserved service name */ && sender[:4] == "mmi." {
 			worker.Delete(true)
 		} else {
-			//  Attach worker to service and mark as idle
+			//  Attach worker to service, with the requests it takes at
+			//  once if it says, and mark as idle
 			worker.service = broker.ServiceRequire(msg[0])
+			if len(msg) > 1 {
+				capacity, err := strconv.Atoi(msg[1])
+				if err != nil || capacity < 1 {
+					broker.countError("invalid_message")
+					log.Printf("E: invalid worker concurrency %q\n", msg[1])
+					worker.Delete(true)
+					break
+				}
+				worker.capacity = capacity
+				worker.tagged = true
+			}
 			worker.Waiting()
 		}
 	case mdapi.MDPW_REPLY:
 		if worker_ready {
-			//  Remove & save client return envelope and insert the
-			//  protocol header and service name, then rewrap envelope.
-			client, msg := unwrap(msg)
-			broker.socket.SendMessage(client, "", mdapi.MDPC_CLIENT, worker.service.name, msg)
-			worker.Waiting()
+			worker.Reply(msg, true)
+		} else {
+			worker.Delete(true)
+		}
+	case MDPW_PARTIAL:
+		//  The worker keeps the request until its final reply
+		if worker_ready {
+			worker.Reply(msg, false)
 		} else {
 			worker.Delete(true)
 		}
@@ -142,21 +359,36 @@ func (broker *Broker) WorkerMsg(sender string, msg []string) {
 	case mdapi.MDPW_DISCONNECT:
 		worker.Delete(false)
 	default:
+		broker.countError("invalid_message")
 		log.Printf("E: invalid input message %q\n", msg)
 	}
 }
 
 //  Process a request coming from a client. We implement MMI requests
-//  directly here (at present, we implement only the mmi.service request):
+//  directly here. Other requests are refused, with the reply "RateLimited"
+//  and a frame saying when to try again, if the client is over a rate
+//  limit, or if the service's queue is full:
 
-func (broker *Broker) ClientMsg(sender string, msg []string) {
-	//  Service name + body
+func (broker *Broker) ClientMsg(sender, header string, msg []string) {
+	//  Service name + body, or properties
 	if len(msg) < 2 {
-		panic("len(msg) < 2")
+		broker.countError("invalid_message")
+		log.Printf("E: request too short from client %q: %q\n", sender, msg)
+		return
 	}
 
 	service_frame, msg := popStr(msg)
-	service := broker.ServiceRequire(service_frame)
+	var properties llibrary.Properties
+	if header == llibrary.MDP_CLIENT {
+		var frame string
+		var err error
+		frame, msg = popStr(msg)
+		if properties, err = llibrary.ParseProperties(frame); err != nil {
+			broker.countError("invalid_message")
+			log.Printf("E: invalid properties from client: %q\n", frame)
+			return
+		}
+	}
 
 	//  Set reply return identity to client sender
 	m := []string{sender, ""}
@@ -164,47 +396,313 @@ func (broker *Broker) ClientMsg(sender string, msg []string) {
 
 	//  If we got a MMI service request, process that internally
 	if len(service_frame) >= 4 && service_frame[:4] == "mmi." {
-		var return_code string
-		if service_frame == "mmi.service" {
-			name := msg[len(msg)-1]
-			service, ok := broker.services[name]
-			if ok && len(service.waiting) > 0 {
-				return_code = "200"
-			} else {
-				return_code = "404"
-			}
-		} else {
-			return_code = "501"
-		}
-
+		return_code, reply := broker.MMI(service_frame, msg[len(msg)-1])
 		msg[len(msg)-1] = return_code
+		msg = append(msg, reply...)
 
-		//  Remove & save client return envelope and insert the
-		//  protocol header and service name, then rewrap envelope.
 		client, msg := unwrap(msg)
-		broker.socket.SendMessage(client, "", mdapi.MDPC_CLIENT, service_frame, msg)
+		broker.SendToClient(client, header, service_frame, true, msg)
+	} else if retry_after, ok := broker.limiter.Allow(sender, service_frame); !ok {
+		broker.countError("rate_limited")
+		rate_limited_total.Inc(service_frame)
+		broker.SendToClient(sender, header, service_frame, true,
+			[]string{"RateLimited", llibrary.RetryAfterFrame(retry_after)})
 	} else {
 		//  Else dispatch the message to the requested service
-		service.Dispatch(msg)
+		service := broker.ServiceRequire(service_frame)
+		requests_total.Inc(service.name)
+		broker.stats.Requests[service.name]++
+		request := NewRequest(msg, properties)
+		request.header = header
+		request.expiry = request.deadline
+		if expiry := broker.QueueLimit(service.name).Expiry; request.expiry.IsZero() && expiry > 0 {
+			request.expiry = request.queued.Add(time.Duration(expiry) * time.Millisecond)
+		}
+		if service.Full(request) {
+			broker.countError("queue_full")
+			queue_full_total.Inc(service.name)
+			if broker.verbose {
+				log.Printf("W: queue full for service %s\n", service.name)
+			}
+			broker.SendToClient(sender, header, service_frame, true, []string{"QueueFull"})
+			return
+		}
+		broker.StartSpan(service, request)
+		service.Dispatch(request)
 	}
 }
 
-//  The purge method deletes any idle workers that haven't pinged us in a
-//  while. We hold workers from oldest to most recent, so we can stop
-//  scanning whenever we find a live worker. This means we'll mainly stop
-//  at the first worker, which is essential when we have large numbers of
-//  workers (since we call this method in our critical path):
+//  Sends a reply to a client, inserting the protocol header and service
+//  name, and for MDP/0.2 whether it is the final reply, after the return
+//  envelope
+
+func (broker *Broker) SendToClient(client, header, service string, final bool, msg []string) {
+	if header != llibrary.MDP_CLIENT {
+		broker.socket.SendMessage(client, "", mdapi.MDPC_CLIENT, service, msg)
+		return
+	}
+	command := llibrary.MDPC_PARTIAL
+	if final {
+		command = llibrary.MDPC_FINAL
+	}
+	broker.socket.SendMessage(client, "", header, command, service, msg)
+}
+
+//  A client may send its trace context in the request's properties. If
+//  it did, start the broker's span for the request, and pass the span's
+//  own context on to the worker in place of the client's. The span
+//  covers queueing as well as processing, and ends with the reply.
+
+func (broker *Broker) StartSpan(service *Service, request *Request) {
+	parent, ok := request.properties.Trace()
+	if !ok {
+		return
+	}
+	span := llibrary.StartSpan("mdbroker "+service.name, llibrary.SPAN_KIND_SERVER, parent)
+	broker.spans[span.Context.SpanID] = span
+	request.properties.SetTrace(span.Context)
+}
+
+//  Takes the span of a request dispatched to a worker from those waiting
+
+func (broker *Broker) takeSpan(worker *Worker, request *Request) {
+	if sc, ok := request.properties.Trace(); ok {
+		request.span = broker.spans[sc.SpanID]
+		request.span.SetAttribute("worker", worker.id_string)
+		delete(broker.spans, sc.SpanID)
+	}
+}
+
+//  Ends the span of a request that will not be dispatched
+
+func (broker *Broker) dropSpan(request *Request, err error) {
+	if sc, ok := request.properties.Trace(); ok {
+		if span, ok := broker.spans[sc.SpanID]; ok {
+			span.SetError(err)
+			span.End()
+			delete(broker.spans, sc.SpanID)
+		}
+	}
+}
+
+//  A client may also send its time budget in the request's properties.
+//  The request's deadline is taken from it on arrival, and the budget is
+//  rewritten with what is left when the request is dispatched, so the
+//  worker's budget does not include time spent queueing.
+
+func NewRequest(msg []string, properties llibrary.Properties) *Request {
+	request := &Request{msg: msg, properties: properties, queued: time.Now()}
+	for _, frame := range msg {
+		request.size += len(frame)
+	}
+	if properties != nil {
+		request.size += len(properties.Frame())
+	}
+	if budget, ok := properties.Budget(); ok {
+		request.deadline = time.Now().Add(budget)
+	}
+	return request
+}
+
+//  Whether the request has passed its expiry
+
+func (request *Request) Expired(now time.Time) bool {
+	return !request.expiry.IsZero() && now.After(request.expiry)
+}
+
+//  The request as sent to a worker: the client envelope, then for an
+//  MDP/0.2 worker the properties, with what is left of the budget, then
+//  the body
+
+func (request *Request) workerMsg(worker *Worker) []string {
+	if worker.header != llibrary.MDP_WORKER {
+		return request.msg
+	}
+	properties := request.properties
+	if properties == nil {
+		properties = llibrary.NewProperties()
+	}
+	if !request.deadline.IsZero() {
+		properties.SetBudget(time.Until(request.deadline))
+	}
+	client, body := unwrap(request.msg)
+	return append([]string{client, "", properties.Frame()}, body...)
+}
+
+//  Answers an MMI request, given the last frame of its body
+
+func (broker *Broker) MMI(service_frame, body string) (return_code string, reply []string) {
+	switch service_frame {
+	case "mmi.service":
+		service, ok := broker.services[body]
+		if ok && len(service.waiting) > 0 {
+			return "200", nil
+		}
+		return "404", nil
+	case "mmi.services":
+		names := make([]string, 0, len(broker.services))
+		for name := range broker.services {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return mmiReply(names)
+	case "mmi.workers":
+		attached := make(map[*Service]int)
+		in_progress := make(map[*Service]int)
+		for _, worker := range broker.workers {
+			attached[worker.service]++
+			in_progress[worker.service] += len(worker.requests)
+		}
+		return broker.mmiReport(body, func(service *Service) interface{} {
+			return WorkerCounts{
+				Workers:    attached[service],
+				Waiting:    len(service.waiting),
+				InProgress: in_progress[service],
+			}
+		})
+	case "mmi.queue":
+		now := time.Now()
+		return broker.mmiReport(body, func(service *Service) interface{} {
+			queue := QueueStats{Depth: len(service.requests), Bytes: service.bytes}
+			if queue.Depth > 0 {
+				queue.OldestAge = now.Sub(service.requests[0].queued).Milliseconds()
+			}
+			return queue
+		})
+	case "mmi.stats":
+		return mmiReply(broker.stats)
+	case "mmi.ratelimit":
+		return broker.RateLimitCommand(body)
+	case "mmi.queuelimit":
+		return broker.QueueLimitCommand(body)
+	}
+	broker.countError("mmi_unsupported")
+	return "501", nil
+}
+
+//  Replies 200 with value as JSON
+
+func mmiReply(value interface{}) (return_code string, reply []string) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "500", []string{err.Error()}
+	}
+	return "200", []string{string(data)}
+}
+
+//  Replies with a report on the service named, or 404 if there is no
+//  such service, or on every service if none is named
+
+func (broker *Broker) mmiReport(name string, report func(*Service) interface{}) (return_code string, reply []string) {
+	reports := make(map[string]interface{})
+	for _, service := range broker.services {
+		if name == "" || service.name == name {
+			reports[service.name] = report(service)
+		}
+	}
+	if name != "" && len(reports) == 0 {
+		return "404", nil
+	}
+	return mmiReply(reports)
+}
+
+//  Counts an error in the metrics and in mmi.stats
+
+func (broker *Broker) countError(reason string) {
+	errors_total.Inc(reason)
+	broker.stats.Errors[reason]++
+}
+
+//  The mmi.ratelimit request sets the limit it is sent as JSON, unless
+//  it is sent an empty body, and replies with the limits in force. Limits
+//  on clients are keyed by their socket identities.
+
+func (broker *Broker) RateLimitCommand(body string) (return_code string, reply []string) {
+	if body != "" {
+		var limit llibrary.Limit
+		err := json.Unmarshal([]byte(body), &limit)
+		if err == nil {
+			err = broker.limiter.SetLimit(limit)
+		}
+		if err != nil {
+			broker.countError("invalid_message")
+			return "400", []string{err.Error()}
+		}
+		if broker.verbose {
+			log.Printf("I: rate limit set: %+v\n", limit)
+		}
+	}
+	limits, _ := json.Marshal(broker.limiter.Limits())
+	return "200", []string{string(limits)}
+}
+
+//  The mmi.queuelimit request sets the queue limit it is sent as JSON,
+//  unless it is sent an empty body, and replies with the limits in force.
+//  A limit of 0 on length, bytes and expiry for a service removes its
+//  own, leaving it the default.
+
+func (broker *Broker) QueueLimitCommand(body string) (return_code string, reply []string) {
+	if body != "" {
+		var limit QueueLimit
+		err := json.Unmarshal([]byte(body), &limit)
+		if err == nil && (limit.Length < 0 || limit.Bytes < 0 || limit.Expiry < 0) {
+			err = errors.New("Error:BadLimit:negative")
+		}
+		if err != nil {
+			broker.countError("invalid_message")
+			return "400", []string{err.Error()}
+		}
+		if limit.Service != "" && limit.Length == 0 && limit.Bytes == 0 && limit.Expiry == 0 {
+			delete(broker.queue_limits, limit.Service)
+		} else {
+			broker.queue_limits[limit.Service] = limit
+		}
+		if broker.verbose {
+			log.Printf("I: queue limit set: %+v\n", limit)
+		}
+	}
+	limits := make([]QueueLimit, 0, len(broker.queue_limits))
+	for _, limit := range broker.queue_limits {
+		limits = append(limits, limit)
+	}
+	sort.Slice(limits, func(i, j int) bool { return limits[i].Service < limits[j].Service })
+	return mmiReply(limits)
+}
+
+//  The queue limit a service is held to
+
+func (broker *Broker) QueueLimit(service string) QueueLimit {
+	if limit, ok := broker.queue_limits[service]; ok {
+		return limit
+	}
+	return broker.queue_limits[""]
+}
+
+//  The purge method deletes any workers that haven't pinged us in a
+//  while, busy or not, except one that takes a request at a time and is
+//  busy with it, and drops expired requests from the queues. We call this
+//  method in our critical path, so it sweeps only every EXPIRY_INTERVAL,
+//  which is essential when we have large numbers of workers. A deleted
+//  worker's requests go back on the queue:
 
 func (broker *Broker) Purge() {
 	now := time.Now()
-	for len(broker.waiting) > 0 {
-		if broker.waiting[0].expiry.After(now) {
-			break //  Worker is alive, we're done here
+	if !now.After(broker.expire_at) {
+		return
+	}
+	broker.expire_at = now.Add(EXPIRY_INTERVAL)
+	for _, worker := range broker.workers {
+		if worker.expiry.After(now) || !worker.tagged && len(worker.requests) > 0 {
+			continue //  Worker is alive, or silent at work
 		}
 		if broker.verbose {
-			log.Println("I: deleting expired worker:", broker.waiting[0].id_string)
+			log.Println("I: deleting expired worker:", worker.id_string)
 		}
-		broker.waiting[0].Delete(false)
+		broker.countError("worker_expired")
+		worker.Delete(false)
+	}
+	for _, service := range broker.services {
+		service.ExpireRequests(now)
 	}
 }
 
@@ -220,7 +718,7 @@ func (broker *Broker) ServiceRequire(service_frame string) (service *Service) {
 		service = &Service{
 			broker:   broker,
 			name:     name,
-			requests: make([][]string, 0),
+			requests: make([]*Request, 0),
 			waiting:  make([]*Worker, 0),
 		}
 		broker.services[name] = service
@@ -231,23 +729,133 @@ func (broker *Broker) ServiceRequire(service_frame string) (service *Service) {
 	return
 }
 
-//  The dispatch method sends requests to waiting workers:
+//  Whether queueing a request would take the service over its limits.
+//  A request that would go straight to a waiting worker always fits.
 
-func (service *Service) Dispatch(msg []string) {
+func (service *Service) Full(request *Request) bool {
+	if len(service.waiting) > 0 {
+		return false
+	}
+	limit := service.broker.QueueLimit(service.name)
+	if limit.Length > 0 && len(service.requests) >= limit.Length {
+		return true
+	}
+	return limit.Bytes > 0 && service.bytes+request.size > limit.Bytes
+}
+
+//  The dispatch method sends requests to waiting workers. A worker with
+//  room for another request goes to the back of the line again:
 
-	if len(msg) > 0 {
-		//  Queue message if any
-		service.requests = append(service.requests, msg)
+func (service *Service) Dispatch(request *Request) {
+
+	if request != nil {
+		//  Queue request if any
+		service.requests = append(service.requests, request)
+		service.bytes += request.size
 	}
 
 	service.broker.Purge()
 	for len(service.waiting) > 0 && len(service.requests) > 0 {
+		request, service.requests = popRequest(service.requests)
+		service.bytes -= request.size
+		//  Expired since the last sweep
+		if request.Expired(time.Now()) {
+			service.Expire(request)
+			continue
+		}
 		var worker *Worker
 		worker, service.waiting = popWorker(service.waiting)
-		service.broker.waiting = delWorker(service.broker.waiting, worker)
-		msg, service.requests = popMsg(service.requests)
-		worker.Send(mdapi.MDPW_REQUEST, "", msg)
+		msg := request.workerMsg(worker)
+		service.broker.sequence++
+		request.id = strconv.FormatUint(service.broker.sequence, 10)
+		service.broker.takeSpan(worker, request)
+		request.sent_at = time.Now()
+		worker.requests[request.id] = request
+		if worker.tagged {
+			worker.Send(mdapi.MDPW_REQUEST, request.id, msg)
+		} else {
+			worker.Send(mdapi.MDPW_REQUEST, "", msg)
+		}
+		if len(worker.requests) < worker.capacity {
+			service.waiting = append(service.waiting, worker)
+		}
+	}
+	service.Report()
+}
+
+//  Puts the requests a deleted worker had in progress back at the front
+//  of the queue, oldest first, for another worker. A request whose client
+//  has had partial replies cannot be started over, so its client gets the
+//  reply "WorkerLost" instead.
+
+func (service *Service) Requeue(requests map[string]*Request) {
+	broker := service.broker
+	requeued := make([]*Request, 0, len(requests))
+	for _, request := range requests {
+		if request.streamed {
+			broker.countError("worker_lost")
+			request.span.SetError(errors.New("worker deleted after partial reply"))
+			request.span.End()
+			client, _ := unwrap(request.msg)
+			broker.SendToClient(client, request.header, service.name, true, []string{"WorkerLost"})
+			continue
+		}
+		//  The next worker starts afresh, with the span waiting again
+		request.held = nil
+		if request.span != nil {
+			broker.spans[request.span.Context.SpanID] = request.span
+			request.span = nil
+		}
+		service.bytes += request.size
+		requeued = append(requeued, request)
 	}
+	sort.Slice(requeued, func(i, j int) bool { return requeued[i].queued.Before(requeued[j].queued) })
+	service.requests = append(requeued, service.requests...)
+	service.Dispatch(nil)
+}
+
+//  Drops the service's expired requests
+
+func (service *Service) ExpireRequests(now time.Time) {
+	kept := service.requests[:0]
+	for _, request := range service.requests {
+		if request.Expired(now) {
+			service.bytes -= request.size
+			service.Expire(request)
+		} else {
+			kept = append(kept, request)
+		}
+	}
+	if len(kept) < len(service.requests) {
+		service.requests = kept
+		service.Report()
+	}
+}
+
+//  Counts a request dropped from the queue for expiring, and tells its
+//  client, unless the client's own deadline has passed and it has given
+//  up already
+
+func (service *Service) Expire(request *Request) {
+	broker := service.broker
+	broker.countError("expired")
+	expired_total.Inc(service.name)
+	if broker.verbose {
+		log.Printf("I: request for %s expired in queue\n", service.name)
+	}
+	broker.dropSpan(request, errors.New("request expired in queue"))
+	if request.deadline.IsZero() {
+		client, _ := unwrap(request.msg)
+		broker.SendToClient(client, request.header, service.name, true, []string{"Expired"})
+	}
+}
+
+//  Brings the service's gauges up to date
+
+func (service *Service) Report() {
+	queue_depth.Set(float64(len(service.requests)), service.name)
+	queue_bytes.Set(float64(service.bytes), service.name)
+	waiting_workers.Set(float64(len(service.waiting)), service.name)
 }
 
 //  Here is the implementation of the methods that work on a worker:
@@ -265,8 +873,11 @@ func (broker *Broker) WorkerRequire(identity string) (worker *Worker) {
 			broker:    broker,
 			id_string: id_string,
 			identity:  identity,
+			capacity:  1,
+			requests:  make(map[string]*Request),
 		}
 		broker.workers[id_string] = worker
+		workers_total.Set(float64(len(broker.workers)))
 		if broker.verbose {
 			log.Printf("I: registering new worker: %s\n", id_string)
 		}
@@ -283,9 +894,15 @@ func (worker *Worker) Delete(disconnect bool) {
 
 	if worker.service != nil {
 		worker.service.waiting = delWorker(worker.service.waiting, worker)
+		worker.service.Report()
 	}
-	worker.broker.waiting = delWorker(worker.broker.waiting, worker)
 	delete(worker.broker.workers, worker.id_string)
+	workers_total.Set(float64(len(worker.broker.workers)))
+
+	if worker.service != nil && len(worker.requests) > 0 {
+		worker.service.Requeue(worker.requests)
+		worker.requests = make(map[string]*Request)
+	}
 }
 
 //  The send method formats and sends a command to a worker. The caller may
@@ -305,6 +922,10 @@ func (worker *Worker) Send(command, option string, msg []string) (err error) {
 	}
 	m[3] = command
 	m[2] = mdapi.MDPW_WORKER
+	if worker.header == llibrary.MDP_WORKER {
+		m[3] = to_mdp02[command]
+		m[2] = llibrary.MDP_WORKER
+	}
 
 	//  Stack routing envelope to start of message
 	m[1] = ""
@@ -317,70 +938,163 @@ func (worker *Worker) Send(command, option string, msg []string) (err error) {
 	return
 }
 
+//  Passes a reply from the worker on to the client of the request it
+//  answers, found by its ID or, for a worker that takes one at a time, as
+//  the only one in progress. A client that takes only one reply gets the
+//  partial replies with the final one.
+
+func (worker *Worker) Reply(msg []string, final bool) {
+	var id string
+	if worker.tagged && len(msg) > 0 {
+		id, msg = popStr(msg)
+	} else {
+		for id = range worker.requests {
+		}
+	}
+	request, ok := worker.requests[id]
+	if !ok || len(msg) == 0 {
+		worker.broker.countError("invalid_message")
+		log.Printf("E: reply for no request in progress: %q\n", msg)
+		return
+	}
+	worker.expiry = time.Now().Add(HEARTBEAT_EXPIRY)
+
+	//  Remove & save client return envelope
+	client, msg := unwrap(msg)
+	if request.header != llibrary.MDP_CLIENT && !final {
+		request.held = append(request.held, msg...)
+		return
+	}
+	if !final {
+		request.streamed = true
+	}
+	if len(request.held) > 0 {
+		msg = append(request.held, msg...)
+		request.held = nil
+	}
+	worker.broker.SendToClient(client, request.header, worker.service.name, final, msg)
+	if final {
+		worker.Complete(request)
+	}
+}
+
+//  Ends a request the worker has sent its final reply to. A worker that
+//  was full is waiting for work again.
+
+func (worker *Worker) Complete(request *Request) {
+	service := worker.service
+	replies_total.Inc(service.name)
+	worker.broker.stats.Replies[service.name]++
+	request_duration.ObserveSince(request.sent_at, service.name)
+	request.span.End()
+	delete(worker.requests, request.id)
+	if len(worker.requests) == worker.capacity-1 {
+		worker.Waiting()
+	}
+}
+
 //  This worker is now waiting for work
 
 func (worker *Worker) Waiting() {
-	//  Queue to broker and service waiting lists
-	worker.broker.waiting = append(worker.broker.waiting, worker)
+	//  Queue to service waiting list
 	worker.service.waiting = append(worker.service.waiting, worker)
 	worker.expiry = time.Now().Add(HEARTBEAT_EXPIRY)
-	worker.service.Dispatch([]string{})
+	worker.service.Dispatch(nil)
 }
 
 //  Finally here is the main task. We create a new broker instance and
 //  then processes messages on the broker socket:
 
-func main() {
-	verbose := false
-	if len(os.Args) > 1 && os.Args[1] == "-v" {
-		verbose = true
-	}
-
-	broker, _ := NewBroker(verbose)
-	broker.Bind("tcp://*:5555")
-
+//  Gets and processes messages until ctx is done or the socket is
+//  interrupted. The poll is cut short so that ctx is noticed promptly
+//  even between heartbeats.
+func (broker *Broker) Run(ctx context.Context) error {
 	poller := zmq.NewPoller()
 	poller.Add(broker.socket, zmq.POLLIN)
 
-	//  Get and process messages forever or until interrupted
-	for {
-		polled, err := poller.Poll(HEARTBEAT_INTERVAL)
+	for ctx.Err() == nil {
+		polled, err := poller.Poll(RUN_POLL_INTERVAL)
 		if err != nil {
-			break //  Interrupted
+			return err //  Interrupted
 		}
 
 		//  Process next input message, if any
 		if len(polled) > 0 {
 			msg, err := broker.socket.RecvMessage(0)
 			if err != nil {
-				break //  Interrupted
+				return err //  Interrupted
 			}
 			if broker.verbose {
 				log.Printf("I: received message: %q\n", msg)
 			}
-			sender, msg := popStr(msg)
-			_, msg = popStr(msg)
-			header, msg := popStr(msg)
-
-			switch header {
-			case mdapi.MDPC_CLIENT:
-				broker.ClientMsg(sender, msg)
-			case mdapi.MDPW_WORKER:
-				broker.WorkerMsg(sender, msg)
-			default:
-				log.Printf("E: invalid message: %q\n", msg)
-			}
+			broker.RouteMsg(msg)
 		}
-		//  Disconnect and delete any expired workers
-		//  Send heartbeats to idle workers if needed
+		//  Disconnect and delete any expired workers, and drop any
+		//  expired requests
+		broker.Purge()
+		//  Send heartbeats to all workers if needed, busy ones too
 		if time.Now().After(broker.heartbeat_at) {
-			broker.Purge()
-			for _, worker := range broker.waiting {
+			for _, worker := range broker.workers {
 				worker.Send(mdapi.MDPW_HEARTBEAT, "", []string{})
 			}
 			broker.heartbeat_at = time.Now().Add(HEARTBEAT_INTERVAL)
 		}
 	}
+	return ctx.Err()
+}
+
+//  Passes a message from the socket to ClientMsg or WorkerMsg, by the
+//  protocol header after the sender's identity and empty frame. A message
+//  too short to have one is counted and dropped, as is anything else not
+//  understood.
+
+func (broker *Broker) RouteMsg(msg []string) {
+	if len(msg) < 3 {
+		broker.countError("invalid_message")
+		log.Printf("E: invalid message: %q\n", msg)
+		return
+	}
+	sender, msg := popStr(msg)
+	_, msg = popStr(msg)
+	header, msg := popStr(msg)
+
+	switch header {
+	case mdapi.MDPC_CLIENT:
+		broker.ClientMsg(sender, header, msg)
+	case llibrary.MDP_CLIENT:
+		//  Of the commands, clients send only requests
+		if len(msg) > 0 && msg[0] == llibrary.MDPC_REQUEST {
+			broker.ClientMsg(sender, header, msg[1:])
+		} else {
+			broker.countError("invalid_message")
+			log.Printf("E: invalid client command: %q\n", msg)
+		}
+	case mdapi.MDPW_WORKER, llibrary.MDP_WORKER:
+		broker.WorkerMsg(sender, header, msg)
+	default:
+		broker.countError("invalid_message")
+		log.Printf("E: invalid message: %q\n", msg)
+	}
+}
+
+func main() {
+	verbose := false
+	if len(os.Args) > 1 && os.Args[1] == "-v" {
+		verbose = true
+	}
+
+	if err := llibrary.InitTracing("mdbroker"); err != nil {
+		log.Println(err)
+	}
+
+	llibrary.InitMetrics()
+
+	broker, _ := NewBroker(verbose)
+	broker.Bind("tcp://*:5555")
+
+	if err := broker.Run(context.Background()); err != nil {
+		log.Println(err)
+	}
 	log.Println("W: interrupt received, shutting down...")
 }
 
@@ -403,9 +1117,9 @@ func popStr(ss []string) (s string, ss2 []string) {
 	return
 }
 
-func popMsg(msgs [][]string) (msg []string, msgs2 [][]string) {
-	msg = msgs[0]
-	msgs2 = msgs[1:]
+func popRequest(requests []*Request) (request *Request, requests2 []*Request) {
+	request = requests[0]
+	requests2 = requests[1:]
 	return
 }
 
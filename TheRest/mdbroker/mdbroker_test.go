@@ -0,0 +1,698 @@
+package main
+
+import (
+	zmq "github.com/pebbe/zmq4"
+	"github.com/pebbe/zmq4/examples/mdapi"
+
+	"context"
+	"encoding/json"
+	"harness"
+	llibrary "llibrary"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+//  Starts a broker on a fresh endpoint, stopped when the test ends
+func startBroker(t *testing.T) string {
+	broker, err := NewBroker(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := harness.Endpoint("mdbroker")
+	if err = broker.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		broker.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		broker.Close()
+	})
+	return endpoint
+}
+
+//  Starts an echo worker for service. An mdapi worker can only be
+//  stopped from its own goroutine, so it is left running for the rest of
+//  the test binary; with its broker gone it just retries quietly.
+func startWorker(t *testing.T, endpoint, service string) {
+	worker, err := mdapi.NewMdwrk(endpoint, service, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var request, reply []string
+		for {
+			request, err = worker.Recv(reply)
+			if err != nil {
+				break
+			}
+			reply = request
+		}
+		worker.Close()
+	}()
+}
+
+func newClient(t *testing.T, endpoint string) *mdapi.Mdcli {
+	client, err := mdapi.NewMdcli(endpoint, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetTimeout(harness.WAIT_TIMEOUT)
+	client.SetRetries(1)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestEcho(t *testing.T) {
+	endpoint := startBroker(t)
+	startWorker(t, endpoint, "echo")
+	client := newClient(t, endpoint)
+
+	for _, body := range []string{"Hello", "World"} {
+		reply, err := client.Send("echo", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply) != 1 || reply[0] != body {
+			t.Fatalf("got %q for %q", reply, body)
+		}
+	}
+}
+
+func TestMMIService(t *testing.T) {
+	endpoint := startBroker(t)
+	startWorker(t, endpoint, "echo")
+	client := newClient(t, endpoint)
+
+	//  A worker announces its service as soon as it connects
+	harness.Eventually(t, func() bool {
+		reply, err := client.Send("mmi.service", "echo")
+		return err == nil && len(reply) == 1 && reply[0] == "200"
+	}, "echo to be served")
+	reply, err := client.Send("mmi.service", "nosuch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 1 || reply[0] != "404" {
+		t.Fatalf("got %q for an unknown service", reply)
+	}
+}
+
+func TestQueuedUntilWorker(t *testing.T) {
+	endpoint := startBroker(t)
+	client := newClient(t, endpoint)
+
+	//  A request for a service with no workers waits for one
+	replies := make(chan []string)
+	go func() {
+		reply, _ := client.Send("late", "Hello")
+		replies <- reply
+	}()
+	time.Sleep(100 * time.Millisecond)
+	startWorker(t, endpoint, "late")
+	if reply := <-replies; len(reply) != 1 || reply[0] != "Hello" {
+		t.Fatalf("got %q", reply)
+	}
+}
+
+//  Starts an MDP/0.2 worker for service that answers each request with
+//  its properties frame, then the body. Like the mdapi worker, it is left
+//  running.
+func startPropertiesWorker(t *testing.T, endpoint, service string) {
+	worker, err := llibrary.NewMDPWorker(endpoint, service, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			properties, request, err := worker.Recv()
+			if err != nil {
+				break
+			}
+			worker.Final(append([]string{properties.Frame()}, request...)...)
+		}
+		worker.Close()
+	}()
+}
+
+func TestDeadlineShrinksWhileQueued(t *testing.T) {
+	endpoint := startBroker(t)
+	client, err := llibrary.NewMDPClient(endpoint, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetTimeout(harness.WAIT_TIMEOUT)
+
+	//  The echoed properties show what the worker was given
+	properties := llibrary.NewProperties()
+	properties.SetBudget(time.Second)
+	if err = client.SendProperties("budget", properties, "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	startPropertiesWorker(t, endpoint, "budget")
+	_, reply, _, err := client.Recv()
+	if err != nil || len(reply) != 2 || reply[1] != "Hello" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+	properties, _ = llibrary.ParseProperties(reply[0])
+	if budget, ok := properties.Budget(); !ok || budget > 800*time.Millisecond {
+		t.Fatalf("worker was given %q after queueing", reply[0])
+	}
+}
+
+func TestRequestProperties(t *testing.T) {
+	broker, err := NewBroker(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	trace := llibrary.StartSpan("test", llibrary.SPAN_KIND_CLIENT, llibrary.SpanContext{}).Context
+	properties := llibrary.NewProperties()
+	properties.SetTrace(trace)
+	properties.SetBudget(time.Second)
+
+	//  An MDP/0.2 request's properties give its deadline, and go to an
+	//  MDP/0.2 worker ahead of the body, but not to an MDP/0.1 one
+	request := NewRequest([]string{"client", "", "Hello"}, properties)
+	if request.deadline.IsZero() {
+		t.Fatal("no deadline from the properties")
+	}
+	msg := request.workerMsg(&Worker{header: llibrary.MDP_WORKER})
+	if len(msg) != 4 || msg[2] != request.properties.Frame() || msg[3] != "Hello" {
+		t.Fatalf("got %q", msg)
+	}
+	if msg = request.workerMsg(&Worker{header: mdapi.MDPW_WORKER}); len(msg) != 3 || msg[2] != "Hello" {
+		t.Fatalf("got %q", msg)
+	}
+
+	//  Body frames are never taken for properties, whatever they hold
+	body := []string{"client", "", properties.Frame(), trace.Frame(), "Hello"}
+	request = NewRequest(body, nil)
+	if !request.deadline.IsZero() {
+		t.Fatal("deadline for a request without one")
+	}
+	if msg = request.workerMsg(&Worker{header: llibrary.MDP_WORKER}); len(msg) != 6 || msg[2] != "" || msg[3] != properties.Frame() {
+		t.Fatalf("got %q", msg)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	endpoint := startBroker(t)
+	startWorker(t, endpoint, "echo")
+	client := newClient(t, endpoint)
+
+	reply, err := client.Send("mmi.ratelimit", `{"Service":"echo","Rate":0.1}`)
+	if err != nil || len(reply) != 2 || reply[0] != "200" || reply[1] != `[{"Service":"echo","Rate":0.1,"Burst":1}]` {
+		t.Fatalf("got %q, %v setting a limit", reply, err)
+	}
+	if reply, err = client.Send("echo", "Hello"); err != nil || reply[0] != "Hello" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+	reply, err = client.Send("echo", "Hello")
+	if err != nil || len(reply) != 2 || reply[0] != "RateLimited" {
+		t.Fatalf("got %q, %v over the limit", reply, err)
+	}
+	if retry_after, ok := llibrary.ParseRetryAfterFrame(reply[1]); !ok || retry_after > 10*time.Second {
+		t.Fatalf("got %q", reply)
+	}
+
+	if reply, err = client.Send("mmi.ratelimit", `{"Service":"echo"}`); err != nil || reply[0] != "200" {
+		t.Fatalf("got %q, %v removing the limit", reply, err)
+	}
+	if reply, err = client.Send("mmi.ratelimit", "nonsense"); err != nil || reply[0] != "400" {
+		t.Fatalf("got %q, %v for a bad limit", reply, err)
+	}
+}
+
+func TestMMI(t *testing.T) {
+	endpoint := startBroker(t)
+	startWorker(t, endpoint, "echo")
+	client := newClient(t, endpoint)
+	harness.Eventually(t, func() bool {
+		reply, err := client.Send("mmi.service", "echo")
+		return err == nil && len(reply) == 1 && reply[0] == "200"
+	}, "echo to be served")
+	if reply, err := client.Send("echo", "Hello"); err != nil || reply[0] != "Hello" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+
+	for _, c := range []struct{ service, body, want string }{
+		{"mmi.services", "", `["echo"]`},
+		{"mmi.workers", "", `{"echo":{"Workers":1,"Waiting":1,"InProgress":0}}`},
+		{"mmi.workers", "echo", `{"echo":{"Workers":1,"Waiting":1,"InProgress":0}}`},
+		{"mmi.queue", "echo", `{"echo":{"Depth":0,"Bytes":0,"OldestAge":0}}`},
+		{"mmi.stats", "", `{"Requests":{"echo":1},"Replies":{"echo":1},"Errors":{}}`},
+	} {
+		reply, err := client.Send(c.service, c.body)
+		if err != nil || len(reply) != 2 || reply[0] != "200" || reply[1] != c.want {
+			t.Errorf("got %q, %v from %s %q", reply, err, c.service, c.body)
+		}
+	}
+	if reply, err := client.Send("mmi.queue", "nosuch"); err != nil || len(reply) != 1 || reply[0] != "404" {
+		t.Fatalf("got %q, %v for an unknown service", reply, err)
+	}
+	if reply, err := client.Send("mmi.nosuch", ""); err != nil || len(reply) != 1 || reply[0] != "501" {
+		t.Fatalf("got %q, %v for an unknown MMI request", reply, err)
+	}
+}
+
+func TestMMIQueue(t *testing.T) {
+	broker := &Broker{services: make(map[string]*Service), workers: make(map[string]*Worker)}
+	service := broker.ServiceRequire("slow")
+	service.requests = append(service.requests, &Request{queued: time.Now().Add(-time.Second)}, &Request{queued: time.Now()})
+	return_code, reply := broker.MMI("mmi.queue", "")
+	var queues map[string]QueueStats
+	if return_code != "200" || len(reply) != 1 || json.Unmarshal([]byte(reply[0]), &queues) != nil {
+		t.Fatalf("got %s %q", return_code, reply)
+	}
+	if queue := queues["slow"]; queue.Depth != 2 || queue.OldestAge < 1000 || queue.OldestAge > 2000 {
+		t.Fatalf("got %+v", queue)
+	}
+}
+
+//  Starts an MDP/0.2 worker for service that streams each frame of a
+//  request back as a partial reply, then ends with "Done". Like the
+//  mdapi worker, it is left running.
+func startStreamer(t *testing.T, endpoint, service string) {
+	worker, err := llibrary.NewMDPWorker(endpoint, service, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			_, request, err := worker.Recv()
+			if err != nil {
+				break
+			}
+			for _, frame := range request {
+				worker.Partial(frame)
+			}
+			worker.Final("Done")
+		}
+		worker.Close()
+	}()
+}
+
+func TestStreaming(t *testing.T) {
+	endpoint := startBroker(t)
+	startStreamer(t, endpoint, "tail")
+	client, err := llibrary.NewMDPClient(endpoint, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetTimeout(harness.WAIT_TIMEOUT)
+
+	if err = client.Send("tail", "one", "two"); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for final := false; !final; {
+		var service string
+		var reply []string
+		if service, reply, final, err = client.Recv(); err != nil {
+			t.Fatal(err)
+		}
+		if service != "tail" || len(reply) != 1 {
+			t.Fatalf("got %q from %q", reply, service)
+		}
+		got = append(got, reply[0])
+	}
+	if strings.Join(got, ",") != "one,two,Done" {
+		t.Fatalf("got %q", got)
+	}
+
+	//  Replies from an MDP/0.1 worker are final
+	startWorker(t, endpoint, "echo")
+	if err = client.Send("echo", "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, reply, final, err := client.Recv(); err != nil || !final || len(reply) != 1 || reply[0] != "Hello" {
+		t.Fatalf("got %q, %t, %v", reply, final, err)
+	}
+}
+
+func TestWorkerCapacity(t *testing.T) {
+	broker, err := NewBroker(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	broker.WorkerMsg("worker", llibrary.MDP_WORKER, []string{llibrary.MDPW_READY, "busy", "2"})
+	worker := broker.workers[`"worker"`]
+	service := broker.services["busy"]
+
+	//  The worker takes two requests, and the third waits
+	for _, body := range []string{"one", "two", "three"} {
+		service.Dispatch(NewRequest([]string{"client", "", body}, nil))
+	}
+	if len(worker.requests) != 2 || len(service.requests) != 1 || len(service.waiting) != 0 {
+		t.Fatalf("got %d in progress, %d queued, %d waiting",
+			len(worker.requests), len(service.requests), len(service.waiting))
+	}
+
+	//  A reply for an unknown request changes nothing
+	broker.WorkerMsg("worker", llibrary.MDP_WORKER, []string{llibrary.MDPW_FINAL, "nosuch", "client", "", "Done"})
+	if len(worker.requests) != 2 || broker.stats.Errors["invalid_message"] != 1 {
+		t.Fatalf("got %d in progress, %v", len(worker.requests), broker.stats.Errors)
+	}
+
+	//  A partial reply keeps the request, and the final one makes room
+	//  for the third
+	broker.WorkerMsg("worker", llibrary.MDP_WORKER, []string{llibrary.MDPW_PARTIAL, "1", "client", "", "Half"})
+	if len(worker.requests) != 2 || len(worker.requests["1"].held) != 1 {
+		t.Fatalf("got %d in progress", len(worker.requests))
+	}
+	broker.WorkerMsg("worker", llibrary.MDP_WORKER, []string{llibrary.MDPW_FINAL, "1", "client", "", "Done"})
+	if _, ok := worker.requests["3"]; !ok || len(worker.requests) != 2 || len(service.requests) != 0 {
+		t.Fatalf("got %d in progress, %d queued", len(worker.requests), len(service.requests))
+	}
+	if broker.stats.Replies["busy"] != 1 {
+		t.Fatalf("got %v", broker.stats.Replies)
+	}
+}
+
+func TestWorkerLost(t *testing.T) {
+	broker, err := NewBroker(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	broker.WorkerMsg("worker", llibrary.MDP_WORKER, []string{llibrary.MDPW_READY, "busy", "2"})
+	service := broker.services["busy"]
+
+	//  The first client has had a partial reply, the second nothing yet
+	//  and the third is still queued
+	streaming := NewRequest([]string{"client", "", "one"}, nil)
+	streaming.header = llibrary.MDP_CLIENT
+	service.Dispatch(streaming)
+	for _, body := range []string{"two", "three"} {
+		service.Dispatch(NewRequest([]string{"client", "", body}, nil))
+	}
+	broker.WorkerMsg("worker", llibrary.MDP_WORKER, []string{llibrary.MDPW_PARTIAL, "1", "client", "", "Half"})
+
+	//  Once the worker is gone, the second goes back ahead of the third
+	broker.WorkerMsg("worker", llibrary.MDP_WORKER, []string{llibrary.MDPW_DISCONNECT})
+	if len(service.requests) != 2 || service.requests[0].msg[2] != "two" || service.requests[1].msg[2] != "three" {
+		t.Fatalf("got %d queued", len(service.requests))
+	}
+	if service.bytes != service.requests[0].size+service.requests[1].size {
+		t.Fatalf("got %d bytes queued", service.bytes)
+	}
+	if broker.stats.Errors["worker_lost"] != 1 {
+		t.Fatalf("got %v", broker.stats.Errors)
+	}
+
+	//  A READY without a service is refused
+	broker.WorkerMsg("empty", llibrary.MDP_WORKER, []string{llibrary.MDPW_READY})
+	if _, ok := broker.workers[`"empty"`]; ok || broker.stats.Errors["invalid_message"] != 1 {
+		t.Fatalf("got %v", broker.stats.Errors)
+	}
+}
+
+func TestWorkerExpired(t *testing.T) {
+	broker, err := NewBroker(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	broker.WorkerMsg("full", llibrary.MDP_WORKER, []string{llibrary.MDPW_READY, "busy", "2"})
+	broker.WorkerMsg("single", mdapi.MDPW_WORKER, []string{mdapi.MDPW_READY, "slow"})
+	for _, body := range []string{"one", "two"} {
+		broker.services["busy"].Dispatch(NewRequest([]string{"client", "", body}, nil))
+	}
+	broker.services["slow"].Dispatch(NewRequest([]string{"client", "", "three"}, nil))
+
+	//  Both go quiet while busy. The worker that takes two at once should
+	//  have heartbeated throughout, and is lost, but the other may still
+	//  be at work.
+	for _, worker := range broker.workers {
+		worker.expiry = time.Now().Add(-time.Second)
+	}
+	broker.expire_at = time.Time{}
+	broker.Purge()
+	if _, ok := broker.workers[`"full"`]; ok || len(broker.services["busy"].requests) != 2 {
+		t.Fatalf("got %d queued", len(broker.services["busy"].requests))
+	}
+	if worker, ok := broker.workers[`"single"`]; !ok || len(worker.requests) != 1 {
+		t.Fatalf("lost the busy worker that takes one request")
+	}
+	if broker.stats.Errors["worker_expired"] != 1 {
+		t.Fatalf("got %v", broker.stats.Errors)
+	}
+}
+
+//  A broker that goes quiet while requests are at work is not given up on,
+//  since that would drop their replies
+func TestServeOutlastsQuietBroker(t *testing.T) {
+	router, err := zmq.NewSocket(zmq.ROUTER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	router.SetLinger(0)
+	router.SetRcvtimeo(harness.WAIT_TIMEOUT)
+	endpoint := harness.Endpoint("quiet")
+	if err = router.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	worker, err := llibrary.NewMDPWorker(endpoint, "slow", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker.SetHeartbeat(20 * time.Millisecond)
+	worker.SetReconnect(20 * time.Millisecond)
+	go func() {
+		worker.Serve(1, func(properties llibrary.Properties, request []string, partial func(...string)) []string {
+			time.Sleep(300 * time.Millisecond)
+			return request
+		})
+		worker.Close()
+	}()
+
+	ready, err := router.RecvMessage(0)
+	if err != nil || len(ready) < 4 || ready[3] != llibrary.MDPW_READY {
+		t.Fatalf("got %q, %v", ready, err)
+	}
+	router.SendMessage(ready[0], "", llibrary.MDP_WORKER, llibrary.MDPW_REQUEST, "1", "client", "", "", "Hello")
+	for {
+		msg, err := router.RecvMessage(0)
+		if err != nil || len(msg) < 4 {
+			t.Fatalf("got %q, %v", msg, err)
+		}
+		switch msg[3] {
+		case llibrary.MDPW_HEARTBEAT:
+			continue
+		case llibrary.MDPW_FINAL:
+			if msg[0] != ready[0] || msg[len(msg)-1] != "Hello" {
+				t.Fatalf("got %q", msg)
+			}
+			return
+		default:
+			t.Fatalf("got %q before the reply", msg)
+		}
+	}
+}
+
+func TestConcurrentWorker(t *testing.T) {
+	endpoint := startBroker(t)
+	worker, err := llibrary.NewMDPWorker(endpoint, "slow", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//  Each request is held until both have arrived, which they only do
+	//  if the broker sends the second before the first is answered
+	arrived := make(chan bool)
+	release := make(chan bool)
+	go func() {
+		worker.Serve(2, func(properties llibrary.Properties, request []string, partial func(...string)) []string {
+			arrived <- true
+			<-release
+			return request
+		})
+		worker.Close()
+	}()
+
+	client, err := llibrary.NewMDPClient(endpoint, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetTimeout(harness.WAIT_TIMEOUT)
+	for _, body := range []string{"one", "two"} {
+		if err = client.Send("slow", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-arrived:
+		case <-time.After(harness.WAIT_TIMEOUT):
+			t.Fatalf("%d requests in progress at once", i)
+		}
+	}
+	close(release)
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		_, reply, final, err := client.Recv()
+		if err != nil || !final || len(reply) != 1 {
+			t.Fatalf("got %q, %t, %v", reply, final, err)
+		}
+		got = append(got, reply[0])
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "one,two" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestStreamingToMDP01Client(t *testing.T) {
+	endpoint := startBroker(t)
+	startStreamer(t, endpoint, "tail")
+	client := newClient(t, endpoint)
+
+	//  The partial replies come all at once, with the final one
+	reply, err := client.Send("tail", "one", "two")
+	if err != nil || strings.Join(reply, ",") != "one,two,Done" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	broker, err := NewBroker(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	if return_code, reply := broker.QueueLimitCommand(`{"Service":"small","Length":2,"Bytes":30}`); return_code != "200" ||
+		reply[0] != `[{"Length":10000,"Bytes":67108864,"Expiry":60000},{"Service":"small","Length":2,"Bytes":30,"Expiry":0}]` {
+		t.Fatalf("got %s %q", return_code, reply)
+	}
+	if return_code, _ := broker.QueueLimitCommand(`{"Service":"small","Length":-1}`); return_code != "400" {
+		t.Fatalf("got %s for a negative limit", return_code)
+	}
+
+	//  Two short requests fit, and a third does not
+	service := broker.ServiceRequire("small")
+	for i := 0; i < 2; i++ {
+		request := NewRequest([]string{"client", "", "Hello"}, nil)
+		if service.Full(request) {
+			t.Fatalf("full after %d requests", i)
+		}
+		service.Dispatch(request)
+	}
+	if !service.Full(NewRequest([]string{"client", "", "Hello"}, nil)) {
+		t.Fatal("third request fits")
+	}
+
+	//  Nor does one too big on its own, once the length allows it
+	broker.QueueLimitCommand(`{"Service":"small","Length":10,"Bytes":30}`)
+	if !service.Full(NewRequest([]string{"client", "", "Hello, this is rather long"}, nil)) {
+		t.Fatal("long request fits")
+	}
+
+	//  Without a limit of its own the service has the default
+	broker.QueueLimitCommand(`{"Service":"small"}`)
+	if limit := broker.QueueLimit("small"); limit.Length != DEFAULT_QUEUE_LENGTH || limit.Bytes != DEFAULT_QUEUE_BYTES {
+		t.Fatalf("got %+v", limit)
+	}
+}
+
+func TestExpireRequests(t *testing.T) {
+	broker, err := NewBroker(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	//  One past its expiry, one with none and one not yet expired
+	service := broker.ServiceRequire("slow")
+	now := time.Now()
+	for _, expiry := range []time.Time{now.Add(-time.Second), {}, now.Add(time.Second)} {
+		request := NewRequest([]string{"client", "", "Hello"}, nil)
+		request.expiry = expiry
+		service.Dispatch(request)
+	}
+	service.ExpireRequests(now)
+	if len(service.requests) != 2 || !service.requests[0].expiry.IsZero() {
+		t.Fatalf("got %d requests, first expiring at %v", len(service.requests), service.requests[0].expiry)
+	}
+	if service.bytes != service.requests[0].size+service.requests[1].size {
+		t.Fatalf("got %d bytes queued", service.bytes)
+	}
+	if broker.stats.Errors["expired"] != 1 {
+		t.Fatalf("got %v", broker.stats.Errors)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	endpoint := startBroker(t)
+	client := newClient(t, endpoint)
+	if reply, err := client.Send("mmi.queuelimit", `{"Service":"late","Expiry":100}`); err != nil || reply[0] != "200" {
+		t.Fatalf("got %q, %v setting a limit", reply, err)
+	}
+
+	//  With no workers, the request waits until it expires
+	reply, err := client.Send("late", "Hello")
+	if err != nil || len(reply) != 1 || reply[0] != "Expired" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	endpoint := startBroker(t)
+	client := newClient(t, endpoint)
+	if reply, err := client.Send("mmi.queuelimit", `{"Service":"late","Length":1}`); err != nil || reply[0] != "200" {
+		t.Fatalf("got %q, %v setting a limit", reply, err)
+	}
+
+	//  With no workers, one request waits and the next is refused
+	go newClient(t, endpoint).Send("late", "First")
+	harness.Eventually(t, func() bool {
+		reply, err := client.Send("mmi.queue", "late")
+		return err == nil && len(reply) == 2 && strings.Contains(reply[1], `"Depth":1`)
+	}, "request to queue")
+	reply, err := client.Send("late", "Second")
+	if err != nil || len(reply) != 1 || reply[0] != "QueueFull" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+}
+
+func TestShortMessages(t *testing.T) {
+	broker, err := NewBroker(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	//  Each is counted and dropped, and none stops the broker
+	short := [][]string{
+		{},
+		{"client"},
+		{"client", ""},
+		{"client", "", mdapi.MDPC_CLIENT, "echo"},
+		{"client", "", llibrary.MDP_CLIENT},
+		{"client", "", llibrary.MDP_CLIENT, llibrary.MDPC_REQUEST, "echo"},
+		{"worker", "", llibrary.MDP_WORKER},
+	}
+	for _, msg := range short {
+		broker.RouteMsg(msg)
+	}
+	if n := broker.stats.Errors["invalid_message"]; n != int64(len(short)) {
+		t.Fatalf("counted %d of %d", n, len(short))
+	}
+	if len(broker.services) != 0 || len(broker.workers) != 0 {
+		t.Fatalf("got %d services, %d workers", len(broker.services), len(broker.workers))
+	}
+}
@@ -1,28 +1,49 @@
 //
 //  Majordomo Protocol client example.
-//  Uses the mdcli API to hide all MDP aspects
+//  Uses the MDP/0.2 client API to hide all MDP aspects
 //
 
 package main
 
 import (
-	"github.com/pebbe/zmq4/examples/mdapi"
-
 	"fmt"
+	llibrary "llibrary"
 	"log"
 	"os"
+	"time"
 )
 
+//  How long the client waits for each reply; the worker is told how much
+//  of it is left when the request reaches it
+const REQUEST_TIMEOUT = 2500 * time.Millisecond
+
 func main() {
 	var verbose bool
 	if len(os.Args) > 1 && os.Args[1] == "-v" {
 		verbose = true
 	}
-	session, _ := mdapi.NewMdcli("tcp://localhost:5555", verbose)
+	if err := llibrary.InitTracing("mdclient"); err != nil {
+		log.Println(err)
+	}
+	session, err := llibrary.NewMDPClient("tcp://localhost:5555", verbose)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer session.Close()
+	session.SetTimeout(REQUEST_TIMEOUT)
 
 	count := 0
 	for ; count < 100000; count++ {
-		_, err := session.Send("echo", "Hello world")
+		span := llibrary.StartSpan("echo", llibrary.SPAN_KIND_CLIENT, llibrary.SpanContext{})
+		properties := llibrary.NewProperties()
+		properties.SetTrace(span.Context)
+		properties.SetBudget(REQUEST_TIMEOUT)
+		err = session.SendProperties("echo", properties, "Hello world")
+		for final := false; err == nil && !final; {
+			_, _, final, err = session.Recv()
+		}
+		span.SetError(err)
+		span.End()
 		if err != nil {
 			log.Println(err)
 			break //  Interrupt or failure
@@ -0,0 +1,304 @@
+//
+//  HTTP/JSON gateway to Majordomo services.
+//  Maps POST /services/{name} to an MDP request through mdbroker:
+//
+//    X-Frame headers, in order  ->  leading request frames
+//    traceparent header         ->  trace context, in the properties
+//    body, or each part of a    ->  one request frame each
+//    multipart body
+//    reply frames               ->  JSON array of strings
+//
+//  The gateway speaks MDP/0.2, so that trace context travels in the
+//  request's properties frame rather than in the body. Partial replies
+//  are gathered into one response with the final reply.
+//
+//  Requests are left to the broker to queue until a worker is free, so a
+//  service with no workers answers only when the timeout runs out. mmi.*
+//  requests answer with their MMI code.
+//
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	llibrary "llibrary"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SERVICES_PATH = "/services/"
+	MAX_BODY      = 8 << 20 //  Bytes accepted in a request body
+)
+
+var requests_total = llibrary.DefaultRegistry.NewCounter("mdgateway_requests_total",
+	"HTTP requests per service, by status code", "service", "code")
+
+//  The gateway holds one MDP client session per request it may have in
+//  flight. A session is taken for each request and given back after, so
+//  the pool size is the concurrency limit.
+type Gateway struct {
+	broker   string
+	verbose  bool
+	sessions chan *llibrary.MDPClient
+	timeout  time.Duration //  Longest a request may take
+}
+
+func NewGateway(broker string, concurrency int, timeout time.Duration, verbose bool) (gateway *Gateway, err error) {
+	gateway = &Gateway{
+		broker:   broker,
+		verbose:  verbose,
+		sessions: make(chan *llibrary.MDPClient, concurrency),
+		timeout:  timeout,
+	}
+	for i := 0; i < concurrency; i++ {
+		var session *llibrary.MDPClient
+		session, err = gateway.newSession()
+		if err != nil {
+			return
+		}
+		gateway.sessions <- session
+	}
+	return
+}
+
+func (gateway *Gateway) newSession() (session *llibrary.MDPClient, err error) {
+	return llibrary.NewMDPClient(gateway.broker, gateway.verbose)
+}
+
+//  Returns a session to the pool. A session that timed out may still be
+//  waiting for its reply, so it is replaced by a new one.
+func (gateway *Gateway) release(session *llibrary.MDPClient, timed_out bool) {
+	if timed_out {
+		session.Close()
+		fresh, err := gateway.newSession()
+		if err != nil {
+			log.Println("E: cannot replace session:", err)
+			return
+		}
+		session = fresh
+	}
+	gateway.sessions <- session
+}
+
+//  An error reply, sent as {"error": message}
+type httpError struct {
+	code    int
+	message string
+}
+
+func (e httpError) Error() string {
+	return e.message
+}
+
+func (gateway *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, SERVICES_PATH)
+	reply, err := gateway.serve(name, r)
+	code := http.StatusOK
+	if err != nil {
+		code = http.StatusInternalServerError
+		if e, ok := err.(httpError); ok {
+			code = e.code
+		}
+	}
+	if name != "" && !strings.Contains(name, "/") {
+		requests_total.Inc(name, strconv.Itoa(code))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	if err != nil {
+		encoder.Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if r.URL.Query().Get("encoding") == "base64" {
+		for i := range reply {
+			reply[i] = base64.StdEncoding.EncodeToString([]byte(reply[i]))
+		}
+	}
+	encoder.Encode(reply)
+}
+
+//  Validates and forwards one HTTP request, returning the reply frames
+func (gateway *Gateway) serve(name string, r *http.Request) (reply []string, err error) {
+	if r.Method != http.MethodPost {
+		err = httpError{http.StatusMethodNotAllowed, "use POST"}
+		return
+	}
+	if name == "" || strings.Contains(name, "/") {
+		err = httpError{http.StatusNotFound, "no such path"}
+		return
+	}
+	timeout := gateway.timeout
+	if ms := r.Header.Get("X-Timeout-Ms"); ms != "" {
+		n, e := strconv.Atoi(ms)
+		if e != nil || n <= 0 {
+			err = httpError{http.StatusBadRequest, "bad X-Timeout-Ms"}
+			return
+		}
+		if d := time.Duration(n) * time.Millisecond; d < timeout {
+			timeout = d
+		}
+	}
+	var frames []string
+	frames, err = requestFrames(r)
+	if err != nil {
+		return
+	}
+
+	//  Wait no longer than the timeout for a free session
+	deadline := time.Now().Add(timeout)
+	var session *llibrary.MDPClient
+	select {
+	case session = <-gateway.sessions:
+		defer func() {
+			e, ok := err.(httpError)
+			gateway.release(session, ok && e.code == http.StatusGatewayTimeout)
+		}()
+	case <-time.After(timeout):
+		err = httpError{http.StatusServiceUnavailable, "too many requests in flight"}
+		return
+	}
+
+	parent, _ := llibrary.ParseTraceParent(r.Header.Get("traceparent"))
+	span := llibrary.StartSpan("mdgateway "+name, llibrary.SPAN_KIND_SERVER, parent)
+	defer span.End()
+
+	if strings.HasPrefix(name, "mmi.") {
+		reply, err = gateway.send(session, deadline, name, nil, frames)
+		//  The code takes the place of the last request frame, and some
+		//  MMI requests follow it with more
+		if err == nil && len(reply) >= len(frames) {
+			err = mmiError(reply[len(frames)-1])
+		}
+		span.SetError(err)
+		return
+	}
+
+	properties := llibrary.NewProperties()
+	properties.SetTrace(span.Context)
+	reply, err = gateway.send(session, deadline, name, properties, frames)
+	span.SetError(err)
+	return
+}
+
+//  Sends a request and gathers its replies, partial and final, with
+//  whatever time is left before the deadline
+func (gateway *Gateway) send(session *llibrary.MDPClient, deadline time.Time, name string, properties llibrary.Properties, frames []string) (reply []string, err error) {
+	if time.Until(deadline) <= 0 {
+		err = httpError{http.StatusGatewayTimeout, "timed out before sending to " + name}
+		return
+	}
+	if err = session.SendProperties(name, properties, frames...); err != nil {
+		err = httpError{http.StatusBadGateway, fmt.Sprintf("cannot send to %s: %s", name, err)}
+		return
+	}
+	for final := false; !final; {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			err = httpError{http.StatusGatewayTimeout, fmt.Sprintf("no reply from %s: %s", name, llibrary.ErrNoReply)}
+			return nil, err
+		}
+		session.SetTimeout(remaining)
+		var part []string
+		if _, part, final, err = session.Recv(); err != nil {
+			err = httpError{http.StatusGatewayTimeout, fmt.Sprintf("no reply from %s: %s", name, err)}
+			return nil, err
+		}
+		reply = append(reply, part...)
+	}
+	return
+}
+
+//  Maps an MMI return code to an error, or nil for 200
+func mmiError(code string) error {
+	switch code {
+	case "200":
+		return nil
+	case "404":
+		return httpError{http.StatusNotFound, "service not available"}
+	case "501":
+		return httpError{http.StatusNotImplemented, "not implemented"}
+	}
+	return nil
+}
+
+//  Builds the request frames from the X-Frame headers and the body. A
+//  multipart body gives one frame per part. MDP needs at least one body
+//  frame, so an empty request sends a single empty frame.
+func requestFrames(r *http.Request) (frames []string, err error) {
+	frames = append(frames, r.Header["X-Frame"]...)
+
+	body := io.LimitReader(r.Body, MAX_BODY)
+	media, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if strings.HasPrefix(media, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			var part *multipart.Part
+			part, err = reader.NextPart()
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			if err != nil {
+				err = httpError{http.StatusBadRequest, "bad multipart body: " + err.Error()}
+				return
+			}
+			var b []byte
+			b, err = ioutil.ReadAll(part)
+			if err != nil {
+				err = httpError{http.StatusBadRequest, "bad multipart body: " + err.Error()}
+				return
+			}
+			frames = append(frames, string(b))
+		}
+	} else {
+		var b []byte
+		b, err = ioutil.ReadAll(body)
+		if err != nil {
+			err = httpError{http.StatusBadRequest, "bad body: " + err.Error()}
+			return
+		}
+		if len(b) > 0 {
+			frames = append(frames, string(b))
+		}
+	}
+	if len(frames) == 0 {
+		frames = []string{""}
+	}
+	return
+}
+
+func main() {
+	listen := flag.String("listen", "localhost:8080", "HTTP address to listen at")
+	broker := flag.String("broker", "tcp://localhost:5555", "mdbroker endpoint")
+	concurrency := flag.Int("concurrency", 16, "requests in flight at once")
+	timeout := flag.Duration("timeout", 5*time.Second, "longest a request may take")
+	verbose := flag.Bool("v", false, "log MDP traffic")
+	flag.Parse()
+
+	if err := llibrary.InitTracing("mdgateway"); err != nil {
+		log.Println(err)
+	}
+	gateway, err := NewGateway(*broker, *concurrency, *timeout, *verbose)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(SERVICES_PATH, gateway)
+	mux.Handle(llibrary.METRICS_PATH, llibrary.DefaultRegistry)
+	log.Println("Gateway to", *broker, "at http://"+*listen+SERVICES_PATH)
+	log.Fatalln(http.ListenAndServe(*listen, mux))
+}
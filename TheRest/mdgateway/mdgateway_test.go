@@ -0,0 +1,217 @@
+package main
+
+import (
+	zmq "github.com/pebbe/zmq4"
+
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"harness"
+	llibrary "llibrary"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//  Starts a stand-in for mdbroker that answers MDP/0.2 clients itself:
+//  "echo" sends the properties and body back, "tail" sends each body
+//  frame as a partial reply and then "Done", mmi.service finds no service
+//  and "slow" never answers. It stops when the test ends.
+func startBroker(t *testing.T) string {
+	endpoint := harness.Endpoint("mdgateway")
+	socket, err := zmq.NewSocket(zmq.ROUTER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = socket.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		defer socket.Close()
+		poller := zmq.NewPoller()
+		poller.Add(socket, zmq.POLLIN)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			polled, err := poller.Poll(10 * time.Millisecond)
+			if err != nil {
+				return
+			}
+			if len(polled) == 0 {
+				continue
+			}
+			//  Client identity, empty delimiter, header, command, service,
+			//  properties, body
+			msg, err := socket.RecvMessage(0)
+			if err != nil || len(msg) < 6 {
+				continue
+			}
+			client, service, body := msg[0], msg[4], msg[5:]
+			switch service {
+			case "echo":
+			case "tail":
+				for _, frame := range msg[6:] {
+					socket.SendMessage(client, "", llibrary.MDP_CLIENT, llibrary.MDPC_PARTIAL, service, frame)
+				}
+				body = []string{"Done"}
+			case "mmi.service":
+				body = msg[6:]
+				body[len(body)-1] = "404"
+			default:
+				continue
+			}
+			socket.SendMessage(client, "", llibrary.MDP_CLIENT, llibrary.MDPC_FINAL, service, body)
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+	return endpoint
+}
+
+func newGateway(t *testing.T) *httptest.Server {
+	gateway, err := NewGateway(startBroker(t), 2, harness.WAIT_TIMEOUT, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+	return server
+}
+
+//  Posts to the gateway and decodes the JSON it answers with
+func post(t *testing.T, request *http.Request) (code int, reply interface{}) {
+	t.Helper()
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if err = json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, reply
+}
+
+func newRequest(t *testing.T, method, url, body string) *http.Request {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+//  The reply frames that follow the properties the echo service sends
+//  back, which must hold a trace context
+func payload(t *testing.T, reply interface{}) (frames []string) {
+	t.Helper()
+	list, ok := reply.([]interface{})
+	if !ok || len(list) == 0 {
+		t.Fatalf("got %v", reply)
+	}
+	properties, _ := llibrary.ParseProperties(list[0].(string))
+	if _, ok = properties.Trace(); !ok {
+		t.Fatalf("no trace context in %q", list[0])
+	}
+	for _, frame := range list[1:] {
+		frames = append(frames, frame.(string))
+	}
+	return
+}
+
+func TestEcho(t *testing.T) {
+	server := newGateway(t)
+
+	//  Header frames go first, then the body
+	request := newRequest(t, http.MethodPost, server.URL+"/services/echo", "Hello")
+	request.Header.Add("X-Frame", "one")
+	request.Header.Add("X-Frame", "two")
+	code, reply := post(t, request)
+	if frames := payload(t, reply); code != http.StatusOK || strings.Join(frames, ",") != "one,two,Hello" {
+		t.Fatalf("got %d %q", code, frames)
+	}
+
+	//  Body frames that look like trace context reach the service as sent
+	request = newRequest(t, http.MethodPost, server.URL+"/services/echo", "traceparent:Hello")
+	code, reply = post(t, request)
+	if frames := payload(t, reply); code != http.StatusOK || strings.Join(frames, ",") != "traceparent:Hello" {
+		t.Fatalf("got %d %q", code, frames)
+	}
+
+	//  And come back in base64 if asked
+	code, reply = post(t, newRequest(t, http.MethodPost, server.URL+"/services/echo?encoding=base64", "Hello"))
+	list, _ := reply.([]interface{})
+	if code != http.StatusOK || len(list) != 2 || list[1] != base64.StdEncoding.EncodeToString([]byte("Hello")) {
+		t.Fatalf("got %d %q", code, reply)
+	}
+}
+
+func TestPartialReplies(t *testing.T) {
+	server := newGateway(t)
+	request := newRequest(t, http.MethodPost, server.URL+"/services/tail", "")
+	request.Header.Add("X-Frame", "one")
+	request.Header.Add("X-Frame", "two")
+	code, reply := post(t, request)
+	list, _ := reply.([]interface{})
+	if code != http.StatusOK || len(list) != 3 || list[0] != "one" || list[1] != "two" || list[2] != "Done" {
+		t.Fatalf("got %d %q", code, reply)
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	server := newGateway(t)
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range []string{"one", "two"} {
+		field, _ := writer.CreateFormField(part)
+		field.Write([]byte(part))
+	}
+	writer.Close()
+
+	request := newRequest(t, http.MethodPost, server.URL+"/services/echo", body.String())
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	code, reply := post(t, request)
+	if frames := payload(t, reply); code != http.StatusOK || strings.Join(frames, ",") != "one,two" {
+		t.Fatalf("got %d %q", code, frames)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server := newGateway(t)
+	for _, test := range []struct {
+		method, path, timeout string
+		code                  int
+	}{
+		{http.MethodGet, "/services/echo", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/services/", "", http.StatusNotFound},
+		{http.MethodPost, "/services/echo", "soon", http.StatusBadRequest},
+		{http.MethodPost, "/services/mmi.service", "", http.StatusNotFound},
+		{http.MethodPost, "/services/slow", "100", http.StatusGatewayTimeout},
+	} {
+		request := newRequest(t, test.method, server.URL+test.path, "echo")
+		if test.timeout != "" {
+			request.Header.Set("X-Timeout-Ms", test.timeout)
+		}
+		code, reply := post(t, request)
+		message, _ := reply.(map[string]interface{})
+		if _, ok := message["error"]; code != test.code || !ok {
+			t.Fatalf("%s %s: got %d %v", test.method, test.path, code, reply)
+		}
+	}
+
+	//  The session that timed out was replaced, so the gateway still works
+	code, reply := post(t, newRequest(t, http.MethodPost, server.URL+"/services/echo", "Hello"))
+	if frames := payload(t, reply); code != http.StatusOK || strings.Join(frames, ",") != "Hello" {
+		t.Fatalf("got %d %q", code, frames)
+	}
+}
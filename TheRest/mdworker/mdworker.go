@@ -1,15 +1,17 @@
 //
 //  Majordomo Protocol worker example.
-//  Uses the mdwrk API to hide all MDP aspects
+//  Uses the MDP/0.2 worker API to hide all MDP aspects
 //
 
 package main
 
 import (
-	"github.com/pebbe/zmq4/examples/mdapi"
-
+	"context"
+	"fmt"
+	llibrary "llibrary"
 	"log"
 	"os"
+	"time"
 )
 
 func main() {
@@ -17,16 +19,28 @@ func main() {
 	if len(os.Args) > 1 && os.Args[1] == "-v" {
 		verbose = true
 	}
-	session, _ := mdapi.NewMdwrk("tcp://localhost:5555", "echo", verbose)
+	if err := llibrary.InitTracing("mdworker"); err != nil {
+		log.Println(err)
+	}
+	session, _ := llibrary.NewMDPWorker("tcp://localhost:5555", "echo", verbose)
+	defer session.Close()
 
-	var err error
-	var request, reply []string
 	for {
-		request, err = session.Recv(reply)
+		properties, request, err := session.Recv()
 		if err != nil {
+			log.Println(err)
 			break //  Worker was interrupted
 		}
-		reply = request //  Echo is complex... :-)
+		//  Traced requests carry the broker's trace context, and what is
+		//  left of the client's time budget
+		parent, _ := properties.Trace()
+		ctx, cancel := properties.Context(context.Background())
+		span := llibrary.StartSpan("echo", llibrary.SPAN_KIND_SERVER, parent)
+		if deadline, ok := ctx.Deadline(); ok && verbose {
+			fmt.Println("Time left:", time.Until(deadline))
+		}
+		session.Final(request...) //  Echo is complex... :-)
+		span.End()
+		cancel()
 	}
-	log.Println(err)
 }
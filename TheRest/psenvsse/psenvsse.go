@@ -0,0 +1,242 @@
+//
+//  Pubsub envelope to Server-Sent Events bridge.
+//  Subscribes to a PUB endpoint such as psenvpub's and streams messages
+//  to browsers at GET /events?topic=A&topic=B. Each connection gets only
+//  the topics it asks for, by prefix as with SetSubscribe, or every topic
+//  if it names none. Each event carries
+//
+//    id: <sequence number>
+//    data: {"topic": <envelope>, "frames": [<contents>...]}
+//
+//  A browser that reconnects with Last-Event-ID is first sent the events
+//  it missed, as far back as the replay buffer goes.
+//
+
+package main
+
+import (
+	zmq "github.com/pebbe/zmq4"
+
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EVENTS_PATH   = "/events"
+	CLIENT_BUFFER = 256  //  Events queued per connection before it is dropped
+	RETRY_MS      = 3000 //  Browser reconnect delay
+)
+
+type Event struct {
+	ID     uint64
+	Topic  string
+	Frames []string
+}
+
+//  The hub numbers published events, keeps the latest for replay and
+//  hands each to every connected client that wants it
+type Hub struct {
+	mutex   sync.Mutex
+	next    uint64  //  ID of the next event
+	buffer  []Event //  Latest events, oldest first
+	size    int     //  Most events kept for replay
+	clients map[*Client]bool
+}
+
+//  One browser connection
+type Client struct {
+	topics []string
+	events chan Event //  Closed if the client falls too far behind
+}
+
+func NewHub(size int) *Hub {
+	return &Hub{
+		next:    1,
+		size:    size,
+		clients: make(map[*Client]bool),
+	}
+}
+
+func (client *Client) Wants(topic string) bool {
+	if len(client.topics) == 0 {
+		return true
+	}
+	for _, prefix := range client.topics {
+		if strings.HasPrefix(topic, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+//  Numbers an event, keeps it for replay and sends it to clients. A client
+//  too slow to keep up is dropped; it can reconnect and replay.
+func (hub *Hub) Publish(topic string, frames []string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	event := Event{hub.next, topic, frames}
+	hub.next++
+	hub.buffer = append(hub.buffer, event)
+	if len(hub.buffer) > hub.size {
+		hub.buffer = hub.buffer[len(hub.buffer)-hub.size:]
+	}
+	for client := range hub.clients {
+		if !client.Wants(topic) {
+			continue
+		}
+		select {
+		case client.events <- event:
+		default:
+			close(client.events)
+			delete(hub.clients, client)
+		}
+	}
+}
+
+//  Connects a client and returns the events it missed after last_id, if
+//  it is reconnecting. Replay and live events cannot overlap or leave a
+//  gap, since both are decided under the hub's lock.
+func (hub *Hub) Subscribe(topics []string, last_id uint64, reconnecting bool) (client *Client, replay []Event) {
+	client = &Client{topics, make(chan Event, CLIENT_BUFFER)}
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.clients[client] = true
+	if !reconnecting {
+		return
+	}
+	//  An ID from before a bridge restart is meaningless; replay it all
+	if last_id >= hub.next {
+		last_id = 0
+	}
+	for _, event := range hub.buffer {
+		if event.ID > last_id && client.Wants(event.Topic) {
+			replay = append(replay, event)
+		}
+	}
+	return
+}
+
+func (hub *Hub) Unsubscribe(client *Client) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if hub.clients[client] {
+		close(client.events)
+		delete(hub.clients, client)
+	}
+}
+
+//  Serves the event stream to one browser
+type Bridge struct {
+	hub       *Hub
+	heartbeat time.Duration
+}
+
+func (bridge *Bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	//  EventSource sends Last-Event-ID itself; the query parameter is for
+	//  clients that cannot set headers
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.URL.Query().Get("lastEventId")
+	}
+	last_id, err := strconv.ParseUint(last, 10, 64)
+	if last != "" && err != nil {
+		http.Error(w, "bad Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+
+	client, replay := bridge.hub.Subscribe(r.URL.Query()["topic"], last_id, last != "")
+	defer bridge.hub.Unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	fmt.Fprintf(w, "retry: %d\n\n", RETRY_MS)
+	for _, event := range replay {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(bridge.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-client.events:
+			if !ok {
+				return //  Too slow; the browser will reconnect and replay
+			}
+			writeEvent(w, event)
+		case <-heartbeat.C:
+			//  A comment line keeps proxies from closing an idle stream
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event Event) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"topic":  event.Topic,
+		"frames": event.Frames,
+	})
+	fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ID, data)
+}
+
+//  Reads envelopes from the subscriber and publishes them to the hub.
+//  Only this goroutine touches the socket.
+func relay(subscriber *zmq.Socket, hub *Hub) {
+	for {
+		msg, err := subscriber.RecvMessage(0)
+		if err != nil {
+			log.Println("E: receive failed:", err)
+			return
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		hub.Publish(msg[0], msg[1:])
+	}
+}
+
+func main() {
+	endpoint := flag.String("pub", "tcp://localhost:5563", "PUB endpoint to subscribe to")
+	subscribe := flag.String("subscribe", "", "comma-separated topic prefixes to subscribe to; all if empty")
+	listen := flag.String("listen", "localhost:8081", "HTTP address to listen at")
+	size := flag.Int("replay", 1000, "events kept for replay on reconnect")
+	heartbeat := flag.Duration("heartbeat", 15*time.Second, "interval between heartbeats on idle streams")
+	flag.Parse()
+
+	//  Prepare our subscriber
+	subscriber, _ := zmq.NewSocket(zmq.SUB)
+	defer subscriber.Close()
+	subscriber.Connect(*endpoint)
+	for _, topic := range strings.Split(*subscribe, ",") {
+		subscriber.SetSubscribe(topic)
+	}
+
+	hub := NewHub(*size)
+	go relay(subscriber, hub)
+
+	mux := http.NewServeMux()
+	mux.Handle(EVENTS_PATH, &Bridge{hub, *heartbeat})
+	log.Println("Streaming", *endpoint, "at http://"+*listen+EVENTS_PATH)
+	log.Fatalln(http.ListenAndServe(*listen, mux))
+}
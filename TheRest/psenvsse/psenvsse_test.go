@@ -0,0 +1,138 @@
+package main
+
+import (
+	zmq "github.com/pebbe/zmq4"
+
+	"bufio"
+	"context"
+	"fmt"
+	"harness"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	hub := NewHub(3)
+	for _, topic := range []string{"A", "B", "A", "AB", "B"} {
+		hub.Publish(topic, []string{"Hello"})
+	}
+
+	//  The buffer keeps the last three, and the client missed those after
+	//  3 that match its prefix
+	_, replay := hub.Subscribe([]string{"A"}, 3, true)
+	if len(replay) != 1 || replay[0].ID != 4 || replay[0].Topic != "AB" {
+		t.Fatalf("got %+v", replay)
+	}
+
+	//  An ID from before a restart replays all that is kept, and a new
+	//  client gets nothing
+	if _, replay = hub.Subscribe(nil, 99, true); len(replay) != 3 || replay[0].ID != 3 {
+		t.Fatalf("got %+v", replay)
+	}
+	if _, replay = hub.Subscribe(nil, 0, false); len(replay) != 0 {
+		t.Fatalf("got %+v", replay)
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	hub := NewHub(1)
+	client, _ := hub.Subscribe(nil, 0, false)
+
+	//  A client that reads nothing is dropped once its buffer is full
+	for i := 0; i <= CLIENT_BUFFER; i++ {
+		hub.Publish("A", nil)
+	}
+	for i := 0; i < CLIENT_BUFFER; i++ {
+		<-client.events
+	}
+	if _, ok := <-client.events; ok || len(hub.clients) != 0 {
+		t.Fatal("slow client still connected")
+	}
+	hub.Unsubscribe(client)
+}
+
+//  Reads the stream up to the next event and returns its id and data
+//  lines, skipping the retry and heartbeat lines
+func nextEvent(t *testing.T, stream *bufio.Reader) (id, data string) {
+	t.Helper()
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = line[len("id: "):]
+		case strings.HasPrefix(line, "data: "):
+			data = line[len("data: "):]
+		case line == "" && id != "":
+			return
+		}
+	}
+}
+
+func TestBridge(t *testing.T) {
+	endpoint := harness.Endpoint("psenvsse")
+	publisher, err := zmq.NewSocket(zmq.PUB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	if err = publisher.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	//  The relay blocks receiving for good, so like the psenvsse process
+	//  it is left running with its socket
+	subscriber, err := zmq.NewSocket(zmq.SUB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriber.Connect(endpoint)
+	subscriber.SetSubscribe("")
+	hub := NewHub(10)
+	go relay(subscriber, hub)
+
+	//  Publish until the subscription has taken hold
+	harness.Eventually(t, func() bool {
+		publisher.SendMessage("A", "first")
+		hub.mutex.Lock()
+		defer hub.mutex.Unlock()
+		return hub.next > 1
+	}, "first event to reach the hub")
+
+	server := httptest.NewServer(&Bridge{hub, 10 * time.Millisecond})
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), harness.WAIT_TIMEOUT)
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+EVENTS_PATH+"?topic=A", nil)
+	request.Header.Set("Last-Event-ID", "0")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %q", response.Header.Get("Content-Type"))
+	}
+	stream := bufio.NewReader(response.Body)
+
+	//  The events it missed come first, then live ones on its topic only
+	hub.mutex.Lock()
+	missed := hub.next - 1
+	hub.mutex.Unlock()
+	for i := uint64(1); i <= missed; i++ {
+		if id, data := nextEvent(t, stream); id != fmt.Sprint(i) || data != `{"frames":["first"],"topic":"A"}` {
+			t.Fatalf("got %s %s", id, data)
+		}
+	}
+	publisher.SendMessage("B", "other")
+	publisher.SendMessage("A", "live")
+	if id, data := nextEvent(t, stream); id != fmt.Sprint(missed+2) || data != `{"frames":["live"],"topic":"A"}` {
+		t.Fatalf("got %s %s", id, data)
+	}
+}
@@ -0,0 +1,356 @@
+//
+//  Titanic service, for disconnected reliability on top of mdbroker.
+//  Implements http://rfc.zeromq.org/spec:9 as three MDP services:
+//
+//    titanic.request  service, body...  ->  200, UUID
+//    titanic.reply    UUID              ->  200, reply...  | 300 pending  | 400 unknown
+//    titanic.close    UUID              ->  200
+//
+//  A client submits a request for a service, may then disconnect, and
+//  later collects the reply by the UUID it was given. Requests and
+//  replies are kept on disk, so they survive a restart, and a dispatcher
+//  sends each request to its service until a worker answers it. Delivery
+//  is at least once, so workers should expect repeats.
+//
+
+package main
+
+import (
+	"github.com/pebbe/zmq4/examples/mdapi"
+
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	llibrary "llibrary"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_DIR       = ".titanic"
+	DISPATCH_INTERVAL = time.Second //  Between passes over unanswered requests
+
+	REQUEST_SUFFIX = ".req"
+	REPLY_SUFFIX   = ".rep"
+)
+
+//  Sends a request through the broker and waits for its reply, as an
+//  mdapi client session does
+type Sender interface {
+	Send(service string, request ...string) ([]string, error)
+}
+
+//  The Titanic class holds the store of requests and the queue of those
+//  not yet answered:
+
+type Titanic struct {
+	broker  string
+	dir     string //  Where requests and replies are kept
+	verbose bool
+
+	mutex  sync.Mutex
+	queue  []string  //  UUIDs of requests with no reply, oldest first
+	queued chan bool //  Wakes the dispatcher for a new request
+}
+
+//  Opens the store in dir, creating it if need be, and queues the
+//  requests left unanswered by the last run
+
+func NewTitanic(broker, dir string, verbose bool) (titanic *Titanic, err error) {
+	titanic = &Titanic{
+		broker:  broker,
+		dir:     dir,
+		verbose: verbose,
+		queued:  make(chan bool, 1),
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	requests, err := filepath.Glob(filepath.Join(dir, "*"+REQUEST_SUFFIX))
+	if err != nil {
+		return
+	}
+	modified := make(map[string]time.Time)
+	for _, path := range requests {
+		uuid := strings.TrimSuffix(filepath.Base(path), REQUEST_SUFFIX)
+		if _, err := os.Stat(titanic.path(uuid, REPLY_SUFFIX)); err == nil {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			modified[uuid] = info.ModTime()
+			titanic.queue = append(titanic.queue, uuid)
+		}
+	}
+	sort.Slice(titanic.queue, func(i, j int) bool {
+		return modified[titanic.queue[i]].Before(modified[titanic.queue[j]])
+	})
+	return
+}
+
+func (titanic *Titanic) path(uuid, suffix string) string {
+	return filepath.Join(titanic.dir, uuid+suffix)
+}
+
+//  The titanic.request service stores the request, which is the service
+//  name followed by the body, and queues it for the dispatcher
+
+func (titanic *Titanic) Request(request []string) (reply []string) {
+	if len(request) < 2 || request[0] == "" {
+		return []string{"400"}
+	}
+	uuid := NewUUID()
+	if err := writeFrames(titanic.path(uuid, REQUEST_SUFFIX), request); err != nil {
+		log.Println("E: storing request:", err)
+		return []string{"500"}
+	}
+	titanic.mutex.Lock()
+	titanic.queue = append(titanic.queue, uuid)
+	titanic.mutex.Unlock()
+	select {
+	case titanic.queued <- true:
+	default:
+	}
+	if titanic.verbose {
+		log.Printf("I: queued request %s for %s\n", uuid, request[0])
+	}
+	return []string{"200", uuid}
+}
+
+//  The titanic.reply service returns the reply to a request, or says
+//  that it is still pending, or that there is no such request
+
+func (titanic *Titanic) Reply(request []string) (reply []string) {
+	if len(request) < 1 || !validUUID(request[0]) {
+		return []string{"400"}
+	}
+	uuid := request[0]
+	if frames, err := readFrames(titanic.path(uuid, REPLY_SUFFIX)); err == nil {
+		return append([]string{"200"}, frames...)
+	}
+	if _, err := os.Stat(titanic.path(uuid, REQUEST_SUFFIX)); err == nil {
+		return []string{"300"}
+	}
+	return []string{"400"}
+}
+
+//  The titanic.close service forgets a request and its reply. Closing one
+//  that is unknown, or already closed, is no error.
+
+func (titanic *Titanic) Close(request []string) (reply []string) {
+	if len(request) < 1 || !validUUID(request[0]) {
+		return []string{"400"}
+	}
+	uuid := request[0]
+	titanic.mutex.Lock()
+	titanic.queue = remove(titanic.queue, uuid)
+	titanic.mutex.Unlock()
+	os.Remove(titanic.path(uuid, REQUEST_SUFFIX))
+	os.Remove(titanic.path(uuid, REPLY_SUFFIX))
+	return []string{"200"}
+}
+
+//  The dispatcher makes one pass over the unanswered requests, oldest
+//  first, sending each whose service has a worker. A request answered is
+//  stored and taken off the queue; one that is not stays on it for the
+//  next pass.
+
+func (titanic *Titanic) Dispatch(sender Sender) {
+	titanic.mutex.Lock()
+	queue := append([]string(nil), titanic.queue...)
+	titanic.mutex.Unlock()
+
+	for _, uuid := range queue {
+		request, err := readFrames(titanic.path(uuid, REQUEST_SUFFIX))
+		if err != nil || len(request) == 0 {
+			//  Closed since, or unreadable
+			log.Println("E: reading request:", err)
+			titanic.dequeue(uuid)
+			continue
+		}
+		service := request[0]
+		status, err := sender.Send("mmi.service", service)
+		if err != nil || len(status) == 0 || status[0] != "200" {
+			continue
+		}
+		reply, err := sender.Send(service, request[1:]...)
+		if err != nil {
+			if titanic.verbose {
+				log.Printf("W: no reply from %s for %s: %v\n", service, uuid, err)
+			}
+			continue
+		}
+		//  Closed while we waited, so no one wants the reply
+		if _, err = os.Stat(titanic.path(uuid, REQUEST_SUFFIX)); err != nil {
+			continue
+		}
+		if err = writeFrames(titanic.path(uuid, REPLY_SUFFIX), reply); err != nil {
+			log.Println("E: storing reply:", err)
+			continue
+		}
+		titanic.dequeue(uuid)
+		if titanic.verbose {
+			log.Printf("I: answered request %s\n", uuid)
+		}
+	}
+}
+
+func (titanic *Titanic) dequeue(uuid string) {
+	titanic.mutex.Lock()
+	titanic.queue = remove(titanic.queue, uuid)
+	titanic.mutex.Unlock()
+}
+
+//  Runs the dispatcher until ctx is done, making a pass whenever a
+//  request comes in and every DISPATCH_INTERVAL in between
+
+func (titanic *Titanic) RunDispatcher(ctx context.Context, sender Sender) error {
+	timer := time.NewTimer(DISPATCH_INTERVAL)
+	defer timer.Stop()
+	for {
+		titanic.Dispatch(sender)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(DISPATCH_INTERVAL)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-titanic.queued:
+		case <-timer.C:
+		}
+	}
+}
+
+//  Serves one Titanic service through the broker, answering each
+//  request with handler
+
+func (titanic *Titanic) Serve(service string, handler func([]string) []string) error {
+	worker, err := mdapi.NewMdwrk(titanic.broker, service, titanic.verbose)
+	if err != nil {
+		return err
+	}
+	defer worker.Close()
+	var request, reply []string
+	for {
+		request, err = worker.Recv(reply)
+		if err != nil {
+			return err //  Interrupted
+		}
+		reply = handler(request)
+	}
+}
+
+//  A random UUID, as 32 hex digits
+
+func NewUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+//  Whether s is a UUID as NewUUID makes them, which also keeps it from
+//  naming a file outside the store
+
+func validUUID(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+//  Frames are stored as a JSON list of base64 strings, since they may
+//  hold any bytes. The file is synced, and only then put in place, so a
+//  crash leaves either all of it or nothing.
+
+func writeFrames(path string, frames []string) error {
+	encoded := make([][]byte, len(frames))
+	for i, frame := range frames {
+		encoded[i] = []byte(frame)
+	}
+	data, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+func readFrames(path string) (frames []string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var encoded [][]byte
+	if err = json.Unmarshal(data, &encoded); err != nil {
+		return
+	}
+	for _, frame := range encoded {
+		frames = append(frames, string(frame))
+	}
+	return
+}
+
+func remove(uuids []string, uuid string) []string {
+	for i := 0; i < len(uuids); i++ {
+		if uuids[i] == uuid {
+			uuids = append(uuids[:i], uuids[i+1:]...)
+			i--
+		}
+	}
+	return uuids
+}
+
+func main() {
+	broker := flag.String("broker", "tcp://localhost:5555", "mdbroker endpoint")
+	dir := flag.String("dir", DEFAULT_DIR, "directory to keep requests and replies in")
+	verbose := flag.Bool("v", false, "log MDP traffic")
+	flag.Parse()
+
+	if err := llibrary.InitTracing("titanic"); err != nil {
+		log.Println(err)
+	}
+	titanic, err := NewTitanic(*broker, *dir, *verbose)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	go func() { log.Fatalln(titanic.Serve("titanic.request", titanic.Request)) }()
+	go func() { log.Fatalln(titanic.Serve("titanic.reply", titanic.Reply)) }()
+	go func() { log.Fatalln(titanic.Serve("titanic.close", titanic.Close)) }()
+
+	client, err := mdapi.NewMdcli(*broker, *verbose)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+	log.Println("I: Titanic at", *broker, "keeping requests in", *dir)
+	log.Println(titanic.RunDispatcher(context.Background(), client))
+}
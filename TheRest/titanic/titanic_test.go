@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+//  Answers as a broker would: mmi.service for the services it has, and
+//  each of those by echoing the request
+type fakeBroker struct {
+	services map[string]bool
+	sent     int
+}
+
+func (broker *fakeBroker) Send(service string, request ...string) ([]string, error) {
+	if service == "mmi.service" {
+		if broker.services[request[0]] {
+			return []string{"200"}, nil
+		}
+		return []string{"404"}, nil
+	}
+	if !broker.services[service] {
+		return nil, errors.New("permanent error, abandoning request")
+	}
+	broker.sent++
+	return request, nil
+}
+
+func newTitanic(t *testing.T, dir string) *Titanic {
+	titanic, err := NewTitanic("", dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return titanic
+}
+
+func TestTitanic(t *testing.T) {
+	titanic := newTitanic(t, t.TempDir())
+	reply := titanic.Request([]string{"echo", "Hello", "\xff"})
+	if len(reply) != 2 || reply[0] != "200" || !validUUID(reply[1]) {
+		t.Fatalf("got %q", reply)
+	}
+	uuid := reply[1]
+	if reply = titanic.Reply([]string{uuid}); !reflect.DeepEqual(reply, []string{"300"}) {
+		t.Fatalf("got %q before dispatch", reply)
+	}
+
+	//  Nothing goes until the service has a worker
+	broker := &fakeBroker{services: make(map[string]bool)}
+	titanic.Dispatch(broker)
+	if reply = titanic.Reply([]string{uuid}); reply[0] != "300" {
+		t.Fatalf("got %q with no worker", reply)
+	}
+	broker.services["echo"] = true
+	titanic.Dispatch(broker)
+	titanic.Dispatch(broker)
+	if reply = titanic.Reply([]string{uuid}); !reflect.DeepEqual(reply, []string{"200", "Hello", "\xff"}) {
+		t.Fatalf("got %q", reply)
+	}
+	if broker.sent != 1 {
+		t.Fatalf("sent %d times", broker.sent)
+	}
+
+	if reply = titanic.Close([]string{uuid}); reply[0] != "200" {
+		t.Fatalf("got %q closing", reply)
+	}
+	if reply = titanic.Reply([]string{uuid}); reply[0] != "400" {
+		t.Fatalf("got %q after closing", reply)
+	}
+}
+
+func TestTitanicBadRequests(t *testing.T) {
+	titanic := newTitanic(t, t.TempDir())
+	for _, c := range []struct {
+		handler func([]string) []string
+		request []string
+	}{
+		{titanic.Request, []string{"echo"}},
+		{titanic.Request, []string{"", "Hello"}},
+		{titanic.Reply, []string{"../../etc/passwd"}},
+		{titanic.Reply, []string{NewUUID()}},
+		{titanic.Close, []string{"nonsense"}},
+	} {
+		if reply := c.handler(c.request); reply[0] != "400" {
+			t.Errorf("got %q for %q", reply, c.request)
+		}
+	}
+}
+
+func TestTitanicRestart(t *testing.T) {
+	dir := t.TempDir()
+	first := newTitanic(t, dir)
+	answered := first.Request([]string{"echo", "First"})[1]
+	first.Dispatch(&fakeBroker{services: map[string]bool{"echo": true}})
+	pending := first.Request([]string{"echo", "Second"})[1]
+
+	//  Only the unanswered request is queued again
+	titanic := newTitanic(t, dir)
+	if !reflect.DeepEqual(titanic.queue, []string{pending}) {
+		t.Fatalf("queued %q", titanic.queue)
+	}
+	if reply := titanic.Reply([]string{answered}); !reflect.DeepEqual(reply, []string{"200", "First"}) {
+		t.Fatalf("got %q", reply)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Fatalf("%d files in the store", len(entries))
+	}
+}
@@ -0,0 +1,255 @@
+//
+//  Test harness.
+//  Starts brokers, lookup servers and workers in-process on inproc:// or
+//  temporary ipc:// endpoints, and stops them when the test ends. Helpers
+//  wait for readiness and check replies, so that tests read as the
+//  request flows they exercise.
+//
+
+package harness
+
+import (
+	zmq "github.com/pebbe/zmq4"
+
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	llibrary "llibrary"
+	"path/filepath"
+	"reflect"
+	"rrbroker/broker"
+	"rrbroker/rrapi"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	HEARTBEAT_INTERVAL = 50 * time.Millisecond //  Short, so dead workers are noticed quickly
+	HEARTBEAT_LIVENESS = 3
+	WAIT_TIMEOUT       = 5 * time.Second //  Longest wait for anything to happen
+)
+
+var endpoint_sequence int64
+
+//  A fresh inproc endpoint; name only makes it readable in logs
+func Endpoint(name string) string {
+	return fmt.Sprintf("inproc://%s-%d", name, atomic.AddInt64(&endpoint_sequence, 1))
+}
+
+//  A fresh ipc endpoint in the test's temporary directory, for code that
+//  needs a real transport
+func IPCEndpoint(t testing.TB, name string) string {
+	return "ipc://" + filepath.Join(t.TempDir(), name)
+}
+
+//  Polls cond until it holds, failing the test if it does not within
+//  WAIT_TIMEOUT
+func Eventually(t testing.TB, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(WAIT_TIMEOUT)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting: "+format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//  Reads the value of one series from a registry, written as it appears
+//  in the text format, e.g. `rrbroker_workers{service="echo"}`. A series
+//  that has never been set reads as 0.
+func Metric(t testing.TB, registry *llibrary.Registry, series string) float64 {
+	t.Helper()
+	var text bytes.Buffer
+	if err := registry.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(&text)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, series+" ") {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[len(series)+1:], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	return 0
+}
+
+//  Runs fn in a goroutine until the test ends, then cancels its context
+//  and waits for it to return
+func background(t testing.TB, fn func(ctx context.Context) error) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		if err := fn(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Log(err)
+		}
+		close(done)
+	}()
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+	t.Cleanup(stop)
+	return
+}
+
+//  Starts an rrbroker on a fresh inproc endpoint, with no services file,
+//  its own metrics registry and short heartbeats. Options given override
+//  these. The broker is stopped and closed when the test ends.
+func StartRRBroker(t testing.TB, options ...broker.Option) *broker.Broker {
+	t.Helper()
+	defaults := []broker.Option{
+		broker.WithAddress(Endpoint("rrbroker")),
+		broker.WithServicesFile(""),
+		broker.WithRegistry(llibrary.NewRegistry()),
+		broker.WithHeartbeat(HEARTBEAT_INTERVAL, HEARTBEAT_LIVENESS),
+	}
+	b, err := broker.New(append(defaults, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := background(t, b.Run)
+	t.Cleanup(func() {
+		stop()
+		b.Close()
+	})
+	return b
+}
+
+//  Registers a service with an rrbroker, failing the test if the broker
+//  refuses it
+func RegisterRRService(t testing.TB, endpoint string, service broker.Service) rrapi.Registration {
+	t.Helper()
+	message, err := json.Marshal(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := CallRR(t, endpoint, rrapi.NewRequest(rrapi.REGISTER, string(message)))
+	AssertReply(t, reply, rrapi.STATUS_OK)
+	registration, err := rrapi.ParseRegistration(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registration
+}
+
+//  Starts an rrapi worker for the service at address, with short
+//  heartbeats. The worker stops when the test ends, or earlier if stop is
+//  called, which looks to the broker as if the worker had died.
+func StartRRWorker(t testing.TB, address string, handler rrapi.Handler) (stop func()) {
+	worker := rrapi.NewWorker(address)
+	worker.Heartbeat = HEARTBEAT_INTERVAL
+	worker.Liveness = HEARTBEAT_LIVENESS
+	worker.Reconnect = HEARTBEAT_INTERVAL
+	return background(t, func(ctx context.Context) error {
+		return worker.ServeContext(ctx, handler)
+	})
+}
+
+//  Starts an rrapi worker and waits until the broker counts it among
+//  the service's workers
+func StartReadyRRWorker(t testing.TB, b *broker.Broker, service broker.Service, handler rrapi.Handler) (stop func()) {
+	t.Helper()
+	series := fmt.Sprintf(`rrbroker_workers{service="%s"}`, service.SID)
+	before := Metric(t, b.Registry(), series)
+	stop = StartRRWorker(t, service.Address, handler)
+	Eventually(t, func() bool {
+		return Metric(t, b.Registry(), series) > before
+	}, "worker for %s to be ready", service.SID)
+	return
+}
+
+//  Sends frames on a fresh REQ socket and waits up to WAIT_TIMEOUT for
+//  the reply. Unlike Call it may be used off the test's goroutine.
+func Send(endpoint string, frames ...string) (reply []string, err error) {
+	requester, err := zmq.NewSocket(zmq.REQ)
+	if err != nil {
+		return
+	}
+	defer requester.Close()
+	requester.SetLinger(0)
+	if err = requester.Connect(endpoint); err != nil {
+		return
+	}
+	if _, err = requester.SendMessage(frames); err != nil {
+		return
+	}
+	poller := zmq.NewPoller()
+	poller.Add(requester, zmq.POLLIN)
+	polled, err := poller.Poll(WAIT_TIMEOUT)
+	if err != nil {
+		return
+	}
+	if len(polled) == 0 {
+		err = fmt.Errorf("no reply from %s to %q", endpoint, frames)
+		return
+	}
+	return requester.RecvMessage(0)
+}
+
+//  Sends a request to an rrbroker and waits for its reply, like Send
+func SendRR(endpoint string, request rrapi.Request) (reply rrapi.Reply, err error) {
+	frames, err := Send(endpoint, request.ClientFrames()...)
+	if err != nil {
+		return
+	}
+	return rrapi.ParseClientReply(frames)
+}
+
+//  Sends frames and returns the reply, failing the test if there is none
+func Call(t testing.TB, endpoint string, frames ...string) []string {
+	t.Helper()
+	reply, err := Send(endpoint, frames...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+//  Sends a request to an rrbroker and returns its reply, failing the test
+//  if there is none
+func CallRR(t testing.TB, endpoint string, request rrapi.Request) rrapi.Reply {
+	t.Helper()
+	reply, err := SendRR(endpoint, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+//  Fails the test unless the reply has the status and, if any is given,
+//  the body
+func AssertReply(t testing.TB, reply rrapi.Reply, status string, body ...string) {
+	t.Helper()
+	if reply.Status != status {
+		t.Fatalf("got status %s %q, want %s", reply.Status, reply.Body, status)
+	}
+	if len(body) > 0 && !reflect.DeepEqual(reply.Body, body) {
+		t.Fatalf("got body %q, want %q", reply.Body, body)
+	}
+}
+
+//  Starts a lookup server on a fresh inproc endpoint and returns the
+//  endpoint. The server stops when the test ends.
+func StartLookupServer(t testing.TB, server *llibrary.Server) string {
+	endpoint := Endpoint("lookup")
+	background(t, func(ctx context.Context) error {
+		return server.ListenAndServeContext(ctx, endpoint)
+	})
+	return endpoint
+}
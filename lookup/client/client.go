@@ -22,9 +22,19 @@ var servicesReq []string
 var services = make(map[string]msg.Service)
 var servicesFileName string
 
+//  Requests to services back off exponentially, retrying at most one
+//  request in ten once the initial allowance is spent
+var retryPolicy = msg.NewExponentialBackoff(msg.REQUEST_RETRIES, msg.NewRetryBudget(0.1, 10))
+
 //  Init function requests for all services that the client will require
 func init() {
+	if err := msg.InitTracing("client"); err != nil {
+		log.Println(err)
+	}
 	servicesFileName = "dcservicelist.json"
+	msg.OnBreakerChange(func(address string, from, to msg.BreakerState) {
+		log.Printf("Circuit to %s went from %s to %s\n", address, from, to)
+	})
 	servicesReq = append(servicesReq, "hello")
 	//  All I need to know are the details of the lookup service
 	services["lookup"] = msg.NewService("lookup", "LookUp Service", "tcp://localhost:5569", "lookup", "REP")
@@ -49,7 +59,7 @@ func init() {
 func main() {
 	for request_nbr := 0; request_nbr != 10; request_nbr++ {
 		message := fmt.Sprintf("Hello %d", request_nbr)
-		reply, err := msg.SendRequest(services["hello"], "hello", message)
+		reply, err := msg.SendRequestWithPolicy(services["hello"], "hello", message, retryPolicy)
 		if err != nil {
 			log.Println("Whoops! ", err)
 			reply, err = msg.SendRequest(services["lookup"], "lookup", "hello")
@@ -7,8 +7,6 @@
 package main
 
 import (
-	zmq "github.com/pebbe/zmq4"
-
 	"encoding/json"
 	"fmt"
 	msg "llibrary"
@@ -44,40 +42,20 @@ func init() {
 
 //  Main function is to serve clients
 func main() {
-	//  Socket to talk to clients
-	responder, err := zmq.NewSocket(zmq.REP)
-	if err != nil {
-		panic(err)
+	if err := msg.InitTracing("helloservice"); err != nil {
+		log.Println(err)
 	}
-	defer responder.Close()
-	responder.Bind(allowedbinders)
 
-	for {
-		var service_required msg.ProcessRequest
-		var message string
-		var reply string
-		//  Wait for next request from client
-		service_required, message, err = msg.RecieveClientRequest(responder, myservices)
-		if err != nil {
-			msg.SendToClient(mydescription.Reply, fmt.Sprintf("Error:Receive:%s", err), "Error Receiving message", responder)
-			continue
-		}
-		fmt.Println("Received ", message)
-
-		//  Do some 'work'
-		time.Sleep(time.Second)
-		reply, err = service_required(message)
-		if err != nil {
-			msg.SendToClient(mydescription.Reply, fmt.Sprintf("Error:Receive:%s", err), "Error Processing Request", responder)
-			continue
-		}
-
-		//  Send reply back to client
-		msg.SendToClient(mydescription.Reply, "", reply, responder)
-	}
+	//  Serve clients, with metrics at METRICS_ADDRESS if it is set
+	server := msg.NewServer(mydescription.Reply, myservices)
+	panic(server.ListenAndServe(allowedbinders))
 }
 
 func doHelloWorld(message string) (reply string, err error) {
+	fmt.Println("Received ", message)
+
+	//  Do some 'work'
+	time.Sleep(time.Second)
 	reply = "World"
 	return
 }
@@ -0,0 +1,207 @@
+package msg
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	//  Circuit breaker constants, shared by every service address
+	BREAKER_THRESHOLD = 5                //  Consecutive failures before opening
+	BREAKER_COOLDOWN  = 10 * time.Second //  Open for this long before probing
+)
+
+//  Returned without contacting the service while its breaker is open
+var ErrCircuitOpen = errors.New("Error:CircuitOpen")
+
+type BreakerState int
+
+const (
+	BREAKER_CLOSED    BreakerState = iota //  Requests flow normally
+	BREAKER_OPEN                          //  Requests fail immediately
+	BREAKER_HALF_OPEN                     //  One probe request is let through
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BREAKER_CLOSED:
+		return "closed"
+	case BREAKER_OPEN:
+		return "open"
+	case BREAKER_HALF_OPEN:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(state))
+}
+
+//  Called whenever any breaker changes state
+type BreakerListener func(address string, from, to BreakerState)
+
+//  A circuit breaker guards one service address. It opens after too many
+//  consecutive failures, then after a cooldown lets a single probe through
+//  and closes again if the probe succeeds. Only retryable errors count
+//  as failures; a service that replies with an error is still alive.
+type CircuitBreaker struct {
+	mutex     sync.Mutex
+	address   string
+	state     BreakerState
+	failures  int       //  Consecutive failures while closed
+	opened_at time.Time //  When the breaker last opened
+	probing   bool      //  A half-open probe is in flight
+	trips     int       //  Times the breaker has opened
+	rejected  int       //  Requests refused while open
+}
+
+//  Snapshot of a breaker, for reporting
+type BreakerStat struct {
+	Address  string
+	State    BreakerState
+	Failures int
+	Trips    int
+	Rejected int
+}
+
+var (
+	breakers_mutex sync.Mutex
+	breakers       = make(map[string]*CircuitBreaker)
+	listeners      []BreakerListener
+)
+
+var (
+	breaker_state = DefaultRegistry.NewGauge("llibrary_circuit_breaker_state",
+		"State of the circuit breaker per service address: 0 closed, 1 open, 2 half-open", "address")
+	breaker_transitions = DefaultRegistry.NewCounter("llibrary_circuit_breaker_transitions_total",
+		"Circuit breaker state changes per service address, by new state", "address", "state")
+	breaker_rejected = DefaultRegistry.NewCounter("llibrary_circuit_breaker_rejected_total",
+		"Requests refused without sending because the circuit was open", "address")
+)
+
+func init() {
+	DefaultRegistry.OnCollect(func() {
+		for _, stat := range BreakerStats() {
+			breaker_state.Set(float64(stat.State), stat.Address)
+		}
+	})
+}
+
+//  Lazy constructor that locates the breaker for an address, or creates
+//  a closed one if there is none yet
+func GetBreaker(address string) *CircuitBreaker {
+	breakers_mutex.Lock()
+	defer breakers_mutex.Unlock()
+	breaker, ok := breakers[address]
+	if !ok {
+		breaker = &CircuitBreaker{address: address}
+		breakers[address] = breaker
+	}
+	return breaker
+}
+
+//  Registers a listener for breaker state changes
+func OnBreakerChange(listener BreakerListener) {
+	breakers_mutex.Lock()
+	defer breakers_mutex.Unlock()
+	listeners = append(listeners, listener)
+}
+
+//  Snapshot of every breaker, ordered by address
+func BreakerStats() (stats []BreakerStat) {
+	breakers_mutex.Lock()
+	all := make([]*CircuitBreaker, 0, len(breakers))
+	for _, breaker := range breakers {
+		all = append(all, breaker)
+	}
+	breakers_mutex.Unlock()
+
+	for _, breaker := range all {
+		breaker.mutex.Lock()
+		stats = append(stats, BreakerStat{
+			breaker.address,
+			breaker.state,
+			breaker.failures,
+			breaker.trips,
+			breaker.rejected,
+		})
+		breaker.mutex.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Address < stats[j].Address })
+	return
+}
+
+func (breaker *CircuitBreaker) State() BreakerState {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.state
+}
+
+//  Asks to send a request. Returns ErrCircuitOpen if the breaker is open,
+//  or if it is half-open and its probe is already in flight.
+func (breaker *CircuitBreaker) Allow() error {
+	breaker.mutex.Lock()
+	from := breaker.state
+	if breaker.state == BREAKER_OPEN && time.Since(breaker.opened_at) >= BREAKER_COOLDOWN {
+		breaker.state = BREAKER_HALF_OPEN
+		breaker.probing = false
+	}
+	allowed := true
+	switch breaker.state {
+	case BREAKER_OPEN:
+		allowed = false
+	case BREAKER_HALF_OPEN:
+		allowed = !breaker.probing
+		breaker.probing = true
+	}
+	if !allowed {
+		breaker.rejected++
+	}
+	to := breaker.state
+	breaker.mutex.Unlock()
+
+	breaker.notify(from, to)
+	if !allowed {
+		breaker_rejected.Inc(breaker.address)
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+//  Records the outcome of a request that Allow let through
+func (breaker *CircuitBreaker) Record(err error) {
+	breaker.mutex.Lock()
+	from := breaker.state
+	if IsRetryable(err) {
+		breaker.failures++
+		//  A late failure while already open neither trips it again nor
+		//  restarts the cooldown
+		if breaker.state == BREAKER_HALF_OPEN ||
+			breaker.state == BREAKER_CLOSED && breaker.failures >= BREAKER_THRESHOLD {
+			breaker.state = BREAKER_OPEN
+			breaker.opened_at = time.Now()
+			breaker.trips++
+		}
+	} else {
+		breaker.failures = 0
+		breaker.state = BREAKER_CLOSED
+	}
+	breaker.probing = false
+	to := breaker.state
+	breaker.mutex.Unlock()
+
+	breaker.notify(from, to)
+}
+
+func (breaker *CircuitBreaker) notify(from, to BreakerState) {
+	if from == to {
+		return
+	}
+	breaker_transitions.Inc(breaker.address, to.String())
+	breakers_mutex.Lock()
+	current := listeners
+	breakers_mutex.Unlock()
+	for _, listener := range current {
+		listener(breaker.address, from, to)
+	}
+}
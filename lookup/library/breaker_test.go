@@ -0,0 +1,120 @@
+package msg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+//  The breaker for the test's name, forgotten when the test ends, along
+//  with any listeners the test added, so that it can run again
+func testBreaker(t *testing.T) *CircuitBreaker {
+	breakers_mutex.Lock()
+	registered := len(listeners)
+	breakers_mutex.Unlock()
+	t.Cleanup(func() {
+		breakers_mutex.Lock()
+		defer breakers_mutex.Unlock()
+		delete(breakers, t.Name())
+		listeners = listeners[:registered]
+	})
+	return GetBreaker(t.Name())
+}
+
+func TestBreakerOpensAndProbes(t *testing.T) {
+	breaker := testBreaker(t)
+	if GetBreaker(t.Name()) != breaker {
+		t.Fatal("second breaker for one address")
+	}
+	timeout := Retryable(errors.New("Error:TimeOut"))
+
+	//  Errors from the service do not count against it
+	for i := 0; i < 2*BREAKER_THRESHOLD; i++ {
+		breaker.Record(errors.New("Error:InvalidService"))
+	}
+	if breaker.State() != BREAKER_CLOSED {
+		t.Fatalf("breaker %s after service errors", breaker.State())
+	}
+
+	for i := 0; i < BREAKER_THRESHOLD; i++ {
+		if err := breaker.Allow(); err != nil {
+			t.Fatal(err)
+		}
+		breaker.Record(timeout)
+	}
+	if breaker.State() != BREAKER_OPEN {
+		t.Fatalf("breaker %s after %d timeouts", breaker.State(), BREAKER_THRESHOLD)
+	}
+	if err := breaker.Allow(); err != ErrCircuitOpen {
+		t.Fatalf("open breaker allowed a request: %v", err)
+	}
+
+	//  A request from before it opened fails late, and it opened only once
+	breaker.Record(timeout)
+	if stats := statFor(t.Name()); stats.Trips != 1 {
+		t.Fatalf("got %d trips", stats.Trips)
+	}
+
+	//  After the cooldown one probe goes through, and closes it
+	breaker.mutex.Lock()
+	breaker.opened_at = time.Now().Add(-BREAKER_COOLDOWN)
+	breaker.mutex.Unlock()
+	if err := breaker.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	if err := breaker.Allow(); err != ErrCircuitOpen {
+		t.Fatal("second probe allowed while the first is in flight")
+	}
+	breaker.Record(nil)
+	if breaker.State() != BREAKER_CLOSED {
+		t.Fatalf("breaker %s after a good probe", breaker.State())
+	}
+}
+
+func TestBreakerProbeAfterDeadline(t *testing.T) {
+	breaker := testBreaker(t)
+	for i := 0; i < BREAKER_THRESHOLD; i++ {
+		breaker.Record(Retryable(errors.New("Error:TimeOut")))
+	}
+	breaker.mutex.Lock()
+	breaker.opened_at = time.Now().Add(-BREAKER_COOLDOWN)
+	breaker.mutex.Unlock()
+
+	//  A request already out of time does not take the probe
+	expired, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	service := NewService("probe", "Probe Service", t.Name(), "probe", "REP")
+	if _, err := SendRequestContext(expired, service, "probe", "Hi", DefaultRetryPolicy); err != ErrDeadlineExceeded {
+		t.Fatalf("got %v past the deadline", err)
+	}
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("probe held by an expired request: %v", err)
+	}
+}
+
+//  The snapshot of the breaker for address
+func statFor(address string) BreakerStat {
+	for _, stat := range BreakerStats() {
+		if stat.Address == address {
+			return stat
+		}
+	}
+	return BreakerStat{}
+}
+
+func TestBreakerListener(t *testing.T) {
+	breaker := testBreaker(t)
+	var changes []BreakerState
+	OnBreakerChange(func(address string, from, to BreakerState) {
+		if address == t.Name() {
+			changes = append(changes, to)
+		}
+	})
+	for i := 0; i < BREAKER_THRESHOLD; i++ {
+		breaker.Record(Retryable(errors.New("Error:TimeOut")))
+	}
+	if len(changes) != 1 || changes[0] != BREAKER_OPEN {
+		t.Fatalf("got changes %v", changes)
+	}
+}
@@ -0,0 +1,60 @@
+package msg
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+)
+
+//  A caller's remaining time budget travels with a request as the
+//  DEADLINE_PROPERTY of its properties frame. It is a budget in
+//  milliseconds rather than a point in time, so that hosts need not agree
+//  on the time. The receiver turns it back into a context deadline, and
+//  calls made under that context pass on whatever is left of it.
+const DEADLINE_PROPERTY = "deadline"
+
+//  The longest budget that can be held as a time.Duration
+const MAX_BUDGET_MS = math.MaxInt64 / int64(time.Millisecond)
+
+//  Formats a budget, rounded up to whole milliseconds; one that has run
+//  out is sent as 0
+func FormatBudget(budget time.Duration) string {
+	ms := int64((budget + time.Millisecond - 1) / time.Millisecond)
+	if ms < 0 {
+		ms = 0
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+//  Parses a budget. Reports false if it is not a number of milliseconds,
+//  or too many to hold.
+func ParseBudget(ms string) (budget time.Duration, ok bool) {
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil || n < 0 || n > MAX_BUDGET_MS {
+		return
+	}
+	return time.Duration(n) * time.Millisecond, true
+}
+
+//  The caller's budget, if it sent one
+func (properties Properties) Budget() (budget time.Duration, ok bool) {
+	ms, ok := properties[DEADLINE_PROPERTY]
+	if !ok || len(ms) == 0 {
+		return 0, false
+	}
+	return ParseBudget(ms[0])
+}
+
+func (properties Properties) SetBudget(budget time.Duration) {
+	properties[DEADLINE_PROPERTY] = []string{FormatBudget(budget)}
+}
+
+//  A context that ends when the caller's budget runs out, if it sent one.
+//  The caller must call cancel once done with the request.
+func (properties Properties) Context(parent context.Context) (ctx context.Context, cancel context.CancelFunc) {
+	if budget, ok := properties.Budget(); ok {
+		return context.WithTimeout(parent, budget)
+	}
+	return context.WithCancel(parent)
+}
@@ -0,0 +1,92 @@
+package msg
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	for budget, want := range map[time.Duration]string{
+		1500 * time.Millisecond: "1500",
+		1500 * time.Microsecond: "2",
+		-time.Second:            "0",
+	} {
+		if ms := FormatBudget(budget); ms != want {
+			t.Errorf("got %q for %v", ms, budget)
+		}
+	}
+	budget, ok := ParseBudget(FormatBudget(time.Second))
+	if !ok || budget != time.Second {
+		t.Fatalf("got %v, %t", budget, ok)
+	}
+	for _, bad := range []string{"", "-5", "soon", fmt.Sprint(MAX_BUDGET_MS + 1), "99999999999999999999"} {
+		if _, ok := ParseBudget(bad); ok {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+	if budget, ok = ParseBudget(fmt.Sprint(MAX_BUDGET_MS)); !ok || budget <= 0 {
+		t.Fatalf("got %v, %t for the longest budget", budget, ok)
+	}
+}
+
+func TestProperties(t *testing.T) {
+	if properties := ContextProperties(context.Background()); properties.Frame() != "" {
+		t.Fatalf("got %q for a context without a deadline or span", properties.Frame())
+	}
+	span := StartSpan("test", SPAN_KIND_CLIENT, SpanContext{})
+	ctx, cancel := context.WithTimeout(ContextWithSpan(context.Background(), span), time.Second)
+	defer cancel()
+
+	//  What is sent is read back the same
+	properties, err := ParseProperties(ContextProperties(ctx).Frame())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc, ok := properties.Trace(); !ok || sc != span.Context {
+		t.Fatalf("got %v, %t", sc, ok)
+	}
+	if budget, ok := properties.Budget(); !ok || budget <= 0 || budget > time.Second {
+		t.Fatalf("got %v, %t", budget, ok)
+	}
+
+	//  An empty frame carries neither
+	properties, _ = ParseProperties("")
+	if _, ok := properties.Trace(); ok {
+		t.Fatal("trace from empty properties")
+	}
+	if _, ok := properties.Budget(); ok {
+		t.Fatal("budget from empty properties")
+	}
+	if _, err = ParseProperties("%zz"); err == nil {
+		t.Fatal("parsed a bad frame")
+	}
+}
+
+func TestPropertiesContext(t *testing.T) {
+	properties := NewProperties()
+	properties.SetBudget(time.Second)
+	ctx, cancel := properties.Context(context.Background())
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Second {
+		t.Fatalf("got %v, %t", deadline, ok)
+	}
+
+	ctx, cancel = NewProperties().Context(context.Background())
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("got a deadline")
+	}
+	cancel()
+	if ctx.Err() == nil {
+		t.Fatal("cancel did not end the context")
+	}
+
+	//  A budget that has run out ends the context at once
+	properties.SetBudget(0)
+	ctx, cancel = properties.Context(context.Background())
+	defer cancel()
+	if ctx.Err() == nil {
+		t.Fatal("context outlived its budget")
+	}
+}
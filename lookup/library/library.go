@@ -1,6 +1,7 @@
 package msg
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	zmq "github.com/pebbe/zmq4"
@@ -18,6 +19,9 @@ const (
 	PPP_HEARTBEAT = "\002" //  Signals worker heartbeat
 )
 
+//  Returned when a request's deadline passes before it is answered
+var ErrDeadlineExceeded = errors.New("Error:DeadlineExceeded")
+
 type Service struct {
 	SID, Name, Address, Reply, Socket_desc, Heartbeat_state string
 }
@@ -42,12 +46,36 @@ func ProcessHeartBeat(message string) (reply string, err error) {
 }
 
 func RecieveClientRequest(receiver *zmq.Socket, myservices map[string]ProcessRequest) (service_required ProcessRequest, message string, err error) {
+	service_required, message, _, err = ReceiveTracedRequest(receiver, myservices)
+	return
+}
+
+//  Receives a request like RecieveClientRequest, and also starts a server
+//  span for it, joined to the caller's trace if the request carried one.
+//  The caller ends the span once the reply is sent. Heartbeats are not
+//  traced, so the span may be nil.
+func ReceiveTracedRequest(receiver *zmq.Socket, myservices map[string]ProcessRequest) (service_required ProcessRequest, message string, span *Span, err error) {
+	var sid string
+	sid, message, span, _, err = receiveRequest(receiver, func(sid string) bool {
+		_, isPresent := myservices[sid]
+		return isPresent
+	})
+	service_required = myservices[sid]
+	return
+}
+
+//  Receives a request and returns the SID it was addressed to as well,
+//  and when the caller stops waiting for it; zero if the caller sent no
+//  deadline
+func receiveRequest(receiver *zmq.Socket, known func(sid string) bool) (sid, message string, span *Span, deadline time.Time, err error) {
+	var parent SpanContext
+	var invalid error
 	for count := 0; ; count++ {
 		var request string
 		request, err = receiver.Recv(0)
 		if err != nil {
 			err = errors.New(fmt.Sprintf("Error:Receive:%s", err))
-			return
+			break
 		}
 		fmt.Println("\tCurrent: ", request)
 		//  Retrieve message parts from the envelope
@@ -55,29 +83,47 @@ func RecieveClientRequest(receiver *zmq.Socket, myservices map[string]ProcessReq
 		//  a. A heartbeat request
 		//  b. The service's SID
 		//  The second part: the message
+		//  The optional third part: properties, with the caller's trace
+		//  context and remaining time budget
 		if count == 0 {
-			var isPresent bool
-			service_required, isPresent = myservices[request]
-			fmt.Printf("%s is present? %s", request, isPresent)
+			sid = request
+			isPresent := known(request)
+			fmt.Printf("%s is present? %t", request, isPresent)
 			if !isPresent {
-				err = errors.New("Error:InvalidService")
-				return
+				//  Read the rest of the request anyway, as the REP
+				//  socket cannot reply until it has all of it
+				invalid = errors.New("Error:InvalidService")
 			}
 		}
 		if count == 1 {
 			message = request
 		}
+		if count == 2 {
+			properties, _ := ParseProperties(request)
+			parent, _ = properties.Trace()
+			if budget, ok := properties.Budget(); ok {
+				deadline = time.Now().Add(budget)
+			}
+		}
 		//  Check if there are more in envelope and deal with any errors
 		var more bool
 		more, err = receiver.GetRcvmore()
 		if err != nil {
 			err = errors.New(fmt.Sprintf("Error:Receive:%s", err))
-			return
+			break
 		}
 		if !more {
-			return
+			break
 		}
 	}
+	if err == nil {
+		err = invalid
+	}
+	if sid != "" && sid != PPP_HEARTBEAT {
+		span = StartSpan(sid, SPAN_KIND_SERVER, parent)
+		span.SetError(err)
+	}
+	return
 }
 
 func SendToClient(signature, error_status, message string, frontend *zmq.Socket) {
@@ -89,122 +135,75 @@ func SendToClient(signature, error_status, message string, frontend *zmq.Socket)
 	frontend.Send(message, 0)
 }
 
-//  Send a request to a service
+//  Send a request to a service, retrying with the default policy
 func SendRequest(service Service, request, message string) (reply []string, err error) {
-	//  Bind to service if not already done
-	var requester *zmq.Socket
-	fmt.Println("Connecting to '", service.Name, "'' at '", service.Address, "'...")
-	requester, err = zmq.NewSocket(zmq.REQ)
-	if err != nil {
-		log.Println(err)
-		return
+	policy := DefaultRetryPolicy
+	if request == PPP_HEARTBEAT {
+		policy = HeartbeatRetryPolicy
 	}
-	requester.Connect(service.Address)
+	return SendRequestContext(context.Background(), service, request, message, policy)
+}
 
-	poller := zmq.NewPoller()
-	poller.Add(requester, zmq.POLLIN)
+func SendRequestWithPolicy(service Service, request, message string, policy RetryPolicy) (reply []string, err error) {
+	return SendRequestContext(context.Background(), service, request, message, policy)
+}
 
-	retries_left := REQUEST_RETRIES
-	request_timeout := REQUEST_TIMEOUT
-	if request == PPP_HEARTBEAT {
-		retries_left = 1
-		request_timeout = 1500 * time.Millisecond
+//  Send a request to a service, retrying failed attempts as far as the
+//  policy allows. While the circuit breaker for the service's address is
+//  open the request fails at once with ErrCircuitOpen.
+//  Requests other than heartbeats are traced by a client span, a child
+//  of any span in ctx, whose context is sent along in a third frame of
+//  properties. If ctx has a deadline, no attempt waits past it, and what
+//  is left of it is sent along in the properties too.
+func SendRequestContext(ctx context.Context, service Service, request, message string, policy RetryPolicy) (reply []string, err error) {
+	var span *Span
+	if request != PPP_HEARTBEAT {
+		span = StartSpan(request, SPAN_KIND_CLIENT, SpanFromContext(ctx).SpanContext())
+		span.SetAttribute("peer.address", service.Address)
+		defer span.End()
 	}
-	for retries_left > 0 {
-		//  Send message
-		//  The service required in first packet of envelope
-		//  The message for given service in second packet of envelope
-		//  Heartbeat messages only contain one message in envelope
-		if request == PPP_HEARTBEAT {
-			_, err = requester.Send(PPP_HEARTBEAT, 0)
-		} else {
-			_, err = requester.Send(request, zmq.SNDMORE)
-			_, err = requester.Send(message, 0)
-		}
-		for expect_reply := true; expect_reply; {
-			//  Poll socket for a reply, with timeout
-			var sockets []zmq.Polled
-			sockets, err = poller.Poll(request_timeout)
-			if err != nil {
-				break //  Interrupted
-			}
-
-			//  Wait to receive reply if there are no more messages to send
-			if len(sockets) > 0 {
-				//  Receive all replies in the envelope before processing
-				var more bool
-				for count := 0; ; count++ {
-					var rep string
-					rep, err = requester.Recv(0)
-					if err != nil {
-						retries_left--
-						break
-					}
-
-					reply = append(reply, rep)
-					//  Unpacking three parts from the message envelope
-					//  The first part: the expected service reply signature
-					//  The second part is either:
-					//  a. error state (empty if no error) OR
-					//  b. the heartbeat reply of the server
-					//  The third part: the actual message
-					if count == 0 && rep != service.Reply {
-						err = errors.New("ServiceListOutdated:Bound to wrong service")
-						retries_left = 0
-						break
-					}
-					if count == 1 && rep != "" && rep != PPP_READY {
-						err = errors.New(rep)
-						retries_left = 0
-						break
-					}
-					//  Break from loop if there are no more messages or
-					//  an error condition occurs
-					more, err = requester.GetRcvmore()
-					if !more || err != nil {
-						retries_left--
-						break
-					}
-				}
-
-				//  If there was an error retrieving the message, then we
-				//  should still expect replies
-				if err != nil {
-					break
-				}
-				//  All messages retrieved from packet successfully
-				//  Leave the retrieve/retry loops
-				retries_left = 0
-				expect_reply = false
-			} else {
-				retries_left--
-				if retries_left == 0 {
-					if err == nil {
-						err = errors.New("Error:TimeOut")
-					}
-					requester.Close()
-					return
-				} else {
-					err = nil
-					reply = nil
-					fmt.Println("No response from server, retrying...")
-					//  Old socket is confused; close it and open a new one
-					requester.Close()
-					requester, _ = zmq.NewSocket(zmq.REQ)
-					requester.Connect(service.Address)
-					// Recreate poller for new client
-					poller = zmq.NewPoller()
-					poller.Add(requester, zmq.POLLIN)
-					//  Send request again, on the new socket
-					if request == PPP_HEARTBEAT {
-						_, err = requester.Send(PPP_HEARTBEAT, 0)
-					} else {
-						_, err = requester.Send(request, zmq.SNDMORE)
-						_, err = requester.Send(message, 0)
-					}
-				}
+	breaker := GetBreaker(service.Address)
+	fmt.Println("Connecting to '", service.Name, "'' at '", service.Address, "'...")
+	for attempt := 0; ; attempt++ {
+		//  Before asking the breaker, which holds a half-open probe for
+		//  whoever it lets through until the outcome is recorded
+		timeout := policy.Timeout(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+		}
+		if timeout <= 0 {
+			err = ErrDeadlineExceeded
+			span.SetError(err)
+			return
+		}
+		if err = breaker.Allow(); err != nil {
+			fmt.Println("Circuit to", service.Address, "is", breaker.State(), ", not sending")
+			span.SetError(err)
+			return
+		}
+		span.SetAttribute("attempts", fmt.Sprint(attempt+1))
+		reply, err = sendAttempt(ctx, service, request, message, span, timeout)
+		breaker.Record(err)
+		if !IsRetryable(err) {
+			break
+		}
+		wait, ok := policy.Retry(attempt, err)
+		if deadline, has_deadline := ctx.Deadline(); has_deadline && time.Now().Add(wait).After(deadline) {
+			//  No time left for another attempt, so the policy gets back
+			//  the retry it allowed
+			if refunder, can := policy.(RetryRefunder); ok && can {
+				refunder.Refund(attempt)
 			}
+			ok = false
+			err = ErrDeadlineExceeded
+		}
+		if !ok {
+			span.SetError(err)
+			reply = nil
+			return
 		}
+		fmt.Println("No response from server, retrying in", wait, "...")
+		time.Sleep(wait)
 	}
 	fmt.Println("\tReceived: ", reply)
 	//  Deall with invalid/distorted replies first
@@ -212,13 +211,99 @@ func SendRequest(service Service, request, message string) (reply []string, err
 	//  Then package reply for return to the function caller
 	if len(reply) < 2 {
 		err = errors.New(fmt.Sprintf("Error:UnexpectedReply:%s", err))
-		requester.Close()
+		span.SetError(err)
 		return
 	}
+	span.SetError(err)
 	if reply[1] == PPP_READY {
 		reply = append(reply, reply[1])
 	}
 	reply = reply[2:]
-	requester.Close()
 	return
 }
+
+//  Makes one attempt at a request on a fresh REQ socket, since a REQ
+//  socket that missed its reply is confused and cannot be reused.
+//  Timeouts and transport errors are marked retryable; errors reported
+//  by the service are not.
+func sendAttempt(ctx context.Context, service Service, request, message string, span *Span, timeout time.Duration) (reply []string, err error) {
+	var requester *zmq.Socket
+	requester, err = zmq.NewSocket(zmq.REQ)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer requester.Close()
+	requester.SetLinger(0)
+	requester.Connect(service.Address)
+
+	poller := zmq.NewPoller()
+	poller.Add(requester, zmq.POLLIN)
+
+	//  Send message
+	//  The service required in first packet of envelope
+	//  The message for given service in second packet of envelope
+	//  The properties, with the trace context and the remaining time
+	//  budget, in the third packet of envelope
+	//  Heartbeat messages only contain one message in envelope
+	if request == PPP_HEARTBEAT {
+		_, err = requester.Send(PPP_HEARTBEAT, 0)
+	} else {
+		properties := ContextProperties(ctx)
+		if span != nil {
+			properties.SetTrace(span.Context)
+		}
+		_, err = requester.SendMessage(request, message, properties.Frame())
+	}
+	if err != nil {
+		err = Retryable(err)
+		return
+	}
+
+	//  Poll socket for a reply, with timeout
+	var sockets []zmq.Polled
+	sockets, err = poller.Poll(timeout)
+	if err != nil {
+		return //  Interrupted
+	}
+	if len(sockets) == 0 {
+		err = Retryable(errors.New("Error:TimeOut"))
+		return
+	}
+
+	//  Receive all replies in the envelope before processing
+	for count := 0; ; count++ {
+		var rep string
+		rep, err = requester.Recv(0)
+		if err != nil {
+			err = Retryable(err)
+			return
+		}
+
+		reply = append(reply, rep)
+		//  Unpacking three parts from the message envelope
+		//  The first part: the expected service reply signature
+		//  The second part is either:
+		//  a. error state (empty if no error) OR
+		//  b. the heartbeat reply of the server
+		//  The third part: the actual message
+		if count == 0 && rep != service.Reply {
+			err = errors.New("ServiceListOutdated:Bound to wrong service")
+			return
+		}
+		if count == 1 && rep != "" && rep != PPP_READY {
+			err = errors.New(rep)
+			return
+		}
+		//  Stop if there are no more messages or an error condition occurs
+		var more bool
+		more, err = requester.GetRcvmore()
+		if err != nil {
+			err = Retryable(err)
+			return
+		}
+		if !more {
+			return
+		}
+	}
+}
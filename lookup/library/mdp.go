@@ -0,0 +1,454 @@
+//
+//  Majordomo Protocol 0.2 client and worker, after
+//  http://rfc.zeromq.org/spec:18. Unlike MDP/0.1, a worker may answer a
+//  request with any number of partial replies before its final one, so
+//  it can stream results such as log lines or search hits; the broker
+//  keeps the request with the worker until the final reply.
+//
+//  A worker may also say in READY how many requests it takes at once. The
+//  broker then keeps up to that many with it, and each request and reply
+//  carries the request's ID, ahead of the client envelope, so they can be
+//  told apart.
+//
+//  A request carries a properties frame just after the service name,
+//  with any trace context and time budget, which the broker reads and
+//  rewrites, and passes on to the worker ahead of the body. It is always
+//  there, if only empty, so the body is never taken for it. MDP/0.1
+//  clients and workers have no such frame.
+//
+
+package msg
+
+import (
+	"errors"
+	"fmt"
+	zmq "github.com/pebbe/zmq4"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//  Protocol headers
+	MDP_CLIENT = "MDPC02"
+	MDP_WORKER = "MDPW02"
+
+	//  Client commands
+	MDPC_REQUEST = "\001"
+	MDPC_PARTIAL = "\002"
+	MDPC_FINAL   = "\003"
+
+	//  Worker commands
+	MDPW_READY      = "\001"
+	MDPW_REQUEST    = "\002"
+	MDPW_PARTIAL    = "\003"
+	MDPW_FINAL      = "\004"
+	MDPW_HEARTBEAT  = "\005"
+	MDPW_DISCONNECT = "\006"
+
+	MDP_HEARTBEAT_LIVENESS = 3 //  3-5 is reasonable
+	MDP_HEARTBEAT_INTERVAL = 2500 * time.Millisecond
+	MDP_RECONNECT_INTERVAL = 2500 * time.Millisecond
+)
+
+//  Returned when no reply comes within the client's timeout
+var ErrNoReply = errors.New("Error:NoReply")
+
+//  A client of an MDP/0.2 broker. Requests go out with Send and replies
+//  come back with Recv, partial ones first, so a client may have several
+//  requests out at once.
+type MDPClient struct {
+	broker  string
+	socket  *zmq.Socket
+	poller  *zmq.Poller
+	timeout time.Duration //  For each reply
+	verbose bool
+}
+
+func NewMDPClient(broker string, verbose bool) (client *MDPClient, err error) {
+	client = &MDPClient{broker: broker, timeout: REQUEST_TIMEOUT, verbose: verbose}
+	if client.socket, err = zmq.NewSocket(zmq.DEALER); err != nil {
+		return
+	}
+	client.socket.SetLinger(0)
+	if err = client.socket.Connect(broker); err != nil {
+		client.socket.Close()
+		return
+	}
+	client.poller = zmq.NewPoller()
+	client.poller.Add(client.socket, zmq.POLLIN)
+	return
+}
+
+//  Sets how long Recv waits for each reply
+func (client *MDPClient) SetTimeout(timeout time.Duration) {
+	client.timeout = timeout
+}
+
+func (client *MDPClient) Close() error {
+	return client.socket.Close()
+}
+
+//  Sends a request to a service, with no properties
+func (client *MDPClient) Send(service string, request ...string) (err error) {
+	return client.SendProperties(service, nil, request...)
+}
+
+//  Sends a request to a service, with properties such as those
+//  ContextProperties gives
+func (client *MDPClient) SendProperties(service string, properties Properties, request ...string) (err error) {
+	if client.verbose {
+		log.Printf("I: send request to '%s' service: %q %q\n", service, properties.Frame(), request)
+	}
+	_, err = client.socket.SendMessage("", MDP_CLIENT, MDPC_REQUEST, service, properties.Frame(), request)
+	return
+}
+
+//  Receives the next reply, and whether it is the final one for its
+//  request. Fails with ErrNoReply if none comes within the timeout.
+func (client *MDPClient) Recv() (service string, reply []string, final bool, err error) {
+	polled, err := client.poller.Poll(client.timeout)
+	if err != nil {
+		return //  Interrupted
+	}
+	if len(polled) == 0 {
+		err = ErrNoReply
+		return
+	}
+	msg, err := client.socket.RecvMessage(0)
+	if err != nil {
+		return
+	}
+	if client.verbose {
+		log.Printf("I: received reply: %q\n", msg)
+	}
+	//  Empty delimiter, header, command and service, then the body
+	if len(msg) < 4 || msg[0] != "" || msg[1] != MDP_CLIENT ||
+		(msg[2] != MDPC_PARTIAL && msg[2] != MDPC_FINAL) {
+		err = errors.New("Error:UnexpectedReply")
+		return
+	}
+	return msg[3], msg[4:], msg[2] == MDPC_FINAL, nil
+}
+
+//  Handles one request, with its properties as with Recv, sending any
+//  partial replies with partial, and returns the final reply
+type MDPHandler func(properties Properties, request []string, partial func(reply ...string)) (reply []string)
+
+//  A worker for one service of an MDP/0.2 broker. It receives a request
+//  with Recv, answers it with any number of calls to Partial and then one
+//  to Final, and only then receives the next. Or it serves many requests
+//  at once with Serve. It connects to the broker on the first of these.
+type MDPWorker struct {
+	broker  string
+	service string
+	socket  *zmq.Socket
+	verbose bool
+
+	heartbeat    time.Duration //  Between heartbeats
+	reconnect    time.Duration //  Before reconnecting to the broker
+	liveness     int           //  Heartbeats left before the broker is given up
+	heartbeat_at time.Time     //  When to send the next heartbeat
+	generation   int           //  Connections made so far
+	concurrency  int           //  Requests taken at once, if said in READY
+
+	client   string //  Routing envelope of the request being answered
+	answered bool   //  Whether its final reply has been sent
+}
+
+func NewMDPWorker(broker, service string, verbose bool) (worker *MDPWorker, err error) {
+	worker = &MDPWorker{
+		broker:    broker,
+		service:   service,
+		verbose:   verbose,
+		heartbeat: MDP_HEARTBEAT_INTERVAL,
+		reconnect: MDP_RECONNECT_INTERVAL,
+		answered:  true,
+	}
+	return
+}
+
+func (worker *MDPWorker) SetHeartbeat(heartbeat time.Duration) {
+	worker.heartbeat = heartbeat
+}
+
+func (worker *MDPWorker) SetReconnect(reconnect time.Duration) {
+	worker.reconnect = reconnect
+}
+
+func (worker *MDPWorker) Close() error {
+	if worker.socket == nil {
+		return nil
+	}
+	return worker.socket.Close()
+}
+
+//  Connects, or reconnects, to the broker and says we are ready
+func (worker *MDPWorker) connect() (err error) {
+	if worker.socket != nil {
+		worker.socket.Close()
+	}
+	if worker.socket, err = zmq.NewSocket(zmq.DEALER); err != nil {
+		return
+	}
+	worker.socket.SetLinger(0)
+	if err = worker.socket.Connect(worker.broker); err != nil {
+		return
+	}
+	if worker.verbose {
+		log.Printf("I: connecting to broker at %s...\n", worker.broker)
+	}
+	worker.liveness = MDP_HEARTBEAT_LIVENESS
+	worker.heartbeat_at = time.Now().Add(worker.heartbeat)
+	worker.generation++
+	worker.client = ""
+	worker.answered = true
+	if worker.concurrency > 0 {
+		return worker.send(MDPW_READY, worker.service, strconv.Itoa(worker.concurrency))
+	}
+	return worker.send(MDPW_READY, worker.service)
+}
+
+func (worker *MDPWorker) send(command string, frames ...string) (err error) {
+	if worker.verbose {
+		log.Printf("I: sending %q to broker: %q\n", command, frames)
+	}
+	_, err = worker.socket.SendMessage("", MDP_WORKER, command, frames)
+	return
+}
+
+//  Waits for the next request, heartbeating the broker meanwhile and
+//  reconnecting if it goes quiet. The request before must have had its
+//  final reply. The request comes with its properties, which hold the
+//  trace context of the broker's span and what is left of the client's
+//  time budget, if it sent one.
+func (worker *MDPWorker) Recv() (properties Properties, request []string, err error) {
+	if !worker.answered {
+		return nil, nil, errors.New("Error:NoFinalReply")
+	}
+	if worker.socket == nil {
+		if err = worker.connect(); err != nil {
+			return
+		}
+	}
+	poller := zmq.NewPoller()
+	poller.Add(worker.socket, zmq.POLLIN)
+	for {
+		var polled []zmq.Polled
+		polled, err = poller.Poll(worker.heartbeat)
+		if err != nil {
+			return //  Interrupted
+		}
+		if len(polled) > 0 {
+			var msg []string
+			if msg, err = worker.socket.RecvMessage(0); err != nil {
+				return
+			}
+			if worker.verbose {
+				log.Printf("I: received message from broker: %q\n", msg)
+			}
+			worker.liveness = MDP_HEARTBEAT_LIVENESS
+			//  Empty delimiter, header and command
+			if len(msg) < 3 || msg[0] != "" || msg[1] != MDP_WORKER {
+				log.Printf("E: invalid message from broker: %q\n", msg)
+				continue
+			}
+			switch command, msg := msg[2], msg[3:]; command {
+			case MDPW_REQUEST:
+				//  Client envelope, empty delimiter, properties, then the
+				//  body
+				if len(msg) < 3 {
+					log.Printf("E: invalid request from broker: %q\n", msg)
+					continue
+				}
+				if properties, err = ParseProperties(msg[2]); err != nil {
+					log.Printf("E: invalid properties from broker: %q\n", msg[2])
+					properties = NewProperties()
+				}
+				worker.client = msg[0]
+				worker.answered = false
+				return properties, msg[3:], nil
+			case MDPW_HEARTBEAT:
+				//  Nothing to do
+			case MDPW_DISCONNECT:
+				if err = worker.connect(); err != nil {
+					return
+				}
+				poller = zmq.NewPoller()
+				poller.Add(worker.socket, zmq.POLLIN)
+			default:
+				log.Printf("E: invalid command from broker: %q\n", command)
+			}
+		} else {
+			worker.liveness--
+			if worker.liveness == 0 {
+				if worker.verbose {
+					log.Println("W: disconnected from broker - retrying...")
+				}
+				time.Sleep(worker.reconnect)
+				if err = worker.connect(); err != nil {
+					return
+				}
+				poller = zmq.NewPoller()
+				poller.Add(worker.socket, zmq.POLLIN)
+			}
+		}
+		if time.Now().After(worker.heartbeat_at) {
+			worker.send(MDPW_HEARTBEAT)
+			worker.heartbeat_at = time.Now().Add(worker.heartbeat)
+		}
+	}
+}
+
+//  Sends part of the reply to the request being answered
+func (worker *MDPWorker) Partial(reply ...string) error {
+	if worker.answered {
+		return errors.New("Error:NoRequest")
+	}
+	return worker.send(MDPW_PARTIAL, append([]string{worker.client, ""}, reply...)...)
+}
+
+//  Sends the last of the reply to the request being answered
+func (worker *MDPWorker) Final(reply ...string) error {
+	if worker.answered {
+		return errors.New("Error:NoRequest")
+	}
+	worker.answered = true
+	return worker.send(MDPW_FINAL, append([]string{worker.client, ""}, reply...)...)
+}
+
+//  Serves requests with handler, up to concurrency of them at once, each
+//  in its own goroutine, until the socket fails. Use it instead of Recv,
+//  on a worker that has not yet connected, so that the broker hears of
+//  its concurrency in the first READY it sends. Handlers pass their
+//  replies back over an inproc pipe, tagged with the connection they came
+//  in on, since only this goroutine may use the broker socket. A reply
+//  for a request from before a reconnect is dropped; the broker has
+//  already given up on it. So while handlers are at work, a quiet broker
+//  is waited for rather than given up.
+func (worker *MDPWorker) Serve(concurrency int, handler MDPHandler) (err error) {
+	if concurrency < 1 {
+		return errors.New("Error:BadConcurrency")
+	}
+	if worker.socket != nil {
+		return errors.New("Error:AlreadyConnected")
+	}
+	pipe_address := fmt.Sprintf("inproc://mdp-worker-%p", worker)
+	replies, err := zmq.NewSocket(zmq.PAIR)
+	if err != nil {
+		return
+	}
+	defer replies.Close()
+	if err = replies.Bind(pipe_address); err != nil {
+		return
+	}
+	handlers, err := zmq.NewSocket(zmq.PAIR)
+	if err != nil {
+		return
+	}
+	defer handlers.Close()
+	if err = handlers.Connect(pipe_address); err != nil {
+		return
+	}
+	var handlers_mutex sync.Mutex
+	in_progress := 0 //  Handlers yet to send their final reply
+
+	worker.concurrency = concurrency
+	if err = worker.connect(); err != nil {
+		return
+	}
+	for {
+		poller := zmq.NewPoller()
+		poller.Add(worker.socket, zmq.POLLIN)
+		poller.Add(replies, zmq.POLLIN)
+		var polled []zmq.Polled
+		polled, err = poller.Poll(worker.heartbeat)
+		if err != nil {
+			return //  Interrupted
+		}
+
+		for _, item := range polled {
+			switch item.Socket {
+			case replies:
+				var frames []string
+				if frames, err = replies.RecvMessage(0); err != nil {
+					return
+				}
+				//  Connection, command, then the reply
+				if frames[1] == MDPW_FINAL {
+					in_progress--
+				}
+				if frames[0] == strconv.Itoa(worker.generation) {
+					worker.send(frames[1], frames[2:]...)
+				}
+
+			case worker.socket:
+				var msg []string
+				if msg, err = worker.socket.RecvMessage(0); err != nil {
+					return
+				}
+				if worker.verbose {
+					log.Printf("I: received message from broker: %q\n", msg)
+				}
+				worker.liveness = MDP_HEARTBEAT_LIVENESS
+				if len(msg) < 3 || msg[0] != "" || msg[1] != MDP_WORKER {
+					log.Printf("E: invalid message from broker: %q\n", msg)
+					continue
+				}
+				switch command, msg := msg[2], msg[3:]; command {
+				case MDPW_REQUEST:
+					//  Request ID, client envelope, empty delimiter,
+					//  properties, then the body
+					if len(msg) < 4 {
+						log.Printf("E: invalid request from broker: %q\n", msg)
+						continue
+					}
+					id, client, request := msg[0], msg[1], msg[4:]
+					properties, err := ParseProperties(msg[3])
+					if err != nil {
+						log.Printf("E: invalid properties from broker: %q\n", msg[3])
+						properties = NewProperties()
+					}
+					generation := strconv.Itoa(worker.generation)
+					reply := func(command string, reply []string) {
+						handlers_mutex.Lock()
+						handlers.SendMessage(generation, command, id, client, "", reply)
+						handlers_mutex.Unlock()
+					}
+					in_progress++
+					go func() {
+						reply(MDPW_FINAL, handler(properties, request, func(partial ...string) {
+							reply(MDPW_PARTIAL, partial)
+						}))
+					}()
+				case MDPW_HEARTBEAT:
+					//  Nothing to do
+				case MDPW_DISCONNECT:
+					if err = worker.connect(); err != nil {
+						return
+					}
+				default:
+					log.Printf("E: invalid command from broker: %q\n", command)
+				}
+			}
+		}
+
+		if len(polled) == 0 && in_progress == 0 {
+			worker.liveness--
+			if worker.liveness == 0 {
+				if worker.verbose {
+					log.Println("W: disconnected from broker - retrying...")
+				}
+				time.Sleep(worker.reconnect)
+				if err = worker.connect(); err != nil {
+					return
+				}
+			}
+		}
+		if time.Now().After(worker.heartbeat_at) {
+			worker.send(MDPW_HEARTBEAT)
+			worker.heartbeat_at = time.Now().Add(worker.heartbeat)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package msg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//  Metrics are only served over HTTP when this names an address to
+	//  listen at, such as "localhost:9100"
+	METRICS_ADDRESS_ENV = "METRICS_ADDRESS"
+	METRICS_PATH        = "/metrics"
+)
+
+//  Default buckets for latency histograms, in seconds
+var LATENCY_BUCKETS = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+//  A registry holds metrics and writes them out in the Prometheus text
+//  exposition format. It is an http.Handler, so it can be served as is.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []*metric
+	hooks   []func()
+}
+
+//  Registry used by the library and the brokers
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type metric struct {
+	mutex   sync.Mutex
+	name    string
+	help    string
+	kind    string //  counter, gauge or histogram
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+//  One set of label values of a metric
+type series struct {
+	values []string
+	value  float64  //  Counters and gauges
+	counts []uint64 //  Histograms: observations per bucket
+	sum    float64
+	count  uint64
+}
+
+func (registry *Registry) add(name, help, kind string, buckets []float64, labels []string) *metric {
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for _, existing := range registry.metrics {
+		if existing.name == name {
+			panic("metric registered twice: " + name)
+		}
+	}
+	registry.metrics = append(registry.metrics, m)
+	return m
+}
+
+//  Finds or creates the series for the label values. Caller holds the lock.
+func (m *metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+//  A counter only goes up
+type Counter struct {
+	m *metric
+}
+
+func (registry *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{registry.add(name, help, "counter", nil, labels)}
+}
+
+func (counter *Counter) Inc(values ...string) {
+	counter.Add(1, values...)
+}
+
+func (counter *Counter) Add(delta float64, values ...string) {
+	counter.m.mutex.Lock()
+	counter.m.get(values).value += delta
+	counter.m.mutex.Unlock()
+}
+
+//  A gauge goes up and down
+type Gauge struct {
+	m *metric
+}
+
+func (registry *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{registry.add(name, help, "gauge", nil, labels)}
+}
+
+func (gauge *Gauge) Set(value float64, values ...string) {
+	gauge.m.mutex.Lock()
+	gauge.m.get(values).value = value
+	gauge.m.mutex.Unlock()
+}
+
+func (gauge *Gauge) Add(delta float64, values ...string) {
+	gauge.m.mutex.Lock()
+	gauge.m.get(values).value += delta
+	gauge.m.mutex.Unlock()
+}
+
+func (gauge *Gauge) Inc(values ...string) {
+	gauge.Add(1, values...)
+}
+
+func (gauge *Gauge) Dec(values ...string) {
+	gauge.Add(-1, values...)
+}
+
+//  Removes the series for the label values, for things that are gone
+func (gauge *Gauge) Delete(values ...string) {
+	gauge.m.mutex.Lock()
+	delete(gauge.m.series, strings.Join(values, "\xff"))
+	gauge.m.mutex.Unlock()
+}
+
+//  A histogram counts observations into buckets by upper bound
+type Histogram struct {
+	m *metric
+}
+
+func (registry *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Histogram{registry.add(name, help, "histogram", buckets, labels)}
+}
+
+func (histogram *Histogram) Observe(value float64, values ...string) {
+	histogram.m.mutex.Lock()
+	defer histogram.m.mutex.Unlock()
+	s := histogram.m.get(values)
+	for i, bound := range histogram.m.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+//  Observes the seconds elapsed since start
+func (histogram *Histogram) ObserveSince(start time.Time, values ...string) {
+	histogram.Observe(time.Since(start).Seconds(), values...)
+}
+
+//  Registers a function to run before every collection, to bring gauges
+//  up to date with state kept elsewhere
+func (registry *Registry) OnCollect(hook func()) {
+	registry.mutex.Lock()
+	registry.hooks = append(registry.hooks, hook)
+	registry.mutex.Unlock()
+}
+
+//  Writes every metric in the Prometheus text exposition format
+func (registry *Registry) WriteText(w io.Writer) error {
+	registry.mutex.Lock()
+	hooks := registry.hooks
+	metrics := registry.metrics
+	registry.mutex.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+	out := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(out)
+	}
+	return out.Flush()
+}
+
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := registry.WriteText(w); err != nil {
+		log.Println("Error writing metrics: ", err)
+	}
+}
+
+func (m *metric) write(out *bufio.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	fmt.Fprintf(out, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(out, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(out, "%s%s %s\n", m.name, m.labelText(s.values, ""), formatFloat(s.value))
+			continue
+		}
+		for i, bound := range m.buckets {
+			fmt.Fprintf(out, "%s_bucket%s %d\n", m.name, m.labelText(s.values, formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(out, "%s_bucket%s %d\n", m.name, m.labelText(s.values, "+Inf"), s.count)
+		fmt.Fprintf(out, "%s_sum%s %s\n", m.name, m.labelText(s.values, ""), formatFloat(s.sum))
+		fmt.Fprintf(out, "%s_count%s %d\n", m.name, m.labelText(s.values, ""), s.count)
+	}
+}
+
+//  Label pairs in braces, with the histogram bucket bound if le is set
+func (m *metric) labelText(values []string, le string) string {
+	var pairs []string
+	for i, label := range m.labels {
+		pairs = append(pairs, label+`="`+escapeLabel(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var help_escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var label_escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return help_escaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return label_escaper.Replace(s)
+}
+
+//  Serves the registry at /metrics on address, in the background
+func ServeMetrics(address string, registry *Registry) {
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, registry)
+	go func() {
+		log.Println("Metrics at http://" + address + METRICS_PATH)
+		log.Println(http.ListenAndServe(address, mux))
+	}()
+}
+
+//  Serves the default registry if METRICS_ADDRESS is set in the environment
+func InitMetrics() {
+	if address := os.Getenv(METRICS_ADDRESS_ENV); address != "" {
+		ServeMetrics(address, DefaultRegistry)
+	}
+}
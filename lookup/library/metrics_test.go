@@ -0,0 +1,76 @@
+package msg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("test_requests_total", "Requests\nper service", "service")
+	gauge := registry.NewGauge("test_in_flight", "In flight")
+	histogram := registry.NewHistogram("test_seconds", "Latency", []float64{0.1, 1}, "service")
+
+	counter.Inc(`say "hi"`)
+	counter.Add(2, `say "hi"`)
+	gauge.Inc()
+	gauge.Dec()
+	gauge.Add(5)
+	histogram.Observe(0.5, "hello")
+	histogram.Observe(2, "hello")
+
+	var text bytes.Buffer
+	if err := registry.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`# HELP test_requests_total Requests\nper service`,
+		`# TYPE test_requests_total counter`,
+		`test_requests_total{service="say \"hi\""} 3`,
+		`test_in_flight 5`,
+		`test_seconds_bucket{service="hello",le="0.1"} 0`,
+		`test_seconds_bucket{service="hello",le="1"} 1`,
+		`test_seconds_bucket{service="hello",le="+Inf"} 2`,
+		`test_seconds_sum{service="hello"} 2.5`,
+		`test_seconds_count{service="hello"} 2`,
+	} {
+		if !strings.Contains(text.String(), line+"\n") {
+			t.Errorf("missing %s in\n%s", line, text.String())
+		}
+	}
+}
+
+func TestGaugeDelete(t *testing.T) {
+	registry := NewRegistry()
+	gauge := registry.NewGauge("test_workers", "Workers", "service")
+	gauge.Set(2, "hello")
+	gauge.Delete("hello")
+	var text bytes.Buffer
+	registry.WriteText(&text)
+	if strings.Contains(text.String(), "hello") {
+		t.Fatalf("deleted series still written:\n%s", text.String())
+	}
+}
+
+func TestOnCollect(t *testing.T) {
+	registry := NewRegistry()
+	gauge := registry.NewGauge("test_collected", "Set when collected")
+	registry.OnCollect(func() { gauge.Set(42) })
+	var text bytes.Buffer
+	registry.WriteText(&text)
+	if !strings.Contains(text.String(), "test_collected 42\n") {
+		t.Fatalf("hook not run:\n%s", text.String())
+	}
+}
+
+func TestDuplicateMetric(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "Once")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registered a metric twice")
+		}
+	}()
+	registry.NewCounter("test_total", "Twice")
+}
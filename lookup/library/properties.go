@@ -0,0 +1,42 @@
+package msg
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+//  Trace context and the caller's time budget travel with a request in
+//  a properties frame at a fixed place in it, in URL query encoding as
+//  rrapi's are, e.g. "deadline=1500&traceparent=00-<trace>-<span>-01".
+//  An empty frame carries neither. The frame is known by where it is and
+//  not by what it holds, so every other frame reaches the service just
+//  as it was sent.
+type Properties url.Values
+
+func NewProperties() Properties {
+	return Properties{}
+}
+
+//  The properties of a request made under ctx: the trace context of the
+//  span in ctx, if any, and what is left of its deadline, if it has one
+func ContextProperties(ctx context.Context) Properties {
+	properties := NewProperties()
+	if span := SpanFromContext(ctx); span != nil {
+		properties.SetTrace(span.Context)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		properties.SetBudget(time.Until(deadline))
+	}
+	return properties
+}
+
+//  Parses a properties frame
+func ParseProperties(frame string) (Properties, error) {
+	values, err := url.ParseQuery(frame)
+	return Properties(values), err
+}
+
+func (properties Properties) Frame() string {
+	return url.Values(properties).Encode()
+}
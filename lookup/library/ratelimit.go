@@ -0,0 +1,202 @@
+package msg
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//  In a limit's Client or Service, gives every client or service a
+	//  bucket of its own
+	LIMIT_EACH = "*"
+
+	//  A refused request is told when to try again in a frame of its own:
+	//  RETRY_AFTER_PREFIX + milliseconds
+	RETRY_AFTER_PREFIX = "retry-after:"
+
+	//  Buckets that have filled up again are dropped this often
+	RATE_LIMIT_SWEEP_INTERVAL = time.Minute
+)
+
+//  A token bucket limit. A bucket holds up to Burst tokens, and gains Rate
+//  of them each second. Each request takes a token from every bucket it
+//  falls under, and is refused if any of them is empty.
+//
+//  Client and Service say which requests a limit covers. Empty covers
+//  all, sharing one bucket; LIMIT_EACH covers all, with a bucket each;
+//  anything else covers only that client or service. So a limit on a
+//  service alone caps its total traffic, one on LIMIT_EACH client and a
+//  service caps each client's use of that service, and so on.
+type Limit struct {
+	Client  string  `json:",omitempty"`
+	Service string  `json:",omitempty"`
+	Rate    float64 //  Tokens per second; 0 in SetLimit removes the limit
+	Burst   int     `json:",omitempty"` //  At least 1; defaults to the rate
+}
+
+type limitKey struct{ client, service string }
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+//  Token bucket limits, keyed by client and service. Safe for concurrent
+//  use.
+type RateLimiter struct {
+	mutex    sync.Mutex
+	limits   map[limitKey]Limit
+	buckets  map[limitKey]map[limitKey]*bucket //  Per limit, per client and service
+	swept_at time.Time
+	now      func() time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		limits:  make(map[limitKey]Limit),
+		buckets: make(map[limitKey]map[limitKey]*bucket),
+		now:     time.Now,
+	}
+}
+
+//  Adds a limit, or replaces the one for the same client and service,
+//  whose buckets start full again. A limit with a rate of 0 removes it.
+func (limiter *RateLimiter) SetLimit(limit Limit) error {
+	if limit.Rate < 0 || math.IsNaN(limit.Rate) || math.IsInf(limit.Rate, 0) {
+		return errors.New("Error:BadLimit:rate")
+	}
+	if limit.Burst < 0 {
+		return errors.New("Error:BadLimit:burst")
+	}
+	if limit.Burst == 0 {
+		limit.Burst = int(math.Ceil(limit.Rate))
+	}
+	if limit.Burst == 0 {
+		limit.Burst = 1
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	key := limitKey{limit.Client, limit.Service}
+	delete(limiter.buckets, key)
+	if limit.Rate == 0 {
+		delete(limiter.limits, key)
+		return nil
+	}
+	limiter.limits[key] = limit
+	limiter.buckets[key] = make(map[limitKey]*bucket)
+	return nil
+}
+
+//  The limits in force, ordered by client and service
+func (limiter *RateLimiter) Limits() (limits []Limit) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limits = make([]Limit, 0, len(limiter.limits))
+	for _, limit := range limiter.limits {
+		limits = append(limits, limit)
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		if limits[i].Client != limits[j].Client {
+			return limits[i].Client < limits[j].Client
+		}
+		return limits[i].Service < limits[j].Service
+	})
+	return
+}
+
+//  Takes a token for a request from client to service. If any bucket it
+//  falls under is empty, takes none, and reports false and how long until
+//  the request would be let through.
+func (limiter *RateLimiter) Allow(client, service string) (retry_after time.Duration, ok bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	now := limiter.now()
+	if now.Sub(limiter.swept_at) >= RATE_LIMIT_SWEEP_INTERVAL {
+		limiter.sweep(now)
+	}
+
+	var taking []*bucket
+	for key, limit := range limiter.limits {
+		if !covers(key.client, client) || !covers(key.service, service) {
+			continue
+		}
+		b := limiter.bucket(key, limit, client, service, now)
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+			if wait > retry_after {
+				retry_after = wait
+			}
+		}
+		taking = append(taking, b)
+	}
+	if retry_after > 0 {
+		return retry_after, false
+	}
+	for _, b := range taking {
+		b.tokens--
+	}
+	return 0, true
+}
+
+func covers(pattern, name string) bool {
+	return pattern == "" || pattern == LIMIT_EACH || pattern == name
+}
+
+//  Finds the bucket a request falls under for a limit, creating it full,
+//  and tops it up. Caller holds the lock.
+func (limiter *RateLimiter) bucket(key limitKey, limit Limit, client, service string, now time.Time) *bucket {
+	which := limitKey{}
+	if key.client == LIMIT_EACH {
+		which.client = client
+	}
+	if key.service == LIMIT_EACH {
+		which.service = service
+	}
+	b, ok := limiter.buckets[key][which]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		limiter.buckets[key][which] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+	return b
+}
+
+//  Drops buckets that would be full by now, as they would be created
+//  again. Caller holds the lock.
+func (limiter *RateLimiter) sweep(now time.Time) {
+	for key, buckets := range limiter.buckets {
+		limit := limiter.limits[key]
+		for which, b := range buckets {
+			if b.tokens+now.Sub(b.updated).Seconds()*limit.Rate >= float64(limit.Burst) {
+				delete(buckets, which)
+			}
+		}
+	}
+	limiter.swept_at = now
+}
+
+//  The frame telling a refused client when to try again. Rounded up to
+//  whole milliseconds.
+func RetryAfterFrame(retry_after time.Duration) string {
+	ms := int64((retry_after + time.Millisecond - 1) / time.Millisecond)
+	return RETRY_AFTER_PREFIX + strconv.FormatInt(ms, 10)
+}
+
+//  Parses a retry-after frame. Reports false if frame is not one.
+func ParseRetryAfterFrame(frame string) (retry_after time.Duration, ok bool) {
+	if !strings.HasPrefix(frame, RETRY_AFTER_PREFIX) {
+		return
+	}
+	ms, err := strconv.ParseInt(frame[len(RETRY_AFTER_PREFIX):], 10, 64)
+	if err != nil || ms < 0 {
+		return
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
@@ -0,0 +1,120 @@
+package msg
+
+import (
+	"testing"
+	"time"
+)
+
+//  A limiter whose clock only moves when told
+func testLimiter(limits ...Limit) (*RateLimiter, *time.Time) {
+	limiter := NewRateLimiter()
+	now := time.Unix(1e9, 0)
+	limiter.now = func() time.Time { return now }
+	for _, limit := range limits {
+		if err := limiter.SetLimit(limit); err != nil {
+			panic(err)
+		}
+	}
+	return limiter, &now
+}
+
+func TestRateLimiterBucket(t *testing.T) {
+	limiter, now := testLimiter(Limit{Service: "echo", Rate: 2, Burst: 3})
+	for i := 0; i < 3; i++ {
+		if _, ok := limiter.Allow("a", "echo"); !ok {
+			t.Fatalf("refused request %d of the burst", i)
+		}
+	}
+	retry_after, ok := limiter.Allow("b", "echo")
+	if ok || retry_after != 500*time.Millisecond {
+		t.Fatalf("got %v, %t over the limit", retry_after, ok)
+	}
+	if _, ok = limiter.Allow("a", "other"); !ok {
+		t.Fatal("limited a service with no limit")
+	}
+
+	*now = now.Add(250 * time.Millisecond)
+	if retry_after, ok = limiter.Allow("a", "echo"); ok || retry_after != 250*time.Millisecond {
+		t.Fatalf("got %v, %t half way to a token", retry_after, ok)
+	}
+	*now = now.Add(250 * time.Millisecond)
+	if _, ok = limiter.Allow("a", "echo"); !ok {
+		t.Fatal("refused once a token was back")
+	}
+}
+
+func TestRateLimiterEach(t *testing.T) {
+	limiter, _ := testLimiter(
+		Limit{Client: LIMIT_EACH, Rate: 1},
+		Limit{Client: "batch", Service: "echo", Rate: 0.5},
+	)
+	if _, ok := limiter.Allow("a", "echo"); !ok {
+		t.Fatal("refused a's first request")
+	}
+	if _, ok := limiter.Allow("a", "other"); ok {
+		t.Fatal("a's bucket covers every service")
+	}
+	if _, ok := limiter.Allow("b", "echo"); !ok {
+		t.Fatal("b shares a's bucket")
+	}
+
+	//  Over the stricter of two limits, and no token taken from the other
+	retry_after, ok := limiter.Allow("batch", "echo")
+	if !ok {
+		t.Fatal("refused batch's first request")
+	}
+	if retry_after, ok = limiter.Allow("batch", "echo"); ok || retry_after != 2*time.Second {
+		t.Fatalf("got %v, %t", retry_after, ok)
+	}
+}
+
+func TestRateLimiterSetLimit(t *testing.T) {
+	limiter, _ := testLimiter(Limit{Service: "echo", Rate: 1})
+	limiter.Allow("a", "echo")
+	if _, ok := limiter.Allow("a", "echo"); ok {
+		t.Fatal("not limited")
+	}
+
+	//  A new limit starts with full buckets, and a zero rate removes it
+	if err := limiter.SetLimit(Limit{Service: "echo", Rate: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if limits := limiter.Limits(); len(limits) != 1 || limits[0].Burst != 10 {
+		t.Fatalf("got %+v", limits)
+	}
+	if _, ok := limiter.Allow("a", "echo"); !ok {
+		t.Fatal("replaced limit kept its empty bucket")
+	}
+	limiter.SetLimit(Limit{Service: "echo"})
+	if limits := limiter.Limits(); len(limits) != 0 {
+		t.Fatalf("got %+v", limits)
+	}
+
+	for _, bad := range []Limit{{Rate: -1}, {Rate: 1, Burst: -1}} {
+		if err := limiter.SetLimit(bad); err == nil {
+			t.Errorf("accepted %+v", bad)
+		}
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter, now := testLimiter(Limit{Client: LIMIT_EACH, Rate: 1})
+	limiter.Allow("a", "echo")
+	*now = now.Add(RATE_LIMIT_SWEEP_INTERVAL)
+	limiter.Allow("b", "echo")
+	if buckets := limiter.buckets[limitKey{client: LIMIT_EACH}]; len(buckets) != 1 {
+		t.Fatalf("%d buckets after a sweep", len(buckets))
+	}
+}
+
+func TestRetryAfterFrame(t *testing.T) {
+	retry_after, ok := ParseRetryAfterFrame(RetryAfterFrame(1500 * time.Microsecond))
+	if !ok || retry_after != 2*time.Millisecond {
+		t.Fatalf("got %v, %t", retry_after, ok)
+	}
+	for _, bad := range []string{"", "RateLimited", RETRY_AFTER_PREFIX + "-1", RETRY_AFTER_PREFIX + "soon"} {
+		if _, ok := ParseRetryAfterFrame(bad); ok {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package msg
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//  Policies used by SendRequest when the caller does not choose one
+var (
+	DefaultRetryPolicy   RetryPolicy = ConstantRetry{REQUEST_RETRIES, REQUEST_TIMEOUT}
+	HeartbeatRetryPolicy RetryPolicy = ConstantRetry{1, 1500 * time.Millisecond}
+)
+
+//  A retry policy decides how long to wait for each attempt at a request
+//  and whether, and after what delay, a failed attempt is sent again.
+//  Attempts are counted from zero.
+type RetryPolicy interface {
+	Timeout(attempt int) time.Duration
+	Retry(attempt int, err error) (wait time.Duration, ok bool)
+}
+
+//  A policy that can take back a retry it allowed, when the retry is not
+//  made after all
+type RetryRefunder interface {
+	Refund(attempt int)
+}
+
+//  Marks err as a transient failure that is worth another attempt
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return retryableError{err}
+}
+
+//  Reports whether err, or any error it wraps, was marked retryable
+func IsRetryable(err error) bool {
+	var r retryableError
+	return errors.As(err, &r)
+}
+
+type retryableError struct {
+	error
+}
+
+func (e retryableError) Unwrap() error {
+	return e.error
+}
+
+//  Retries immediately with the same reply timeout on every attempt.
+//  This is the Lazy Pirate behaviour SendRequest has always had.
+type ConstantRetry struct {
+	Attempts     int           //  Before we abandon
+	ReplyTimeout time.Duration //  Wait for a reply to each attempt
+}
+
+func (policy ConstantRetry) Timeout(attempt int) time.Duration {
+	return policy.ReplyTimeout
+}
+
+func (policy ConstantRetry) Retry(attempt int, err error) (time.Duration, bool) {
+	return 0, attempt+1 < policy.Attempts && IsRetryable(err)
+}
+
+//  Waits exponentially longer between attempts, with random jitter so
+//  that callers which failed together do not retry together. If a budget
+//  is set, retries are also limited to a share of all requests sent.
+type ExponentialBackoff struct {
+	Attempts     int           //  Before we abandon
+	ReplyTimeout time.Duration //  Wait for a reply to each attempt
+	BaseDelay    time.Duration //  Wait before the first retry
+	MaxDelay     time.Duration //  Upper bound on any wait
+	Multiplier   float64       //  Growth of the wait per attempt
+	Jitter       float64       //  Fraction of the wait that is random, 0-1
+	Budget       *RetryBudget  //  Optional, shared between policies
+}
+
+func NewExponentialBackoff(attempts int, budget *RetryBudget) *ExponentialBackoff {
+	return &ExponentialBackoff{
+		Attempts:     attempts,
+		ReplyTimeout: REQUEST_TIMEOUT,
+		BaseDelay:    100 * time.Millisecond,
+		MaxDelay:     10 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.5,
+		Budget:       budget,
+	}
+}
+
+//  The first attempt of every request earns credit in the budget
+func (policy *ExponentialBackoff) Timeout(attempt int) time.Duration {
+	if attempt == 0 && policy.Budget != nil {
+		policy.Budget.Deposit()
+	}
+	return policy.ReplyTimeout
+}
+
+func (policy *ExponentialBackoff) Retry(attempt int, err error) (time.Duration, bool) {
+	if attempt+1 >= policy.Attempts || !IsRetryable(err) {
+		return 0, false
+	}
+	if policy.Budget != nil && !policy.Budget.Withdraw() {
+		return 0, false
+	}
+	return policy.Delay(attempt), true
+}
+
+//  Returns to the budget the retry that Retry took for the given attempt
+func (policy *ExponentialBackoff) Refund(attempt int) {
+	if policy.Budget != nil {
+		policy.Budget.Refund()
+	}
+}
+
+//  Wait before the retry that follows the given attempt
+func (policy *ExponentialBackoff) Delay(attempt int) time.Duration {
+	delay := float64(policy.BaseDelay) * math.Pow(policy.Multiplier, float64(attempt))
+	if policy.MaxDelay > 0 && delay > float64(policy.MaxDelay) {
+		delay = float64(policy.MaxDelay)
+	}
+	jitter := delay * policy.Jitter
+	return time.Duration(delay - jitter + rand.Float64()*jitter)
+}
+
+//  A retry budget caps retries at a ratio of the requests sent, so that a
+//  struggling service sees at most (1 + ratio) times its normal load.
+//  Every request deposits ratio tokens and every retry withdraws one.
+type RetryBudget struct {
+	mutex   sync.Mutex
+	ratio   float64
+	max     float64
+	balance float64
+}
+
+//  Creates a budget allowing ratio retries per request, holding at most
+//  max unused retries. The budget starts full.
+func NewRetryBudget(ratio float64, max int) *RetryBudget {
+	return &RetryBudget{
+		ratio:   ratio,
+		max:     float64(max),
+		balance: float64(max),
+	}
+}
+
+func (budget *RetryBudget) Deposit() {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	budget.balance = math.Min(budget.balance+budget.ratio, budget.max)
+}
+
+//  Takes one retry from the budget, or reports false if it is spent
+func (budget *RetryBudget) Withdraw() bool {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	if budget.balance < 1 {
+		return false
+	}
+	budget.balance--
+	return true
+}
+
+//  Puts back a retry taken with Withdraw but not made
+func (budget *RetryBudget) Refund() {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	budget.balance = math.Min(budget.balance+1, budget.max)
+}
@@ -0,0 +1,81 @@
+package msg
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	err := errors.New("Error:TimeOut")
+	if IsRetryable(err) {
+		t.Fatal("plain error is retryable")
+	}
+	wrapped := Retryable(err)
+	if !IsRetryable(wrapped) || !errors.Is(wrapped, err) {
+		t.Fatal("retryable error lost its cause")
+	}
+	if Retryable(nil) != nil {
+		t.Fatal("nil became an error")
+	}
+}
+
+func TestConstantRetry(t *testing.T) {
+	policy := ConstantRetry{3, time.Second}
+	timeout := Retryable(errors.New("Error:TimeOut"))
+	for attempt, want := range []bool{true, true, false} {
+		if _, ok := policy.Retry(attempt, timeout); ok != want {
+			t.Errorf("attempt %d: retry %t, want %t", attempt, ok, want)
+		}
+	}
+	if _, ok := policy.Retry(0, errors.New("Error:InvalidService")); ok {
+		t.Error("retried an error from the service")
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	policy := NewExponentialBackoff(10, nil)
+	policy.Jitter = 0
+	for attempt, want := range []time.Duration{100, 200, 400, 800} {
+		if delay := policy.Delay(attempt); delay != want*time.Millisecond {
+			t.Errorf("attempt %d: delay %v, want %v", attempt, delay, want*time.Millisecond)
+		}
+	}
+	if delay := policy.Delay(20); delay != policy.MaxDelay {
+		t.Errorf("delay %v beyond the maximum", delay)
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay := policy.Delay(1); delay < 100*time.Millisecond || delay > 200*time.Millisecond {
+			t.Fatalf("jittered delay %v out of range", delay)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(0.5, 2)
+	policy := NewExponentialBackoff(10, budget)
+	timeout := Retryable(errors.New("Error:TimeOut"))
+
+	//  The budget starts full, then refills half a retry per request
+	for i, want := range []bool{true, true, false} {
+		if _, ok := policy.Retry(0, timeout); ok != want {
+			t.Fatalf("retry %d: %t, want %t", i, ok, want)
+		}
+	}
+	policy.Timeout(0)
+	if _, ok := policy.Retry(0, timeout); ok {
+		t.Fatal("retried on half a token")
+	}
+	policy.Timeout(0)
+	if _, ok := policy.Retry(0, timeout); !ok {
+		t.Fatal("two requests did not earn a retry")
+	}
+
+	//  A retry given back may be taken again
+	policy.Refund(0)
+	if _, ok := policy.Retry(0, timeout); !ok {
+		t.Fatal("refunded retry not available")
+	}
+}
@@ -0,0 +1,136 @@
+package msg
+
+import (
+	"context"
+	"fmt"
+	zmq "github.com/pebbe/zmq4"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	server_requests = DefaultRegistry.NewCounter("server_requests_total",
+		"Requests received per service", "service")
+	server_errors = DefaultRegistry.NewCounter("server_errors_total",
+		"Requests answered with an error per service", "service")
+	server_latency = DefaultRegistry.NewHistogram("server_request_duration_seconds",
+		"Time from receiving a request to sending its reply per service", LATENCY_BUCKETS, "service")
+)
+
+//  A server answers requests for a set of services on one REP socket.
+//  Every request is traced, and counted in the default registry, which
+//  is served over HTTP if MetricsAddress is set.
+type Server struct {
+	Reply    string                    //  Signature sent ahead of every reply
+	Services map[string]ProcessRequest //  Handlers by SID
+	//  Handlers by SID that also get the request's context, which holds
+	//  its span and ends at the caller's deadline. Requests they send
+	//  with SendRequestContext join the trace and inherit the deadline.
+	ContextServices map[string]ProcessRequestContext
+	MetricsAddress  string //  Serve /metrics here if set
+}
+
+type ProcessRequestContext func(ctx context.Context, message string) (string, error)
+
+//  Creates a server, taking the metrics address from METRICS_ADDRESS
+func NewServer(reply string, services map[string]ProcessRequest) *Server {
+	return &Server{
+		Reply:          reply,
+		Services:       services,
+		MetricsAddress: os.Getenv(METRICS_ADDRESS_ENV),
+	}
+}
+
+//  Longest wait for a request before checking whether to stop serving
+const SERVE_POLL_INTERVAL = 250 * time.Millisecond
+
+//  Binds to address and serves requests. Returns only if the socket
+//  cannot be set up.
+func (server *Server) ListenAndServe(address string) error {
+	return server.ListenAndServeContext(context.Background(), address)
+}
+
+//  Binds to address and serves requests until ctx is done, which is
+//  noticed within SERVE_POLL_INTERVAL
+func (server *Server) ListenAndServeContext(ctx context.Context, address string) (err error) {
+	var responder *zmq.Socket
+	responder, err = zmq.NewSocket(zmq.REP)
+	if err != nil {
+		return
+	}
+	defer responder.Close()
+	err = responder.Bind(address)
+	if err != nil {
+		return
+	}
+	if server.MetricsAddress != "" {
+		ServeMetrics(server.MetricsAddress, DefaultRegistry)
+	}
+
+	poller := zmq.NewPoller()
+	poller.Add(responder, zmq.POLLIN)
+	for ctx.Err() == nil {
+		var polled []zmq.Polled
+		polled, err = poller.Poll(SERVE_POLL_INTERVAL)
+		if err != nil {
+			return
+		}
+		if len(polled) > 0 {
+			server.serveRequest(ctx, responder)
+		}
+	}
+	return ctx.Err()
+}
+
+//  Receives one request, processes it and replies, reporting any error
+//  to the client
+func (server *Server) serveRequest(ctx context.Context, responder *zmq.Socket) {
+	sid, message, span, deadline, err := receiveRequest(responder, server.known)
+	defer span.End()
+
+	//  Heartbeats are not counted, and unknown SIDs share one label so
+	//  that clients cannot create series at will
+	label := sid
+	if !server.known(sid) {
+		label = "unknown"
+	}
+	if sid != PPP_HEARTBEAT {
+		server_requests.Inc(label)
+		defer server_latency.ObserveSince(time.Now(), label)
+	}
+	if err != nil {
+		server_errors.Inc(label)
+		SendToClient(server.Reply, fmt.Sprintf("%s", err), "Error Receiving Message", responder)
+		return
+	}
+
+	var reply string
+	if process, isPresent := server.ContextServices[sid]; isPresent {
+		ctx = ContextWithSpan(ctx, span)
+		if !deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+		reply, err = process(ctx, message)
+	} else {
+		reply, err = server.Services[sid](message)
+	}
+	if err != nil {
+		log.Println(err)
+		server_errors.Inc(label)
+		span.SetError(err)
+		SendToClient(server.Reply, fmt.Sprintf("%s", err), "Error Processing Request", responder)
+		return
+	}
+	SendToClient(server.Reply, "", reply, responder)
+}
+
+func (server *Server) known(sid string) bool {
+	_, isPresent := server.Services[sid]
+	if !isPresent {
+		_, isPresent = server.ContextServices[sid]
+	}
+	return isPresent
+}
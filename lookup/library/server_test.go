@@ -0,0 +1,97 @@
+package msg_test
+
+import (
+	"context"
+	"errors"
+	"harness"
+	msg "llibrary"
+	"testing"
+	"time"
+)
+
+func startHello(t *testing.T) msg.Service {
+	server := msg.NewServer("hello", map[string]msg.ProcessRequest{
+		"hello": func(message string) (string, error) {
+			if message == "" {
+				return "", errors.New("Error:EmptyMessage")
+			}
+			return "World", nil
+		},
+		msg.PPP_HEARTBEAT: msg.ProcessHeartBeat,
+	})
+	endpoint := harness.StartLookupServer(t, server)
+	return msg.NewService("hello", "Hello Service", endpoint, "hello", "REP")
+}
+
+func TestServerRequestReply(t *testing.T) {
+	service := startHello(t)
+	reply, err := msg.SendRequest(service, "hello", "Hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 1 || reply[0] != "World" {
+		t.Fatalf("got %q", reply)
+	}
+}
+
+func TestServerHeartbeat(t *testing.T) {
+	service := startHello(t)
+	reply, err := msg.SendRequest(service, msg.PPP_HEARTBEAT, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) < 1 || reply[0] != msg.PPP_READY {
+		t.Fatalf("got %q", reply)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	service := startHello(t)
+	if _, err := msg.SendRequest(service, "nosuch", "Hi"); err == nil || err.Error() != "Error:InvalidService" {
+		t.Fatalf("got %v for an unknown service", err)
+	}
+	if _, err := msg.SendRequest(service, "hello", ""); err == nil || err.Error() != "Error:EmptyMessage" {
+		t.Fatalf("got %v from a failing handler", err)
+	}
+
+	//  A server bound under another signature is the wrong service
+	service.Reply = "lookup"
+	if _, err := msg.SendRequest(service, "hello", "Hi"); err == nil {
+		t.Fatal("accepted a reply with the wrong signature")
+	}
+}
+
+func TestServerDeadline(t *testing.T) {
+	server := msg.NewServer("budget", nil)
+	server.ContextServices = map[string]msg.ProcessRequestContext{
+		"budget": func(ctx context.Context, message string) (string, error) {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				return "", errors.New("Error:NoDeadline")
+			}
+			if msg.SpanFromContext(ctx) == nil {
+				return "", errors.New("Error:NoSpan")
+			}
+			return time.Until(deadline).String(), nil
+		},
+	}
+	service := msg.NewService("budget", "Budget Service", harness.StartLookupServer(t, server), "budget", "REP")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := msg.SendRequestContext(ctx, service, "budget", "Hi", msg.DefaultRetryPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget, err := time.ParseDuration(reply[0])
+	if err != nil || budget <= 0 || budget > time.Second {
+		t.Fatalf("handler saw a budget of %q", reply)
+	}
+
+	//  Nothing is sent once the caller is out of time
+	expired, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	if _, err = msg.SendRequestContext(expired, service, "budget", "Hi", msg.DefaultRetryPolicy); err != msg.ErrDeadlineExceeded {
+		t.Fatalf("got %v past the deadline", err)
+	}
+}
@@ -0,0 +1,355 @@
+package msg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//  Trace context travels between processes as a W3C traceparent,
+	//  "00-<trace id>-<span id>-01", in the TRACE_PROPERTY of a request's
+	//  properties frame. Requests to rrbroker in the old "SID:message"
+	//  format, which has no properties, send it ahead in a frame of its
+	//  own, as TRACE_PREFIX + traceparent.
+	TRACE_PROPERTY = "traceparent"
+	TRACE_PREFIX   = "traceparent:"
+	TRACE_VERSION  = "00"
+	TRACE_SAMPLED  = "01"
+
+	//  Spans are only exported when this names a file to append them to
+	TRACE_FILE_ENV = "TRACE_FILE"
+)
+
+//  Span kinds, numbered as in OpenTelemetry
+type SpanKind int
+
+const (
+	SPAN_KIND_INTERNAL SpanKind = 1
+	SPAN_KIND_SERVER   SpanKind = 2
+	SPAN_KIND_CLIENT   SpanKind = 3
+)
+
+//  Identifies a span within a trace, as carried between processes
+type SpanContext struct {
+	TraceID string //  32 hex digits
+	SpanID  string //  16 hex digits
+}
+
+func (sc SpanContext) IsValid() bool {
+	return len(sc.TraceID) == 32 && len(sc.SpanID) == 16
+}
+
+//  The context in W3C traceparent format
+func (sc SpanContext) String() string {
+	return TRACE_VERSION + "-" + sc.TraceID + "-" + sc.SpanID + "-" + TRACE_SAMPLED
+}
+
+//  The caller's trace context, if it sent one
+func (properties Properties) Trace() (sc SpanContext, ok bool) {
+	traceparent, ok := properties[TRACE_PROPERTY]
+	if !ok || len(traceparent) == 0 {
+		return SpanContext{}, false
+	}
+	return ParseTraceParent(traceparent[0])
+}
+
+func (properties Properties) SetTrace(sc SpanContext) {
+	properties[TRACE_PROPERTY] = []string{sc.String()}
+}
+
+//  The context as a frame to send ahead of an old-format request
+func (sc SpanContext) Frame() string {
+	return TRACE_PREFIX + sc.String()
+}
+
+//  Parses a trace frame. Reports false if frame is not one.
+func ParseTraceFrame(frame string) (sc SpanContext, ok bool) {
+	if !strings.HasPrefix(frame, TRACE_PREFIX) {
+		return
+	}
+	return ParseTraceParent(frame[len(TRACE_PREFIX):])
+}
+
+//  Parses a W3C traceparent, as sent in HTTP headers
+func ParseTraceParent(traceparent string) (sc SpanContext, ok bool) {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || parts[0] != TRACE_VERSION {
+		return
+	}
+	sc = SpanContext{parts[1], parts[2]}
+	ok = sc.IsValid()
+	return
+}
+
+//  Splits a leading trace frame off a message, if there is one
+func PopTraceFrame(frames []string) (sc SpanContext, rest []string) {
+	rest = frames
+	if len(frames) > 0 {
+		var ok bool
+		if sc, ok = ParseTraceFrame(frames[0]); ok {
+			rest = frames[1:]
+		}
+	}
+	return
+}
+
+//  A span times one hop of a request. All methods are safe to call on a
+//  nil span, so untraced paths need no special casing.
+type Span struct {
+	mutex      sync.Mutex
+	Context    SpanContext
+	ParentID   string //  Span ID of the parent, empty for a root span
+	Name       string
+	Kind       SpanKind
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        string
+}
+
+//  Starts a span as a child of parent, or as the root of a new trace if
+//  parent is not valid
+func StartSpan(name string, kind SpanKind, parent SpanContext) *Span {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]string),
+	}
+	if parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		span.Context.TraceID = randomID(16)
+	}
+	span.Context.SpanID = randomID(8)
+	return span
+}
+
+//  Context to send with requests made on behalf of this span
+func (span *Span) SpanContext() SpanContext {
+	if span == nil {
+		return SpanContext{}
+	}
+	return span.Context
+}
+
+func (span *Span) SetAttribute(key, value string) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	span.attributes[key] = value
+	span.mutex.Unlock()
+}
+
+//  Marks the span as failed; a nil error leaves it unchanged
+func (span *Span) SetError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+	span.mutex.Lock()
+	span.err = err.Error()
+	span.mutex.Unlock()
+}
+
+//  Ends the span and hands it to the exporter. Only the first call counts.
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	if !span.end.IsZero() {
+		span.mutex.Unlock()
+		return
+	}
+	span.end = time.Now()
+	span.mutex.Unlock()
+
+	exporter_mutex.Lock()
+	current := exporter
+	exporter_mutex.Unlock()
+	if current != nil {
+		current.ExportSpan(span)
+	}
+}
+
+type spanKey struct{}
+
+//  Returns a copy of ctx carrying span, so that requests sent with it
+//  become children of span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+func randomID(bytes int) string {
+	b := make([]byte, bytes)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+//  Receives every span as it ends
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+var (
+	exporter_mutex sync.Mutex
+	exporter       SpanExporter
+)
+
+//  Sets where ended spans go; nil drops them
+func SetSpanExporter(e SpanExporter) {
+	exporter_mutex.Lock()
+	exporter = e
+	exporter_mutex.Unlock()
+}
+
+//  Exports spans to a file if TRACE_FILE is set in the environment, under
+//  the given service name
+func InitTracing(service_name string) error {
+	path := os.Getenv(TRACE_FILE_ENV)
+	if path == "" {
+		return nil
+	}
+	e, err := NewFileExporter(path, service_name)
+	if err != nil {
+		return err
+	}
+	SetSpanExporter(e)
+	log.Println("Tracing to", path)
+	return nil
+}
+
+//  Appends spans to a file as JSON lines. Each line is an OTLP/JSON
+//  ExportTraceServiceRequest holding one span, the layout written by the
+//  OpenTelemetry collector's file exporter, so the file can be fed to
+//  OpenTelemetry tooling or read line by line.
+type FileExporter struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	service string
+}
+
+func NewFileExporter(path, service_name string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{
+		file:    file,
+		encoder: json.NewEncoder(file),
+		service: service_name,
+	}, nil
+}
+
+func (e *FileExporter) ExportSpan(span *Span) {
+	line := otlpExport{[]otlpResourceSpans{{
+		Resource: otlpResource{[]otlpAttribute{{"service.name", otlpValue{e.service}}}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{"llibrary"},
+			Spans: []otlpSpan{span.otlp()},
+		}},
+	}}}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.encoder.Encode(line); err != nil {
+		log.Println("Error writing span to file: ", err)
+	}
+}
+
+func (e *FileExporter) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.file.Close()
+}
+
+//  OTLP/JSON encoding of a span
+
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` //  1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+func (span *Span) otlp() (o otlpSpan) {
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	o = otlpSpan{
+		TraceId:           span.Context.TraceID,
+		SpanId:            span.Context.SpanID,
+		ParentSpanId:      span.ParentID,
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: 1},
+	}
+	for key, value := range span.attributes {
+		o.Attributes = append(o.Attributes, otlpAttribute{key, otlpValue{value}})
+	}
+	sort.Slice(o.Attributes, func(i, j int) bool { return o.Attributes[i].Key < o.Attributes[j].Key })
+	if span.err != "" {
+		o.Status = otlpStatus{2, span.err}
+	}
+	return
+}
@@ -0,0 +1,67 @@
+package msg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestTraceFrame(t *testing.T) {
+	root := StartSpan("root", SPAN_KIND_CLIENT, SpanContext{})
+	if !root.Context.IsValid() || root.ParentID != "" {
+		t.Fatalf("bad root span %+v", root.Context)
+	}
+	child := StartSpan("child", SPAN_KIND_SERVER, root.Context)
+	if child.Context.TraceID != root.Context.TraceID || child.ParentID != root.Context.SpanID {
+		t.Fatalf("child %+v not joined to %+v", child.Context, root.Context)
+	}
+
+	sc, ok := ParseTraceFrame(child.Context.Frame())
+	if !ok || sc != child.Context {
+		t.Fatalf("got %v, %t", sc, ok)
+	}
+	for _, bad := range []string{"", "hello:World", TRACE_PREFIX + "01-abc-def-01", TRACE_PREFIX + "00-abc-def-01"} {
+		if _, ok := ParseTraceFrame(bad); ok {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+
+	sc, rest := PopTraceFrame([]string{child.Context.Frame(), "hello:World"})
+	if sc != child.Context || !reflect.DeepEqual(rest, []string{"hello:World"}) {
+		t.Fatalf("got %v, %q", sc, rest)
+	}
+	sc, rest = PopTraceFrame([]string{"hello:World"})
+	if sc.IsValid() || len(rest) != 1 {
+		t.Fatalf("got %v, %q", sc, rest)
+	}
+}
+
+type recorder []*Span
+
+func (r *recorder) ExportSpan(span *Span) {
+	*r = append(*r, span)
+}
+
+func TestSpanExport(t *testing.T) {
+	var spans recorder
+	SetSpanExporter(&spans)
+	defer SetSpanExporter(nil)
+
+	span := StartSpan("test", SPAN_KIND_INTERNAL, SpanContext{})
+	span.End()
+	span.End()
+	if len(spans) != 1 || spans[0] != span {
+		t.Fatalf("exported %d spans", len(spans))
+	}
+
+	//  Untraced paths pass nil spans around
+	var none *Span
+	none.SetAttribute("key", "value")
+	none.End()
+	if SpanFromContext(context.Background()) != nil {
+		t.Fatal("span from an empty context")
+	}
+	if SpanFromContext(ContextWithSpan(context.Background(), span)) != span {
+		t.Fatal("span lost from context")
+	}
+}
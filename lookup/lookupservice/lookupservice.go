@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	zmq "github.com/pebbe/zmq4"
 	"io"
 	"io/ioutil"
 	msg "llibrary"
@@ -41,32 +40,14 @@ func init() {
 }
 
 func main() {
-	//  Socket to talk to clients
-	responder, err := zmq.NewSocket(zmq.REP)
-	if err != nil {
-		panic(err)
+	if err := msg.InitTracing("lookupservice"); err != nil {
+		log.Println(err)
 	}
-	defer responder.Close()
-	responder.Bind(ALLOWED_BINDERS)
-	fmt.Println("Directory Service at ", services["lookup"].Address, " waiting for connection...")
 
-	//  Wait for next request from client
-	for {
-		var service_required msg.ProcessRequest
-		var message string
-		service_required, message, err = msg.RecieveClientRequest(responder, myservices)
-		var reply string
-		if err != nil {
-			msg.SendToClient(services["lookup"].Reply, fmt.Sprintf("%s", err), "Error Receiving Message", responder)
-			continue
-		}
-		reply, err := service_required(message)
-		if err != nil {
-			msg.SendToClient(services["lookup"].Reply, fmt.Sprintf("%s", err), "Error Processing Request", responder)
-			continue
-		}
-		msg.SendToClient(services["lookup"].Reply, "", reply, responder)
-	}
+	//  Serve clients, with metrics at METRICS_ADDRESS if it is set
+	server := msg.NewServer(services["lookup"].Reply, myservices)
+	fmt.Println("Directory Service at ", services["lookup"].Address, " waiting for connection...")
+	panic(server.ListenAndServe(ALLOWED_BINDERS))
 }
 
 func getServiceDesc(SID string) (reply string, err error) {
@@ -135,17 +116,12 @@ func getServiceList() {
 // Lists all available services in the service list including the
 // "register" service that is not in the service list
 func listServices() {
-<<<<<<< HEAD
-	fmt.Printf("\n\n=====================\nAvailable services:\n%#v\n", msg.NewService("", "", "", "", ""))
-	for _, service := range services {
-		fmt.Printf("%v", service)
-=======
 	fmt.Println("\n\n=====================\nAvailable services:\n{SID Name Address Reply Socket}")
 	for _, service := range services {
 		fmt.Println(service)
->>>>>>> a020ff35954a322911fb4e82d068d2114a174334
 	}
-	fmt.Println("=====================\n")
+	fmt.Println("=====================")
+	fmt.Println()
 }
 
 //  Registers a new service by:
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"harness"
+	msg "llibrary"
+	"os"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	server := msg.NewServer("hello", map[string]msg.ProcessRequest{
+		msg.PPP_HEARTBEAT: msg.ProcessHeartBeat,
+	})
+	endpoint := harness.StartLookupServer(t, server)
+	services["hello"] = msg.NewService("hello", "Hello Service", endpoint, "hello", "REP")
+	defer delete(services, "hello")
+
+	reply, err := getServiceDesc("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var service msg.Service
+	if err = json.Unmarshal([]byte(reply), &service); err != nil {
+		t.Fatal(err)
+	}
+	if service.Address != endpoint || service.Heartbeat_state == "" {
+		t.Fatalf("got %+v", service)
+	}
+
+	if reply, err = getServiceDesc("nosuch"); err == nil || reply != "NotAvailable" {
+		t.Fatalf("got %q, %v for an unknown service", reply, err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	t.Chdir(t.TempDir())
+	defer delete(services, "hello")
+
+	description := msg.NewService("hello", "Hello Service", "tcp://localhost:5560", "hello", "REP")
+	reply, err := registerService(string(encodeTOJSON(description)))
+	if err != nil || reply != "RegistrationSuccess" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+	if services["hello"].Address != description.Address {
+		t.Fatalf("registered %+v", services["hello"])
+	}
+	if _, err = os.Stat(SERVICES_FILENAME); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = registerService("{not json"); err == nil {
+		t.Fatal("registered a bad description")
+	}
+}
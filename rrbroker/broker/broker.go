@@ -0,0 +1,766 @@
+//
+//  Request-reply broker, for embedding.
+//  Clients send requests to the broker's frontend, and the broker passes
+//  each to the backend of the service it names. Requests and replies are
+//  framed as described in rrapi. Requests in the old "SID:message" format
+//  are still accepted and answered in kind. Brokers may peer, passing on
+//  requests for services they do not have; see Peering.
+//
+//  A Broker is driven by one goroutine, in Run. Only Reload may be called
+//  from other goroutines while it runs.
+//
+
+package broker
+
+import (
+	zmq "github.com/pebbe/zmq4"
+
+	"context"
+	"errors"
+	"fmt"
+	llibrary "llibrary"
+	"log"
+	"rrbroker/rrapi"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_ADDRESS       = "tcp://*:5559"
+	DEFAULT_SERVICES_FILE = "services.json"
+)
+
+type Service struct {
+	SID, Name, Address string
+	Backend            *zmq.Socket `json:"-"`
+	//  The framing the service's workers speak: rrapi.RRPW_WORKER, or
+	//  empty for workers that expect a trace frame and the message body
+	Protocol string `json:",omitempty"`
+	//  Milliseconds to wait for a reply when the client does not say; 0
+	//  waits as long as it takes
+	Timeout int `json:",omitempty"`
+
+	endpoint string //  What Address bound to, for unbinding
+}
+
+//  A request forwarded to a service and awaiting its reply
+type inflight struct {
+	ID       string //  Tells the reply to this request from late ones
+	SID      string
+	Envelope []string
+	Started  time.Time
+	Deadline time.Time //  Zero if there is none
+	Span     *llibrary.Span
+	Legacy   bool //  The client sent "SID:message" and expects a bare reply
+
+	RequestID string //  Set if the request is in the request log
+	Replayed  bool   //  Sent again from the log, with no client to answer
+	Peer      string //  Set if the request went to a peer broker
+}
+
+type Broker struct {
+	address            string           //  Frontend endpoint
+	services_file      string           //  Service list; "" keeps it in memory only
+	heartbeat_interval time.Duration    //  Between heartbeats to and from workers
+	heartbeat_liveness int              //  Heartbeats a worker may miss
+	redispatch         int              //  Resends of a request whose worker died
+	default_timeout    time.Duration    //  For services that set none; 0 for none
+	endpoints          endpoints        //  Where registered services are bound
+	priorities         map[string]int   //  Weight of each priority in service queues
+	limits             []llibrary.Limit //  Rate limits to start with
+	request_log_dir    string           //  Where requests with IDs are logged; "" for nowhere
+	peering            Peering          //  How to federate; no Name for not at all
+	verbose            bool             //  Print registrations and the service list
+	registry           *llibrary.Registry
+	metrics            *metrics
+
+	frontend          *zmq.Socket
+	poller            *zmq.Poller
+	services          map[string]Service
+	services_modified time.Time //  Of the service list file when last read or written
+	pools             map[string]*pool
+	limiter           *llibrary.RateLimiter
+	request_log       *requestLog
+	replays           []string          //  Logged requests not yet sent again
+	expired           map[string]string //  Request IDs of logged requests that timed out, by ID
+	state_pub         *zmq.Socket       //  Our state, to peers
+	state_sub         *zmq.Socket       //  Peers' state, to us
+	peers             map[string]*peer
+
+	//  Requests awaiting replies, keyed by ID. A DEALER client may have
+	//  many in flight at once.
+	requests         map[string]inflight
+	request_sequence uint64
+
+	//  Run sleeps in Poll, so other goroutines wake it through a pipe
+	wake_address string
+	waker        *zmq.Socket //  Written by other goroutines, under waker_mutex
+	waker_mutex  sync.Mutex
+	woken        *zmq.Socket //  Read by Run
+	reload       chan bool
+}
+
+type Option func(*Broker)
+
+//  Sets the endpoint the frontend binds to
+func WithAddress(address string) Option {
+	return func(broker *Broker) { broker.address = address }
+}
+
+//  Sets the file services are loaded from and saved to, or "" to keep the
+//  service list in memory only
+func WithServicesFile(path string) Option {
+	return func(broker *Broker) { broker.services_file = path }
+}
+
+//  Sets how often the broker and its workers heartbeat each other, and how
+//  many heartbeats a worker may miss before it is dropped
+func WithHeartbeat(interval time.Duration, liveness int) Option {
+	return func(broker *Broker) {
+		broker.heartbeat_interval = interval
+		broker.heartbeat_liveness = liveness
+	}
+}
+
+//  Sets how many times a request is resent after its worker dies, before
+//  the client gets an error
+func WithRedispatch(times int) Option {
+	return func(broker *Broker) { broker.redispatch = times }
+}
+
+//  Binds services that register at the first free port from low to high,
+//  which their workers reach at host, rather than where they ask
+func WithPortRange(host string, low, high int) Option {
+	return func(broker *Broker) {
+		broker.endpoints.host = host
+		broker.endpoints.low = low
+		broker.endpoints.high = high
+	}
+}
+
+//  Binds services that register at ipc endpoints in dir, named after
+//  their SIDs, rather than where they ask
+func WithIPCDirectory(dir string) Option {
+	return func(broker *Broker) { broker.endpoints.ipc_dir = dir }
+}
+
+//  Sets the priorities requests may have, and the weight of each. While
+//  a service's workers are busy each priority gets a share of them in
+//  proportion to its weight. The default is interactive 8 and batch 1.
+func WithPriorities(weights map[string]int) Option {
+	return func(broker *Broker) { broker.priorities = weights }
+}
+
+//  Sets the rate limits the broker starts with. They can be changed while
+//  it runs through the "ratelimit" service.
+func WithRateLimits(limits ...llibrary.Limit) Option {
+	return func(broker *Broker) { broker.limits = limits }
+}
+
+//  Logs requests that carry a request ID, and their replies, in dir, and
+//  sends those without replies again when the broker starts
+func WithRequestLog(dir string) Option {
+	return func(broker *Broker) { broker.request_log_dir = dir }
+}
+
+//  Federates the broker with others, passing on requests for services
+//  it does not have to peers that have them
+func WithPeering(peering Peering) Option {
+	return func(broker *Broker) { broker.peering = peering }
+}
+
+//  Sets how long to wait for a reply for services that set no timeout
+func WithTimeout(timeout time.Duration) Option {
+	return func(broker *Broker) { broker.default_timeout = timeout }
+}
+
+//  Sets the registry the broker's metrics go in. By default each broker
+//  has its own.
+func WithRegistry(registry *llibrary.Registry) Option {
+	return func(broker *Broker) { broker.registry = registry }
+}
+
+//  Prints registrations and the service list to stdout
+func WithVerbose(verbose bool) Option {
+	return func(broker *Broker) { broker.verbose = verbose }
+}
+
+//  Creates a broker, binds its frontend and loads its service list
+func New(options ...Option) (broker *Broker, err error) {
+	broker = &Broker{
+		address:            DEFAULT_ADDRESS,
+		services_file:      DEFAULT_SERVICES_FILE,
+		heartbeat_interval: rrapi.HEARTBEAT_INTERVAL,
+		heartbeat_liveness: rrapi.HEARTBEAT_LIVENESS,
+		priorities:         defaultPriorities(),
+		services:           make(map[string]Service),
+		pools:              make(map[string]*pool),
+		requests:           make(map[string]inflight),
+		expired:            make(map[string]string),
+		peers:              make(map[string]*peer),
+		limiter:            llibrary.NewRateLimiter(),
+		reload:             make(chan bool, 1),
+	}
+	for _, option := range options {
+		option(broker)
+	}
+	if broker.registry == nil {
+		broker.registry = llibrary.NewRegistry()
+	}
+	broker.metrics = newMetrics(broker.registry)
+	broker.poller = zmq.NewPoller()
+	defer func() {
+		if err != nil {
+			broker.Close()
+		}
+	}()
+	if _, ok := broker.priorities[rrapi.PRIORITY_INTERACTIVE]; !ok {
+		err = errors.New("no weight for the default priority, " + rrapi.PRIORITY_INTERACTIVE)
+		return
+	}
+	for priority, weight := range broker.priorities {
+		if weight < 1 || weight > STRIDE {
+			err = fmt.Errorf("priority %q has weight %d, not 1 to %d", priority, weight, STRIDE)
+			return
+		}
+	}
+	for _, limit := range broker.limits {
+		if err = broker.limiter.SetLimit(limit); err != nil {
+			return
+		}
+	}
+
+	//  Prepare our frontend socket
+	broker.frontend, err = zmq.NewSocket(zmq.ROUTER)
+	if err != nil {
+		return
+	}
+	broker.frontend.SetLinger(0)
+	if err = broker.frontend.Bind(broker.address); err != nil {
+		return
+	}
+	broker.poller.Add(broker.frontend, zmq.POLLIN)
+
+	//  And the pipe that wakes Run
+	broker.wake_address = fmt.Sprintf("inproc://rrbroker-wake-%p", broker)
+	if broker.woken, err = zmq.NewSocket(zmq.PAIR); err != nil {
+		return
+	}
+	if err = broker.woken.Bind(broker.wake_address); err != nil {
+		return
+	}
+	if broker.waker, err = zmq.NewSocket(zmq.PAIR); err != nil {
+		return
+	}
+	if err = broker.waker.Connect(broker.wake_address); err != nil {
+		return
+	}
+	broker.poller.Add(broker.woken, zmq.POLLIN)
+
+	//  Load Service List, binding each service's backend
+	if broker.services_file != "" {
+		list, e := broker.readServiceList()
+		if e != nil {
+			log.Println(e)
+		}
+		broker.applyServiceList(list)
+	}
+	broker.metrics.services.Set(float64(len(broker.services)))
+
+	if broker.peering.Name != "" {
+		if err = broker.startPeering(); err != nil {
+			return
+		}
+	}
+
+	//  Then pick up where the last broker left off, once Run starts
+	if broker.request_log_dir != "" {
+		if broker.request_log, err = openRequestLog(broker.request_log_dir); err != nil {
+			return
+		}
+		broker.replays = broker.request_log.unanswered()
+	}
+	return
+}
+
+//  The endpoint the frontend is bound to. With a wildcard port this is
+//  the port actually chosen.
+func (broker *Broker) Endpoint() string {
+	endpoint, err := broker.frontend.GetLastEndpoint()
+	if err != nil {
+		return broker.address
+	}
+	return endpoint
+}
+
+//  The registry the broker's metrics are in
+func (broker *Broker) Registry() *llibrary.Registry {
+	return broker.registry
+}
+
+//  Asks the running broker to reload its service list. Safe to call from
+//  any goroutine.
+func (broker *Broker) Reload() {
+	select {
+	case broker.reload <- true:
+	default:
+	}
+	broker.wake()
+}
+
+func (broker *Broker) wake() {
+	broker.waker_mutex.Lock()
+	defer broker.waker_mutex.Unlock()
+	if broker.waker != nil {
+		broker.waker.Send("", zmq.DONTWAIT)
+	}
+}
+
+//  Switches messages between sockets, and heartbeats workers and times out
+//  requests between messages, until ctx is done
+func (broker *Broker) Run(ctx context.Context) error {
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			broker.wake()
+		case <-done:
+		}
+	}()
+
+	broker.println("Broker at ", broker.address, " waiting for connection...")
+	//  List available services
+	broker.listServices()
+
+	broker.replay()
+	heartbeat_at := time.Now().Add(broker.heartbeat_interval)
+	for {
+		sockets, err := broker.poller.Poll(broker.pollTimeout(heartbeat_at))
+		if err != nil {
+			return err //  Interrupted
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		for _, socket := range sockets {
+			switch s := socket.Socket; s {
+			case broker.frontend:
+				broker.serveFrontend()
+			case broker.woken:
+				s.RecvMessage(0)
+			case broker.state_sub:
+				broker.serveState()
+			//  All services and peers fall under default
+			default:
+				if p, ok := broker.peerFor(s); ok {
+					broker.servePeer(p)
+				} else {
+					broker.serveBackend(s)
+				}
+			} //end switch (sockets polled)
+		} //end for(sockets polled)
+
+		//  Disconnect and delete any expired workers
+		//  Send heartbeats to all workers if it's time
+		if time.Now().After(heartbeat_at) {
+			for SID, pool := range broker.pools {
+				broker.purge(pool, broker.services[SID])
+				broker.heartbeat(pool, broker.services[SID])
+			}
+			//  And pick up edits to the service list
+			broker.checkServiceList()
+			//  Replayed requests wait for their services' workers
+			broker.replay()
+			//  Tell peers what we have, and forget those gone quiet
+			if broker.peering.Name != "" {
+				broker.publishState()
+				broker.purgePeers()
+			}
+			heartbeat_at = time.Now().Add(broker.heartbeat_interval)
+		}
+
+		//  Answer requests whose deadline has passed
+		broker.expireRequests()
+
+		select {
+		case <-broker.reload:
+			broker.reloadServices()
+		default:
+		}
+	} //end for(forever)
+}
+
+//  Closes the broker's sockets and request log. Call it once Run has
+//  returned.
+func (broker *Broker) Close() {
+	broker.closePeering()
+	if broker.request_log != nil {
+		broker.request_log.close()
+		broker.request_log = nil
+	}
+	//  Unbind first, so the addresses are free when Close returns; closing
+	//  alone frees them only later
+	for SID, service := range broker.services {
+		service.Backend.Unbind(service.endpoint)
+		service.Backend.Close()
+		delete(broker.services, SID)
+	}
+	broker.waker_mutex.Lock()
+	if broker.waker != nil {
+		broker.waker.Close()
+		broker.waker = nil
+	}
+	broker.waker_mutex.Unlock()
+	if broker.woken != nil {
+		broker.woken.Close()
+		broker.woken = nil
+	}
+	if broker.frontend != nil {
+		broker.frontend.Unbind(broker.Endpoint())
+		broker.frontend.Close()
+		broker.frontend = nil
+	}
+}
+
+//  Receives a request from a client and forwards it to its service
+func (broker *Broker) serveFrontend() {
+	frames, err := broker.frontend.RecvMessage(0)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	envelope, frames := unwrapClientEnvelope(frames)
+	request, legacy, err := parseClientRequest(frames)
+	if err != nil {
+		broker.metrics.errors.Inc("bad_request")
+		broker.replyToClient(envelope, legacy,
+			rrapi.NewError(request.Service, rrapi.STATUS_BAD_REQUEST, err.Error()))
+		return
+	}
+
+	//  If the service request is to register a service, register it
+	if request.Service == rrapi.REGISTER {
+		broker.replyToClient(envelope, legacy, broker.registerService(request, legacy))
+		return
+	}
+
+	if request.Service == rrapi.DEREGISTER {
+		broker.replyToClient(envelope, legacy, broker.deregisterService(request))
+		return
+	}
+
+	if request.Service == rrapi.RATELIMIT {
+		broker.replyToClient(envelope, legacy, broker.rateLimitCommand(request))
+		return
+	}
+
+	if request.Service == rrapi.FETCH {
+		broker.replyToClient(envelope, legacy, broker.fetchReply(request))
+		return
+	}
+
+	//  If the service is not in the service list, pass the request on to a
+	//  peer that has it, or report back to client
+	service, isPresent := broker.services[request.Service]
+	var to_peer *peer
+	if !isPresent && request.Via() == "" {
+		to_peer = broker.choosePeer(request.Service)
+	}
+	if to_peer != nil {
+		service = Service{SID: request.Service, Address: to_peer.frontend}
+	} else if !isPresent {
+		broker.metrics.errors.Inc("invalid_service")
+		broker.replyToClient(envelope, legacy,
+			rrapi.NewError(request.Service, rrapi.STATUS_NOT_FOUND, "InvalidService"))
+		return
+	}
+
+	//  Turn away clients over their limits
+	if retry_after, ok := broker.limiter.Allow(clientOf(request, envelope), service.SID); !ok {
+		broker.metrics.errors.Inc("rate_limited")
+		broker.metrics.rate_limited.Inc(service.SID)
+		broker.replyToClient(envelope, legacy, rateLimited(service.SID, retry_after))
+		return
+	}
+
+	//  The client's timeout wins over the service's
+	timeout, err := request.Timeout()
+	if err != nil {
+		broker.metrics.errors.Inc("bad_request")
+		broker.replyToClient(envelope, legacy,
+			rrapi.NewError(request.Service, rrapi.STATUS_BAD_REQUEST, err.Error()))
+		return
+	}
+	if _, known := broker.priorities[request.Priority()]; !known {
+		broker.metrics.errors.Inc("bad_request")
+		broker.replyToClient(envelope, legacy,
+			rrapi.NewError(request.Service, rrapi.STATUS_BAD_REQUEST, "Error:BadRequest:priority:"+request.Priority()))
+		return
+	}
+	if timeout == 0 {
+		timeout = time.Duration(service.Timeout) * time.Millisecond
+	}
+	if timeout == 0 {
+		timeout = broker.default_timeout
+	}
+	if to_peer != nil {
+		broker.forwardToPeer(to_peer, service, envelope, request, timeout, legacy)
+		return
+	}
+
+	//  A request with an ID is logged before it goes anywhere, and one the
+	//  log already holds is answered from it
+	id := ""
+	if broker.request_log != nil {
+		id = request.RequestID()
+	}
+	if id != "" {
+		if held, seen := broker.request_log.lookup(id); seen {
+			broker.replyToClient(envelope, legacy, loggedReply(held))
+			return
+		}
+		if err = broker.request_log.logRequest(id, request); err != nil {
+			log.Println("Error logging request: ", err)
+			broker.metrics.errors.Inc("request_log")
+			broker.replyToClient(envelope, legacy,
+				rrapi.NewError(request.Service, rrapi.STATUS_UNAVAILABLE, "RequestLogFailed"))
+			return
+		}
+	}
+
+	record := broker.startRequest(service, envelope, request.Trace(), timeout, legacy)
+	if id != "" {
+		record.RequestID = id
+		broker.requests[record.ID] = record
+	}
+	broker.forward(service, record, request)
+}
+
+//  Sends a request in the framing the service registered with, queueing
+//  it until a worker is free if the service has a pool. Old style workers
+//  echo the request ID ahead of the envelope.
+func (broker *Broker) forward(service Service, record inflight, request rrapi.Request) {
+	request.SetTrace(record.Span.Context)
+	if service.Protocol == rrapi.RRPW_WORKER {
+		broker.enqueue(broker.getPool(service.SID), service, record, request)
+	} else {
+		service.Backend.SendMessage(record.ID, record.Envelope, request.Trace().Frame(), request.Body)
+	}
+}
+
+//  Receives a reply from a service and returns it to the client, in the
+//  format the client sent its request in
+func (broker *Broker) serveBackend(backend *zmq.Socket) {
+	service := broker.serviceFor(backend)
+	if service.Protocol == rrapi.RRPW_WORKER {
+		broker.serveWorker(service)
+		return
+	}
+
+	frames, err := backend.RecvMessage(0)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(frames) < 2 {
+		return
+	}
+	id, frames := frames[0], frames[1:]
+	_, frames = unwrapEnvelope(frames)
+	reply := rrapi.Reply{Service: service.SID, Status: rrapi.STATUS_OK, Body: frames}
+	request, ok := broker.currentRequest(id)
+	if !ok {
+		broker.metrics.late_replies.Inc(service.SID)
+		broker.logLateReply(id, reply)
+		return
+	}
+	broker.finishRequest(request)
+	broker.complete(request, reply)
+}
+
+//  Splits a message into the routing envelope, up to and including the
+//  empty delimiter frame a REQ socket adds, and the message itself. A
+//  DEALER client sends no delimiter, so its envelope is just its identity.
+func unwrapEnvelope(frames []string) (envelope, message []string) {
+	for i, frame := range frames {
+		if frame == "" {
+			return frames[:i+1], frames[i+1:]
+		}
+	}
+	if len(frames) == 0 {
+		return []string{""}, nil
+	}
+	return frames[:1], frames[1:]
+}
+
+//  Splits a client's message like unwrapEnvelope, except that a request
+//  in the new format starts at its protocol header. That follows the
+//  identity straight away for a DEALER client, or else a delimiter, and
+//  the properties frame after it may be empty.
+func unwrapClientEnvelope(frames []string) (envelope, message []string) {
+	for i := 1; i < len(frames); i++ {
+		if frames[i] == rrapi.RRPC_CLIENT && (i == 1 || frames[i-1] == "") {
+			return frames[:i], frames[i:]
+		}
+	}
+	return unwrapEnvelope(frames)
+}
+
+//  Who a request counts against for fairness and rate limits: the name
+//  the client gave itself, or else its socket's identity
+func clientOf(request rrapi.Request, envelope []string) string {
+	if client := request.Client(); client != "" {
+		return client
+	}
+	return envelope[0]
+}
+
+//  Parses a client request. Requests that do not start with the protocol
+//  header are taken to be in the old format: an optional trace context
+//  frame, then "SID:message". A request in the old format with no SID
+//  gets an empty service name, which no service has.
+func parseClientRequest(frames []string) (request rrapi.Request, legacy bool, err error) {
+	if len(frames) > 0 && frames[0] == rrapi.RRPC_CLIENT {
+		request, err = rrapi.ParseClientRequest(frames)
+		return
+	}
+	legacy = true
+	parent, frames := llibrary.PopTraceFrame(frames)
+	request = rrapi.NewRequest("")
+	if parent.IsValid() {
+		request.SetTrace(parent)
+	}
+	if len(frames) > 0 {
+		message := strings.SplitN(frames[0], ":", 2)
+		if len(message) == 2 {
+			request.Service = message[0]
+			request.Body = append([]string{message[1]}, frames[1:]...)
+		}
+	}
+	return
+}
+
+//  Sends a reply to a client. Clients using the old format get only the
+//  body, which for errors is a single frame such as "InvalidService".
+func (broker *Broker) replyToClient(envelope []string, legacy bool, reply rrapi.Reply) {
+	if !legacy {
+		broker.frontend.SendMessage(envelope, reply.ClientFrames())
+		return
+	}
+	body := reply.Body
+	if len(body) == 0 {
+		body = []string{""}
+	}
+	broker.frontend.SendMessage(envelope, body)
+}
+
+//  Answers a request, logging the reply first if the request is logged.
+//  A replayed request has no client to answer.
+func (broker *Broker) complete(request inflight, reply rrapi.Reply) {
+	if request.RequestID != "" {
+		if err := broker.request_log.logReply(request.RequestID, reply); err != nil {
+			log.Println("Error logging reply: ", err)
+			broker.metrics.errors.Inc("request_log")
+		}
+	}
+	if !request.Replayed {
+		broker.replyToClient(request.Envelope, request.Legacy, reply)
+	}
+}
+
+//  Finds the service whose backend socket a reply came in on
+func (broker *Broker) serviceFor(backend *zmq.Socket) Service {
+	for _, service := range broker.services {
+		if service.Backend == backend {
+			return service
+		}
+	}
+	return Service{}
+}
+
+//  Records a request forwarded to a service and starts its span, as a
+//  child of the client's span if it sent one. The request is finished
+//  when the reply comes back through the broker, or when it times out.
+func (broker *Broker) startRequest(service Service, envelope []string, parent llibrary.SpanContext, timeout time.Duration, legacy bool) inflight {
+	span := llibrary.StartSpan("rrbroker "+service.SID, llibrary.SPAN_KIND_SERVER, parent)
+	span.SetAttribute("service.address", service.Address)
+	broker.request_sequence++
+	request := inflight{
+		ID:       strconv.FormatUint(broker.request_sequence, 10),
+		SID:      service.SID,
+		Envelope: envelope,
+		Started:  time.Now(),
+		Span:     span,
+		Legacy:   legacy,
+	}
+	if timeout > 0 {
+		request.Deadline = request.Started.Add(timeout)
+	}
+	broker.requests[request.ID] = request
+	broker.metrics.requests.Inc(service.SID)
+	broker.metrics.in_flight.Inc(service.SID)
+	return request
+}
+
+//  Records the reply to a request on its way back to the client
+func (broker *Broker) finishRequest(request inflight) {
+	request.Span.End()
+	broker.metrics.replies.Inc(request.SID)
+	broker.metrics.in_flight.Dec(request.SID)
+	broker.metrics.duration.ObserveSince(request.Started, request.SID)
+	delete(broker.requests, request.ID)
+}
+
+//  Finds the request a reply is for, unless it has timed out
+func (broker *Broker) currentRequest(id string) (request inflight, ok bool) {
+	request, ok = broker.requests[id]
+	return
+}
+
+//  Answers each request whose deadline has passed with a timeout error.
+//  Its reply, if one ever comes, is discarded, unless the request is
+//  logged. The timeout comes from the broker rather than the service, so
+//  it is not logged as the reply: a logged request stays pending, for a
+//  late reply or a replay to answer.
+func (broker *Broker) expireRequests() {
+	now := time.Now()
+	for _, request := range broker.requests {
+		if request.Deadline.IsZero() || now.Before(request.Deadline) {
+			continue
+		}
+		if pool, ok := broker.pools[request.SID]; ok {
+			broker.cancel(pool, broker.services[request.SID], request.ID)
+		}
+		broker.metrics.errors.Inc("timeout")
+		request.Span.SetError(errors.New("Error:Timeout"))
+		request.Span.End()
+		broker.metrics.in_flight.Dec(request.SID)
+		delete(broker.requests, request.ID)
+		if request.RequestID != "" {
+			broker.expired[request.ID] = request.RequestID
+		}
+		if !request.Replayed {
+			broker.replyToClient(request.Envelope, request.Legacy,
+				rrapi.NewError(request.SID, rrapi.STATUS_TIMEOUT, "Timeout"))
+		}
+	}
+}
+
+//  How long to poll for: until the next heartbeat or the nearest
+//  request deadline, whichever comes first
+func (broker *Broker) pollTimeout(heartbeat_at time.Time) time.Duration {
+	next := heartbeat_at
+	for _, request := range broker.requests {
+		if !request.Deadline.IsZero() && request.Deadline.Before(next) {
+			next = request.Deadline
+		}
+	}
+	timeout := time.Until(next)
+	if timeout < 0 {
+		timeout = 0
+	}
+	return timeout
+}
@@ -0,0 +1,734 @@
+package broker_test
+
+import (
+	zmq "github.com/pebbe/zmq4"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"harness"
+	llibrary "llibrary"
+	"os"
+	"path/filepath"
+	"rrbroker/broker"
+	"rrbroker/rrapi"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func echo(request rrapi.Request) rrapi.Reply {
+	return rrapi.Reply{Service: request.Service, Status: rrapi.STATUS_OK, Body: request.Body}
+}
+
+//  Starts a broker with an echo service and one worker for it
+func startEcho(t *testing.T, options ...broker.Option) (*broker.Broker, broker.Service) {
+	b := harness.StartRRBroker(t, options...)
+	service := broker.Service{SID: "echo", Name: "Echo", Address: harness.Endpoint("echo")}
+	harness.RegisterRRService(t, b.Endpoint(), service)
+	harness.StartReadyRRWorker(t, b, service, echo)
+	return b, service
+}
+
+func TestRequestReply(t *testing.T) {
+	b, _ := startEcho(t)
+	reply := harness.CallRR(t, b.Endpoint(), rrapi.NewRequest("echo", "Hello", "World"))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Hello", "World")
+	if reply.Service != "echo" {
+		t.Fatalf("got reply from %q", reply.Service)
+	}
+	if n := harness.Metric(t, b.Registry(), `rrbroker_replies_total{service="echo"}`); n != 1 {
+		t.Fatalf("counted %v replies", n)
+	}
+}
+
+func TestLegacyRequest(t *testing.T) {
+	b, _ := startEcho(t)
+	reply := harness.Call(t, b.Endpoint(), "echo:Hello")
+	if len(reply) != 1 || reply[0] != "Hello" {
+		t.Fatalf("got %q", reply)
+	}
+	reply = harness.Call(t, b.Endpoint(), "nosuch:Hello")
+	if len(reply) != 1 || reply[0] != "InvalidService" {
+		t.Fatalf("got %q", reply)
+	}
+}
+
+func TestDealerClient(t *testing.T) {
+	b, _ := startEcho(t)
+	dealer, err := zmq.NewSocket(zmq.DEALER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dealer.Close()
+	dealer.SetLinger(0)
+	dealer.SetRcvtimeo(harness.WAIT_TIMEOUT)
+	if err = dealer.Connect(b.Endpoint()); err != nil {
+		t.Fatal(err)
+	}
+
+	//  No delimiter, and an empty properties frame. Both requests are in
+	//  flight at once, and both are answered.
+	request := rrapi.NewRequest("echo", "Hello")
+	if request.Properties.Encode() != "" {
+		t.Fatalf("got properties %q", request.Properties.Encode())
+	}
+	for _, body := range []string{"Hello", "World"} {
+		request.Body = []string{body}
+		if _, err = dealer.SendMessage(request.ClientFrames()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for i := 0; i < 2; i++ {
+		frames, err := dealer.RecvMessage(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := rrapi.ParseClientReply(frames)
+		if err != nil || len(reply.Body) != 1 {
+			t.Fatalf("got %q: %v", frames, err)
+		}
+		got = append(got, reply.Body[0])
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "Hello,World" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestUnknownService(t *testing.T) {
+	b := harness.StartRRBroker(t)
+	reply := harness.CallRR(t, b.Endpoint(), rrapi.NewRequest("nosuch", "Hello"))
+	harness.AssertReply(t, reply, rrapi.STATUS_NOT_FOUND, "InvalidService")
+}
+
+func TestBadRequest(t *testing.T) {
+	b, _ := startEcho(t)
+	request := rrapi.NewRequest("echo", "Hello")
+	request.Properties.Set(rrapi.TIMEOUT, "soon")
+	harness.AssertReply(t, harness.CallRR(t, b.Endpoint(), request), rrapi.STATUS_BAD_REQUEST)
+}
+
+func TestRegistration(t *testing.T) {
+	b, service := startEcho(t)
+
+	//  Registering again changes nothing and keeps the worker connected
+	registration := harness.RegisterRRService(t, b.Endpoint(), service)
+	if registration.SID != "echo" || registration.Endpoint != service.Address || registration.Saved {
+		t.Fatalf("got %+v", registration)
+	}
+	reply := harness.CallRR(t, b.Endpoint(), rrapi.NewRequest("echo", "Again"))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Again")
+
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.DEREGISTER, "echo"))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK)
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest("echo", "Gone"))
+	harness.AssertReply(t, reply, rrapi.STATUS_NOT_FOUND)
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.DEREGISTER, "echo"))
+	harness.AssertReply(t, reply, rrapi.STATUS_NOT_FOUND)
+}
+
+func TestRegistrationSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	b := harness.StartRRBroker(t, broker.WithServicesFile(path))
+	service := broker.Service{SID: "echo", Name: "Echo", Address: harness.Endpoint("echo")}
+	if registration := harness.RegisterRRService(t, b.Endpoint(), service); !registration.Saved {
+		t.Fatalf("got %+v", registration)
+	}
+	if saved, err := os.ReadFile(path); err != nil || !strings.Contains(string(saved), service.Address) {
+		t.Fatalf("saved %q, %v", saved, err)
+	}
+}
+
+func register(t *testing.T, endpoint, message string) (rrapi.Reply, rrapi.Registration) {
+	reply := harness.CallRR(t, endpoint, rrapi.NewRequest(rrapi.REGISTER, message))
+	registration, _ := rrapi.ParseRegistration(reply)
+	return reply, registration
+}
+
+func TestRegistrationInvalid(t *testing.T) {
+	b := harness.StartRRBroker(t)
+	for _, message := range []string{
+		`{not json`,
+		`{"SID":"echo","Address":"inproc://echo"} {}`,
+		`{"SID":"echo","Address":"inproc://echo","Port":5560}`,
+		`{"Name":"Echo","Address":"inproc://echo"}`,
+		`{"SID":"register","Address":"inproc://echo"}`,
+		`{"SID":"echo:1","Address":"inproc://echo"}`,
+		`{"SID":"echo"}`,
+		`{"SID":"echo","Address":"inproc://echo","Protocol":"MDPW01"}`,
+		`{"SID":"echo","Address":"inproc://echo","Timeout":-1}`,
+	} {
+		reply, _ := register(t, b.Endpoint(), message)
+		if reply.Status != rrapi.STATUS_BAD_REQUEST {
+			t.Errorf("got %s %q for %s", reply.Status, reply.Body, message)
+		}
+	}
+}
+
+func TestRegistrationConflicts(t *testing.T) {
+	b, service := startEcho(t)
+
+	//  The SID is taken at another address
+	moved := service
+	moved.Address = harness.Endpoint("echo")
+	message, _ := json.Marshal(moved)
+	reply, registration := register(t, b.Endpoint(), string(message))
+	harness.AssertReply(t, reply, rrapi.STATUS_CONFLICT)
+	if registration.ConflictsWith != "echo" {
+		t.Fatalf("got %+v", registration)
+	}
+
+	//  The address is taken by another SID
+	other := service
+	other.SID = "other"
+	message, _ = json.Marshal(other)
+	reply, registration = register(t, b.Endpoint(), string(message))
+	harness.AssertReply(t, reply, rrapi.STATUS_CONFLICT, "Conflict:Address", `{"SID":"other","Endpoint":"","Saved":false,"ConflictsWith":"echo"}`)
+
+	//  Neither took effect
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest("echo", "Still here"))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Still here")
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest("other", "Hello"))
+	harness.AssertReply(t, reply, rrapi.STATUS_NOT_FOUND)
+}
+
+func TestRegistrationBindFails(t *testing.T) {
+	b := harness.StartRRBroker(t)
+	reply, _ := register(t, b.Endpoint(), `{"SID":"echo","Address":"nosuch://transport"}`)
+	if reply.Err() == nil {
+		t.Fatal("registered at an address that cannot be bound")
+	}
+
+	//  Nothing was left behind to conflict with
+	service := broker.Service{SID: "echo", Name: "Echo", Address: harness.Endpoint("echo")}
+	harness.RegisterRRService(t, b.Endpoint(), service)
+}
+
+func TestLegacyRegistration(t *testing.T) {
+	b := harness.StartRRBroker(t)
+	reply := harness.Call(t, b.Endpoint(), `register:{"SID":"echo","Address":"`+harness.Endpoint("echo")+`"}`)
+	if len(reply) != 1 || reply[0] != "Registered" {
+		t.Fatalf("got %q", reply)
+	}
+	reply = harness.Call(t, b.Endpoint(), `register:{"SID":"echo"}`)
+	if len(reply) != 1 || reply[0] != "Failed:Missing Address" {
+		t.Fatalf("got %q", reply)
+	}
+}
+
+func TestQueueing(t *testing.T) {
+	b := harness.StartRRBroker(t)
+	service := broker.Service{SID: "slow", Name: "Slow", Address: harness.Endpoint("slow")}
+	harness.RegisterRRService(t, b.Endpoint(), service)
+	harness.StartReadyRRWorker(t, b, service, func(request rrapi.Request) rrapi.Reply {
+		time.Sleep(100 * time.Millisecond)
+		return echo(request)
+	})
+
+	//  One worker serves each request in turn
+	errs := make(chan error)
+	for _, body := range []string{"one", "two", "three"} {
+		go func(body string) {
+			reply, err := harness.SendRR(b.Endpoint(), rrapi.NewRequest("slow", body))
+			if err == nil {
+				err = reply.Err()
+			}
+			if err == nil && (len(reply.Body) != 1 || reply.Body[0] != body) {
+				err = fmt.Errorf("got %q for %q", reply.Body, body)
+			}
+			errs <- err
+		}(body)
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	b := harness.StartRRBroker(t)
+	service := broker.Service{SID: "busy", Name: "Busy", Address: harness.Endpoint("busy")}
+	harness.RegisterRRService(t, b.Endpoint(), service)
+	seen := make(chan string, 10)
+	proceed := make(chan bool)
+	harness.StartReadyRRWorker(t, b, service, func(request rrapi.Request) rrapi.Reply {
+		seen <- request.Body[0]
+		<-proceed
+		return echo(request)
+	})
+
+	//  With the worker held, a backlog of batch work builds up ahead of
+	//  an interactive call
+	errs := make(chan error)
+	send := func(body, priority string) {
+		request := rrapi.NewRequest("busy", body)
+		request.SetPriority(priority)
+		reply, err := harness.SendRR(b.Endpoint(), request)
+		if err == nil {
+			err = reply.Err()
+		}
+		errs <- err
+	}
+	go send("first", rrapi.PRIORITY_BATCH)
+	<-seen
+	for i := 0; i < 5; i++ {
+		go send("batch", rrapi.PRIORITY_BATCH)
+	}
+	harness.Eventually(t, func() bool {
+		return harness.Metric(t, b.Registry(), `rrbroker_priority_queue_depth{service="busy",priority="batch"}`) == 5
+	}, "batch requests to queue")
+	go send("urgent", rrapi.PRIORITY_INTERACTIVE)
+	harness.Eventually(t, func() bool {
+		return harness.Metric(t, b.Registry(), `rrbroker_priority_queue_depth{service="busy",priority="interactive"}`) == 1
+	}, "interactive request to queue")
+
+	close(proceed)
+	for i := 0; i < 6; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if next := []string{<-seen, <-seen}; next[0] != "urgent" && next[1] != "urgent" {
+		t.Fatalf("interactive request waited behind %q", next)
+	}
+
+	request := rrapi.NewRequest("busy", "Hello")
+	request.SetPriority("someday")
+	reply := harness.CallRR(t, b.Endpoint(), request)
+	harness.AssertReply(t, reply, rrapi.STATUS_BAD_REQUEST, "Error:BadRequest:priority:someday")
+}
+
+func TestRateLimit(t *testing.T) {
+	b, _ := startEcho(t, broker.WithRateLimits(llibrary.Limit{Client: llibrary.LIMIT_EACH, Service: "echo", Rate: 0.1}))
+	request := rrapi.NewRequest("echo", "Hello")
+	request.SetClient("chatty")
+	harness.AssertReply(t, harness.CallRR(t, b.Endpoint(), request), rrapi.STATUS_OK, "Hello")
+	reply := harness.CallRR(t, b.Endpoint(), request)
+	if retry_after, ok := reply.RetryAfter(); !ok || retry_after <= 0 || retry_after > 10*time.Second {
+		t.Fatalf("got %+v over the limit", reply)
+	}
+	if n := harness.Metric(t, b.Registry(), `rrbroker_rate_limited_total{service="echo"}`); n != 1 {
+		t.Fatalf("counted %v refusals", n)
+	}
+
+	//  Another client has a bucket of its own
+	harness.AssertReply(t, harness.CallRR(t, b.Endpoint(), rrapi.NewRequest("echo", "Hi")), rrapi.STATUS_OK, "Hi")
+
+	//  Limits change without a restart
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.RATELIMIT, `{"Client":"*","Service":"echo"}`))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Updated", "[]")
+	harness.AssertReply(t, harness.CallRR(t, b.Endpoint(), request), rrapi.STATUS_OK, "Hello")
+
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.RATELIMIT, `{"Service":"echo","Rate":5}`))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Updated", `[{"Service":"echo","Rate":5,"Burst":5}]`)
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.RATELIMIT))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Limits", `[{"Service":"echo","Rate":5,"Burst":5}]`)
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.RATELIMIT, `{"Rate":-1}`))
+	if reply.Status != rrapi.STATUS_BAD_REQUEST {
+		t.Fatalf("got %+v for a bad limit", reply)
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	b := harness.StartRRBroker(t, broker.WithRequestLog(t.TempDir()))
+	service := broker.Service{SID: "counted", Name: "Counted", Address: harness.Endpoint("counted")}
+	harness.RegisterRRService(t, b.Endpoint(), service)
+	calls := make(chan bool, 10)
+	harness.StartReadyRRWorker(t, b, service, func(request rrapi.Request) rrapi.Reply {
+		calls <- true
+		return echo(request)
+	})
+
+	request := rrapi.NewRequest("counted", "Hello")
+	request.SetRequestID(rrapi.NewRequestID())
+	harness.AssertReply(t, harness.CallRR(t, b.Endpoint(), request), rrapi.STATUS_OK, "Hello")
+	reply := harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.FETCH, request.RequestID()))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Hello")
+
+	//  Sent again, the request is answered from the log
+	harness.AssertReply(t, harness.CallRR(t, b.Endpoint(), request), rrapi.STATUS_OK, "Hello")
+	if len(calls) != 1 {
+		t.Fatalf("worker called %d times", len(calls))
+	}
+
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.FETCH, "nosuch"))
+	harness.AssertReply(t, reply, rrapi.STATUS_NOT_FOUND, "UnknownRequest")
+}
+
+func TestDeregisterInFlight(t *testing.T) {
+	b := harness.StartRRBroker(t, broker.WithRequestLog(t.TempDir()))
+	service := broker.Service{SID: "stuck", Name: "Stuck", Address: harness.Endpoint("stuck")}
+	harness.RegisterRRService(t, b.Endpoint(), service)
+	release := make(chan bool)
+	defer close(release)
+	harness.StartReadyRRWorker(t, b, service, func(request rrapi.Request) rrapi.Reply {
+		<-release
+		return echo(request)
+	})
+
+	request := rrapi.NewRequest("stuck", "Hello")
+	request.SetRequestID(rrapi.NewRequestID())
+	replies := make(chan rrapi.Reply)
+	go func() {
+		reply, _ := harness.SendRR(b.Endpoint(), request)
+		replies <- reply
+	}()
+	harness.Eventually(t, func() bool {
+		return harness.Metric(t, b.Registry(), `rrbroker_requests_in_flight{service="stuck"}`) == 1
+	}, "request to be in flight")
+
+	//  Its client is told, and so is the log
+	reply := harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.DEREGISTER, "stuck"))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK)
+	harness.AssertReply(t, <-replies, rrapi.STATUS_UNAVAILABLE, "ServiceRemoved")
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.FETCH, request.RequestID()))
+	harness.AssertReply(t, reply, rrapi.STATUS_UNAVAILABLE, "ServiceRemoved")
+}
+
+func TestRequestLogReplay(t *testing.T) {
+	dir := t.TempDir()
+	options := []broker.Option{
+		broker.WithServicesFile(filepath.Join(dir, "services.json")),
+		broker.WithRequestLog(dir),
+	}
+
+	//  A broker holding a request for a service with no workers stops
+	first, err := broker.New(append(options,
+		broker.WithAddress(harness.Endpoint("rrbroker")), broker.WithRegistry(llibrary.NewRegistry()))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		first.Run(ctx)
+		close(done)
+	}()
+	service := broker.Service{SID: "later", Name: "Later", Address: harness.Endpoint("later")}
+	harness.RegisterRRService(t, first.Endpoint(), service)
+	request := rrapi.NewRequest("later", "Hello")
+	request.SetRequestID(rrapi.NewRequestID())
+	go harness.SendRR(first.Endpoint(), request)
+	harness.Eventually(t, func() bool {
+		return harness.Metric(t, first.Registry(), `rrbroker_queue_depth{service="later"}`) == 1
+	}, "request to queue")
+	cancel()
+	<-done
+	first.Close()
+
+	//  The next sends it on once a worker turns up
+	b := harness.StartRRBroker(t, options...)
+	harness.Eventually(t, func() bool {
+		return harness.Metric(t, b.Registry(), `rrbroker_replayed_total{service="later"}`) == 1
+	}, "request to be replayed")
+	reply := harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.FETCH, request.RequestID()))
+	harness.AssertReply(t, reply, rrapi.STATUS_ACCEPTED, "Pending")
+	harness.StartReadyRRWorker(t, b, service, echo)
+	harness.Eventually(t, func() bool {
+		reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.FETCH, request.RequestID()))
+		return reply.Status == rrapi.STATUS_OK
+	}, "replayed request to be answered")
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Hello")
+}
+
+//  Writes value to path as a line of JSON, the way the broker keeps its
+//  service list and request log
+func writeJSONLine(t *testing.T, path string, value interface{}) {
+	t.Helper()
+	line, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, append(line, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestLogReplayWaitsForWorker(t *testing.T) {
+	dir := t.TempDir()
+	service := broker.Service{SID: "old", Name: "Old", Address: harness.Endpoint("old")}
+	request := rrapi.NewRequest("old", "Hello")
+	request.SetRequestID(rrapi.NewRequestID())
+	writeJSONLine(t, filepath.Join(dir, "services.json"), service)
+	writeJSONLine(t, filepath.Join(dir, broker.REQUEST_LOG_FILE), map[string]interface{}{
+		"Time": time.Now(), "ID": request.RequestID(), "Request": request,
+	})
+
+	//  An old style service takes nothing until a worker connects, and the
+	//  broker serves without waiting for one
+	b := harness.StartRRBroker(t, broker.WithServicesFile(filepath.Join(dir, "services.json")), broker.WithRequestLog(dir))
+	fetch := rrapi.NewRequest(rrapi.FETCH, request.RequestID())
+	harness.AssertReply(t, harness.CallRR(t, b.Endpoint(), fetch), rrapi.STATUS_ACCEPTED, "Pending")
+
+	responder, err := zmq.NewSocket(zmq.REP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	responder.SetLinger(0)
+	responder.SetRcvtimeo(harness.WAIT_TIMEOUT)
+	if err = responder.Connect(service.Address); err != nil {
+		t.Fatal(err)
+	}
+	frames, err := responder.RecvMessage(0)
+	if err != nil || frames[len(frames)-1] != "Hello" {
+		t.Fatalf("got %q: %v", frames, err)
+	}
+	responder.SendMessage("World")
+	var reply rrapi.Reply
+	harness.Eventually(t, func() bool {
+		reply = harness.CallRR(t, b.Endpoint(), fetch)
+		return reply.Status == rrapi.STATUS_OK
+	}, "replayed request to be answered")
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "World")
+}
+
+func TestRequestLogTimeout(t *testing.T) {
+	b := harness.StartRRBroker(t, broker.WithRequestLog(t.TempDir()))
+	service := broker.Service{SID: "slow", Name: "Slow", Address: harness.Endpoint("slow")}
+	harness.RegisterRRService(t, b.Endpoint(), service)
+	release := make(chan bool)
+	defer close(release)
+	harness.StartReadyRRWorker(t, b, service, func(request rrapi.Request) rrapi.Reply {
+		<-release
+		return echo(request)
+	})
+
+	//  The client is told of the timeout, but the log does not take it
+	//  for the reply
+	request := rrapi.NewRequest("slow", "Hello")
+	request.SetRequestID(rrapi.NewRequestID())
+	request.SetTimeout(100 * time.Millisecond)
+	reply := harness.CallRR(t, b.Endpoint(), request)
+	harness.AssertReply(t, reply, rrapi.STATUS_TIMEOUT, "Timeout")
+	fetch := rrapi.NewRequest(rrapi.FETCH, request.RequestID())
+	harness.AssertReply(t, harness.CallRR(t, b.Endpoint(), fetch), rrapi.STATUS_ACCEPTED, "Pending")
+
+	//  The reply that comes after is logged instead
+	release <- true
+	harness.Eventually(t, func() bool {
+		reply = harness.CallRR(t, b.Endpoint(), fetch)
+		return reply.Status == rrapi.STATUS_OK
+	}, "late reply to be logged")
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Hello")
+}
+
+//  Starts two brokers peered with each other; east has an echo service
+func startPeers(t *testing.T) (west, east *broker.Broker) {
+	west_address, east_address := harness.Endpoint("west"), harness.Endpoint("east")
+	west_state, east_state := harness.Endpoint("west-state"), harness.Endpoint("east-state")
+	east, _ = startEcho(t, broker.WithAddress(east_address), broker.WithPeering(broker.Peering{
+		Name: "east", Frontend: east_address, State: east_state, Peers: []string{west_state},
+	}))
+	west = harness.StartRRBroker(t, broker.WithAddress(west_address), broker.WithPeering(broker.Peering{
+		Name: "west", Frontend: west_address, State: west_state, Peers: []string{east_state},
+	}))
+	harness.Eventually(t, func() bool {
+		return harness.Metric(t, west.Registry(), "rrbroker_peers") == 1
+	}, "west to hear from east")
+	return
+}
+
+func TestPeering(t *testing.T) {
+	west, east := startPeers(t)
+	reply := harness.CallRR(t, west.Endpoint(), rrapi.NewRequest("echo", "Hello"))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Hello")
+	reply = harness.CallRR(t, west.Endpoint(), rrapi.NewRequest("nosuch", "Hello"))
+	harness.AssertReply(t, reply, rrapi.STATUS_NOT_FOUND, "InvalidService")
+	if n := harness.Metric(t, west.Registry(), `rrbroker_forwarded_total{service="echo",peer="east"}`); n != 1 {
+		t.Fatalf("forwarded %v requests", n)
+	}
+	if n := harness.Metric(t, east.Registry(), `rrbroker_replies_total{service="echo"}`); n != 1 {
+		t.Fatalf("east answered %v requests", n)
+	}
+
+	//  Replies find their way back to each of several clients at once
+	replies := make(chan rrapi.Reply)
+	for i := 0; i < 5; i++ {
+		go func(i int) {
+			reply, err := harness.SendRR(west.Endpoint(), rrapi.NewRequest("echo", fmt.Sprint(i)))
+			if err != nil {
+				reply = rrapi.NewError("echo", rrapi.STATUS_INTERNAL, err.Error())
+			}
+			reply.Body = append(reply.Body, fmt.Sprint(i))
+			replies <- reply
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		reply := <-replies
+		if reply.Status != rrapi.STATUS_OK || reply.Body[0] != reply.Body[1] {
+			t.Fatalf("got %+v", reply)
+		}
+	}
+
+	//  A request that has been passed on once is not passed on again
+	request := rrapi.NewRequest("echo", "Hello")
+	request.SetVia("elsewhere")
+	reply = harness.CallRR(t, west.Endpoint(), request)
+	harness.AssertReply(t, reply, rrapi.STATUS_NOT_FOUND, "InvalidService")
+}
+
+func TestTimeout(t *testing.T) {
+	b := harness.StartRRBroker(t)
+	service := broker.Service{SID: "slow", Name: "Slow", Address: harness.Endpoint("slow")}
+	harness.RegisterRRService(t, b.Endpoint(), service)
+	harness.StartReadyRRWorker(t, b, service, func(request rrapi.Request) rrapi.Reply {
+		time.Sleep(300 * time.Millisecond)
+		return echo(request)
+	})
+
+	request := rrapi.NewRequest("slow", "Hello")
+	request.SetTimeout(100 * time.Millisecond)
+	reply := harness.CallRR(t, b.Endpoint(), request)
+	harness.AssertReply(t, reply, rrapi.STATUS_TIMEOUT, "Timeout")
+
+	//  The reply that comes after is dropped, and the worker serves again
+	harness.Eventually(t, func() bool {
+		return harness.Metric(t, b.Registry(), `rrbroker_late_replies_total{service="slow"}`) == 1
+	}, "late reply to be dropped")
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest("slow", "Again"))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Again")
+}
+
+func TestWorkerBudget(t *testing.T) {
+	b := harness.StartRRBroker(t)
+	service := broker.Service{SID: "budget", Name: "Budget", Address: harness.Endpoint("budget")}
+	harness.RegisterRRService(t, b.Endpoint(), service)
+	harness.StartReadyRRWorker(t, b, service, func(request rrapi.Request) rrapi.Reply {
+		deadline, ok := request.Context().Deadline()
+		if !ok {
+			return rrapi.NewError(request.Service, rrapi.STATUS_BAD_REQUEST, "NoDeadline")
+		}
+		return rrapi.Reply{Service: request.Service, Status: rrapi.STATUS_OK, Body: []string{time.Until(deadline).String()}}
+	})
+
+	request := rrapi.NewRequest("budget")
+	request.SetTimeout(time.Second)
+	reply := harness.CallRR(t, b.Endpoint(), request)
+	if reply.Err() != nil {
+		t.Fatal(reply.Err())
+	}
+	budget, err := time.ParseDuration(reply.Body[0])
+	if err != nil || budget <= 0 || budget > time.Second {
+		t.Fatalf("handler saw a budget of %q", reply.Body)
+	}
+}
+
+//  A worker that stops while holding a request, without replying
+func startStuck(t *testing.T, b *broker.Broker, service broker.Service) (stop func(), held chan bool) {
+	held = make(chan bool, 1)
+	release := make(chan bool)
+	t.Cleanup(func() { close(release) })
+	stop = harness.StartReadyRRWorker(t, b, service, func(request rrapi.Request) rrapi.Reply {
+		held <- true
+		<-release
+		return echo(request)
+	})
+	return
+}
+
+func TestDeadWorker(t *testing.T) {
+	b := harness.StartRRBroker(t)
+	service := broker.Service{SID: "echo", Name: "Echo", Address: harness.Endpoint("echo")}
+	harness.RegisterRRService(t, b.Endpoint(), service)
+	stop, held := startStuck(t, b, service)
+
+	go func() {
+		<-held
+		stop()
+	}()
+	reply := harness.CallRR(t, b.Endpoint(), rrapi.NewRequest("echo", "Hello"))
+	harness.AssertReply(t, reply, rrapi.STATUS_UNAVAILABLE, "WorkerDied")
+	if n := harness.Metric(t, b.Registry(), `rrbroker_workers_expired_total{service="echo"}`); n != 1 {
+		t.Fatalf("counted %v expired workers", n)
+	}
+}
+
+func TestRedispatch(t *testing.T) {
+	b := harness.StartRRBroker(t, broker.WithRedispatch(1))
+	service := broker.Service{SID: "echo", Name: "Echo", Address: harness.Endpoint("echo")}
+	harness.RegisterRRService(t, b.Endpoint(), service)
+
+	//  The stuck worker has been idle longest, so it gets the request first
+	stop, held := startStuck(t, b, service)
+	harness.StartReadyRRWorker(t, b, service, echo)
+
+	go func() {
+		<-held
+		stop()
+	}()
+	reply := harness.CallRR(t, b.Endpoint(), rrapi.NewRequest("echo", "Hello"))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Hello")
+}
+
+func TestHeartbeatKeepsIdleWorker(t *testing.T) {
+	b, _ := startEcho(t)
+	time.Sleep(10 * harness.HEARTBEAT_INTERVAL)
+	if n := harness.Metric(t, b.Registry(), `rrbroker_workers{service="echo"}`); n != 1 {
+		t.Fatalf("%v workers after idling", n)
+	}
+	reply := harness.CallRR(t, b.Endpoint(), rrapi.NewRequest("echo", strings.Repeat("x", 1000)))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK)
+}
+
+func TestAllocatedIPCEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	b := harness.StartRRBroker(t, broker.WithIPCDirectory(dir))
+
+	//  The address asked for is ignored
+	service := broker.Service{SID: "echo", Name: "Echo", Address: "tcp://*:5560"}
+	registration := harness.RegisterRRService(t, b.Endpoint(), service)
+	if registration.Endpoint != "ipc://"+filepath.Join(dir, "echo") {
+		t.Fatalf("got %+v", registration)
+	}
+	service.Address = registration.Endpoint
+	harness.StartReadyRRWorker(t, b, service, echo)
+	reply := harness.CallRR(t, b.Endpoint(), rrapi.NewRequest("echo", "Hello"))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK, "Hello")
+
+	for _, SID := range []string{"../echo", ".", ".."} {
+		reply, _ = register(t, b.Endpoint(), `{"SID":"`+SID+`"}`)
+		harness.AssertReply(t, reply, rrapi.STATUS_BAD_REQUEST)
+	}
+
+	//  An old worker could not be told where to connect
+	legacy := harness.Call(t, b.Endpoint(), `register:{"SID":"old","Address":"`+harness.Endpoint("old")+`"}`)
+	if len(legacy) != 1 || legacy[0] != "Failed:EndpointChosenByBroker" {
+		t.Fatalf("got %q", legacy)
+	}
+}
+
+func TestAllocatedPorts(t *testing.T) {
+	b := harness.StartRRBroker(t, broker.WithPortRange("localhost", 47560, 47561))
+	for i, SID := range []string{"one", "two"} {
+		registration := harness.RegisterRRService(t, b.Endpoint(), broker.Service{SID: SID})
+		if want := fmt.Sprintf("tcp://localhost:%d", 47560+i); registration.Endpoint != want {
+			t.Fatalf("got %+v, want %s", registration, want)
+		}
+	}
+
+	//  Registering again keeps the port
+	if registration := harness.RegisterRRService(t, b.Endpoint(), broker.Service{SID: "one"}); registration.Endpoint != "tcp://localhost:47560" {
+		t.Fatalf("got %+v", registration)
+	}
+
+	reply, _ := register(t, b.Endpoint(), `{"SID":"three"}`)
+	harness.AssertReply(t, reply, rrapi.STATUS_UNAVAILABLE)
+
+	//  A port is free again once its service has gone, though the socket
+	//  may take a moment to let go of it
+	reply = harness.CallRR(t, b.Endpoint(), rrapi.NewRequest(rrapi.DEREGISTER, "one"))
+	harness.AssertReply(t, reply, rrapi.STATUS_OK)
+	var registration rrapi.Registration
+	harness.Eventually(t, func() bool {
+		reply, registration = register(t, b.Endpoint(), `{"SID":"three"}`)
+		return reply.Status == rrapi.STATUS_OK
+	}, "port to be free")
+	if registration.Endpoint != "tcp://localhost:47560" {
+		t.Fatalf("got %+v", registration)
+	}
+}
@@ -0,0 +1,83 @@
+//
+//  Backend endpoints chosen by the broker.
+//  With a port range or an ipc directory configured, a service that
+//  registers is bound wherever the broker picks, and the address it asked
+//  for is ignored. The registration reply tells its workers where to
+//  connect. Services loaded from the service list keep their addresses;
+//  only whoever edits the file can choose those. Registrations in the old
+//  format are refused, since their reply has no room for the endpoint.
+//
+
+package broker
+
+import (
+	zmq "github.com/pebbe/zmq4"
+
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var errNoFreeEndpoint = errors.New("NoFreeEndpoint")
+
+//  Where the broker may bind backends for services that register
+type endpoints struct {
+	host      string //  Workers reach the broker's ports at this host
+	low, high int    //  Port range, inclusive; unset if high is 0
+	ipc_dir   string //  Directory for ipc endpoints; takes precedence
+}
+
+//  Reports whether the broker chooses backend endpoints itself
+func (e endpoints) allocating() bool {
+	return e.ipc_dir != "" || e.high > 0
+}
+
+//  The addresses a service may be bound at, in order of preference
+func (e endpoints) candidates(SID string) (addresses []string) {
+	if e.ipc_dir != "" {
+		return []string{"ipc://" + filepath.Join(e.ipc_dir, SID)}
+	}
+	for port := e.low; port <= e.high; port++ {
+		addresses = append(addresses, fmt.Sprintf("tcp://*:%d", port))
+	}
+	return
+}
+
+//  The address workers connect to for a backend bound at address
+func (e endpoints) connectAddress(address string) string {
+	if e.host != "" && strings.HasPrefix(address, "tcp://*:") {
+		return "tcp://" + e.host + address[len("tcp://*"):]
+	}
+	return address
+}
+
+//  Binds a new service at the first free endpoint the broker may choose.
+//  Endpoints other services hold are skipped, as are those something
+//  outside the broker has taken.
+func (broker *Broker) allocateService(service Service) (Service, error) {
+	if strings.ContainsAny(service.SID, `/\`) || service.SID == "." || service.SID == ".." {
+		return service, errors.New("SID is not a file name")
+	}
+	for _, address := range broker.endpoints.candidates(service.SID) {
+		if _, taken := broker.addressHolder(address); taken {
+			continue
+		}
+		service.Address = address
+		bound, err := broker.addService(service)
+		if zmq.AsErrno(err) == zmq.Errno(syscall.EADDRINUSE) {
+			continue
+		}
+		return bound, err
+	}
+	return service, errNoFreeEndpoint
+}
+
+//  Where a service's workers should connect
+func (broker *Broker) serviceEndpoint(service Service) string {
+	if broker.endpoints.allocating() {
+		return broker.endpoints.connectAddress(service.Address)
+	}
+	return service.endpoint
+}
@@ -0,0 +1,162 @@
+//
+//  Weighted fair queuing of the requests waiting for a service's workers.
+//  Each priority gets a share of the workers in proportion to its weight
+//  while requests of several priorities wait, by stride scheduling: the
+//  priority with the lowest pass goes next, and its pass then grows by
+//  STRIDE/weight. A priority that has had nothing queued starts again
+//  from the pass of the last one served, so it cannot save up turns.
+//  Within a priority each client has a queue of its own, and the clients
+//  take turns.
+//
+
+package broker
+
+import (
+	"rrbroker/rrapi"
+	"sort"
+)
+
+const (
+	//  Weights of the priorities every broker knows
+	DEFAULT_INTERACTIVE_WEIGHT = 8
+	DEFAULT_BATCH_WEIGHT       = 1
+
+	STRIDE = 1 << 20
+)
+
+//  The weights a broker starts with
+func defaultPriorities() map[string]int {
+	return map[string]int{
+		rrapi.PRIORITY_INTERACTIVE: DEFAULT_INTERACTIVE_WEIGHT,
+		rrapi.PRIORITY_BATCH:       DEFAULT_BATCH_WEIGHT,
+	}
+}
+
+//  The requests of one priority
+type class struct {
+	weight  int
+	pass    int64
+	clients []string             //  Clients with requests queued, next to go first
+	queues  map[string][]pending //  Each client's requests in arrival order
+	length  int
+}
+
+type fairQueue struct {
+	classes map[string]*class
+	names   []string  //  Priorities in order, to break ties
+	retries []pending //  Requests whose worker died, ahead of all others
+	pass    int64     //  Of the priority served last
+}
+
+func newFairQueue(weights map[string]int) *fairQueue {
+	q := &fairQueue{classes: make(map[string]*class)}
+	for priority, weight := range weights {
+		q.classes[priority] = &class{weight: weight, queues: make(map[string][]pending)}
+		q.names = append(q.names, priority)
+	}
+	sort.Strings(q.names)
+	return q
+}
+
+//  Requests waiting, of every priority
+func (q *fairQueue) len() int {
+	n := len(q.retries)
+	for _, c := range q.classes {
+		n += c.length
+	}
+	return n
+}
+
+//  Requests of one priority waiting, not counting any being retried
+func (q *fairQueue) depth(priority string) int {
+	if c, ok := q.classes[priority]; ok {
+		return c.length
+	}
+	return 0
+}
+
+//  Queues a request behind the others from its client. Its priority must
+//  be one the queue was made with.
+func (q *fairQueue) push(request pending) {
+	c := q.classes[request.priority]
+	if c.length == 0 && c.pass < q.pass {
+		c.pass = q.pass
+	}
+	queue := c.queues[request.client]
+	if len(queue) == 0 {
+		c.clients = append(c.clients, request.client)
+	}
+	c.queues[request.client] = append(queue, request)
+	c.length++
+}
+
+//  Puts a request back at the head of the queue, ahead of everything
+func (q *fairQueue) pushFront(request pending) {
+	q.retries = append([]pending{request}, q.retries...)
+}
+
+//  Takes the next request off the queue, which must not be empty
+func (q *fairQueue) pop() (request pending) {
+	if len(q.retries) > 0 {
+		request, q.retries = q.retries[0], q.retries[1:]
+		return
+	}
+	var next *class
+	for _, priority := range q.names {
+		c := q.classes[priority]
+		if c.length > 0 && (next == nil || c.pass < next.pass) {
+			next = c
+		}
+	}
+	q.pass = next.pass
+	next.pass += STRIDE / int64(next.weight)
+
+	client := next.clients[0]
+	next.clients = next.clients[1:]
+	queue := next.queues[client]
+	request = queue[0]
+	if len(queue) > 1 {
+		next.queues[client] = queue[1:]
+		next.clients = append(next.clients, client)
+	} else {
+		delete(next.queues, client)
+	}
+	next.length--
+	return
+}
+
+//  Takes a request off the queue by ID. Reports false if it is not there.
+func (q *fairQueue) remove(id string) bool {
+	for i, request := range q.retries {
+		if request.id == id {
+			q.retries = append(q.retries[:i], q.retries[i+1:]...)
+			return true
+		}
+	}
+	for _, c := range q.classes {
+		for client, queue := range c.queues {
+			for i, request := range queue {
+				if request.id != id {
+					continue
+				}
+				c.queues[client] = append(queue[:i], queue[i+1:]...)
+				c.length--
+				if len(c.queues[client]) == 0 {
+					delete(c.queues, client)
+					c.clients = removeString(c.clients, client)
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	for i, item := range list {
+		if item == s {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"fmt"
+	"rrbroker/rrapi"
+	"testing"
+)
+
+func queued(id, priority, client string) pending {
+	return pending{id: id, priority: priority, client: client}
+}
+
+//  Pops n requests, returning their IDs
+func popIDs(q *fairQueue, n int) (ids []string) {
+	for i := 0; i < n && q.len() > 0; i++ {
+		ids = append(ids, q.pop().id)
+	}
+	return
+}
+
+func TestFairQueueWeights(t *testing.T) {
+	q := newFairQueue(defaultPriorities())
+	for i := 0; i < 20; i++ {
+		q.push(queued(fmt.Sprint("b", i), rrapi.PRIORITY_BATCH, "batch"))
+		q.push(queued(fmt.Sprint("i", i), rrapi.PRIORITY_INTERACTIVE, "interactive"))
+	}
+	batch := 0
+	for _, id := range popIDs(q, 18) {
+		if id[0] == 'b' {
+			batch++
+		}
+	}
+	if batch != 2 {
+		t.Fatalf("served %d batch requests in 18", batch)
+	}
+	if q.len() != 22 || q.depth(rrapi.PRIORITY_BATCH) != 18 {
+		t.Fatalf("%d left, %d batch", q.len(), q.depth(rrapi.PRIORITY_BATCH))
+	}
+}
+
+func TestFairQueueClients(t *testing.T) {
+	q := newFairQueue(defaultPriorities())
+	for i := 0; i < 3; i++ {
+		q.push(queued(fmt.Sprint("chatty", i), rrapi.PRIORITY_INTERACTIVE, "chatty"))
+	}
+	q.push(queued("quiet", rrapi.PRIORITY_INTERACTIVE, "quiet"))
+	if ids := fmt.Sprint(popIDs(q, 4)); ids != "[chatty0 quiet chatty1 chatty2]" {
+		t.Fatalf("served %s", ids)
+	}
+}
+
+func TestFairQueueIdlePriority(t *testing.T) {
+	q := newFairQueue(defaultPriorities())
+	for i := 0; i < 40; i++ {
+		q.push(queued(fmt.Sprint("i", i), rrapi.PRIORITY_INTERACTIVE, "interactive"))
+	}
+	popIDs(q, 20)
+
+	//  Batch work arriving later has not saved up turns
+	for i := 0; i < 10; i++ {
+		q.push(queued(fmt.Sprint("b", i), rrapi.PRIORITY_BATCH, "batch"))
+	}
+	batch := 0
+	for _, id := range popIDs(q, 9) {
+		if id[0] == 'b' {
+			batch++
+		}
+	}
+	if batch > 2 {
+		t.Fatalf("served %d batch requests in 9", batch)
+	}
+}
+
+func TestFairQueueRemove(t *testing.T) {
+	q := newFairQueue(defaultPriorities())
+	q.push(queued("one", rrapi.PRIORITY_INTERACTIVE, "a"))
+	q.push(queued("two", rrapi.PRIORITY_INTERACTIVE, "b"))
+	q.pushFront(queued("retry", rrapi.PRIORITY_BATCH, "c"))
+	if !q.remove("one") || q.remove("one") {
+		t.Fatal("removed a request other than once")
+	}
+	if ids := fmt.Sprint(popIDs(q, 3)); ids != "[retry two]" {
+		t.Fatalf("served %s", ids)
+	}
+}
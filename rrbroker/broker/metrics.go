@@ -0,0 +1,65 @@
+package broker
+
+import (
+	llibrary "llibrary"
+)
+
+//  Broker metrics
+type metrics struct {
+	requests             *llibrary.Counter
+	replies              *llibrary.Counter
+	errors               *llibrary.Counter
+	late_replies         *llibrary.Counter
+	in_flight            *llibrary.Gauge
+	duration             *llibrary.Histogram
+	services             *llibrary.Gauge
+	queue_depth          *llibrary.Gauge
+	priority_queue_depth *llibrary.Gauge
+	queue_wait           *llibrary.Histogram
+	waiting_workers      *llibrary.Gauge
+	workers              *llibrary.Gauge
+	workers_expired      *llibrary.Counter
+	rate_limited         *llibrary.Counter
+	replayed             *llibrary.Counter
+	forwarded            *llibrary.Counter
+	peers                *llibrary.Gauge
+}
+
+func newMetrics(registry *llibrary.Registry) *metrics {
+	return &metrics{
+		requests: registry.NewCounter("rrbroker_requests_total",
+			"Requests forwarded per service", "service"),
+		replies: registry.NewCounter("rrbroker_replies_total",
+			"Replies returned to clients per service", "service"),
+		errors: registry.NewCounter("rrbroker_errors_total",
+			"Requests the broker could not forward, by reason", "reason"),
+		late_replies: registry.NewCounter("rrbroker_late_replies_total",
+			"Replies discarded because their request had timed out per service", "service"),
+		in_flight: registry.NewGauge("rrbroker_requests_in_flight",
+			"Requests forwarded and awaiting a reply per service", "service"),
+		duration: registry.NewHistogram("rrbroker_request_duration_seconds",
+			"Time from forwarding a request to returning its reply per service", llibrary.LATENCY_BUCKETS, "service"),
+		services: registry.NewGauge("rrbroker_services",
+			"Services registered with the broker"),
+		queue_depth: registry.NewGauge("rrbroker_queue_depth",
+			"Requests waiting for an idle worker per service", "service"),
+		priority_queue_depth: registry.NewGauge("rrbroker_priority_queue_depth",
+			"Requests waiting for an idle worker per service and priority", "service", "priority"),
+		queue_wait: registry.NewHistogram("rrbroker_queue_wait_seconds",
+			"Time requests wait for an idle worker per service and priority", llibrary.LATENCY_BUCKETS, "service", "priority"),
+		waiting_workers: registry.NewGauge("rrbroker_waiting_workers",
+			"Idle workers per service", "service"),
+		workers: registry.NewGauge("rrbroker_workers",
+			"Workers connected per service", "service"),
+		workers_expired: registry.NewCounter("rrbroker_workers_expired_total",
+			"Workers dropped for missing heartbeats per service", "service"),
+		rate_limited: registry.NewCounter("rrbroker_rate_limited_total",
+			"Requests refused for being over a rate limit per service", "service"),
+		replayed: registry.NewCounter("rrbroker_replayed_total",
+			"Unanswered requests from the request log sent again after a restart per service", "service"),
+		forwarded: registry.NewCounter("rrbroker_forwarded_total",
+			"Requests passed on to a peer broker per service and peer", "service", "peer"),
+		peers: registry.NewGauge("rrbroker_peers",
+			"Peer brokers heard from within their liveness"),
+	}
+}
@@ -0,0 +1,304 @@
+//
+//  Federation between brokers, after the Peering pattern.
+//  Each broker publishes its state at every heartbeat: where peers reach
+//  its frontend, and the services it has with how many more requests each
+//  could take now. It subscribes to the state of its peers. A request for
+//  a service the broker does not have goes to the live peer with the most
+//  capacity for it, over a DEALER connected to that peer's frontend, and
+//  the reply goes back to the client that sent it.
+//
+//  A request passed on carries the "via" property and is never passed on
+//  again, so requests cannot go round in circles. Only services a broker
+//  has itself are advertised.
+//
+
+package broker
+
+import (
+	zmq "github.com/pebbe/zmq4"
+
+	"encoding/json"
+	"errors"
+	"log"
+	"rrbroker/rrapi"
+	"sort"
+	"time"
+)
+
+//  How a broker takes part in federation
+type Peering struct {
+	Name     string   //  Unique among the peers
+	Frontend string   //  Where peers reach our frontend
+	State    string   //  Where we publish our state
+	Peers    []string //  Where peers publish theirs
+}
+
+//  What a broker publishes about itself, as JSON in the frame after its
+//  name
+type peerState struct {
+	Frontend string
+	Services map[string]int //  Requests each service could take now
+}
+
+//  A broker we have heard from
+type peer struct {
+	name     string
+	frontend string
+	socket   *zmq.Socket    //  DEALER connected to its frontend
+	services map[string]int //  As it last advertised, less what we sent since
+	expiry   time.Time      //  Expires at unless it publishes again
+}
+
+//  Joins the federation: binds the socket our state goes out on and
+//  subscribes to our peers'
+func (broker *Broker) startPeering() (err error) {
+	if broker.peering.Frontend == "" {
+		return errors.New("peering needs the address peers reach the frontend at")
+	}
+	if broker.state_pub, err = zmq.NewSocket(zmq.PUB); err != nil {
+		return
+	}
+	broker.state_pub.SetLinger(0)
+	if broker.peering.State != "" {
+		if err = broker.state_pub.Bind(broker.peering.State); err != nil {
+			return
+		}
+	}
+	if broker.state_sub, err = zmq.NewSocket(zmq.SUB); err != nil {
+		return
+	}
+	broker.state_sub.SetLinger(0)
+	broker.state_sub.SetSubscribe("")
+	for _, address := range broker.peering.Peers {
+		if err = broker.state_sub.Connect(address); err != nil {
+			return
+		}
+	}
+	broker.poller.Add(broker.state_sub, zmq.POLLIN)
+	return
+}
+
+//  Publishes our state to our peers
+func (broker *Broker) publishState() {
+	state, err := json.Marshal(peerState{Frontend: broker.peering.Frontend, Services: broker.capacity()})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	broker.state_pub.SendMessage(broker.peering.Name, state)
+}
+
+//  How many more requests each of our services could take now: for a
+//  pool, its idle workers less the requests queued for them, and for a
+//  service without one, 1 while it is there
+func (broker *Broker) capacity() map[string]int {
+	capacity := make(map[string]int)
+	for SID, service := range broker.services {
+		if service.Protocol != rrapi.RRPW_WORKER {
+			capacity[SID] = 1
+			continue
+		}
+		free := 0
+		if p, ok := broker.pools[SID]; ok {
+			free = len(p.idle) - p.queue.len()
+		}
+		if free < 0 {
+			free = 0
+		}
+		capacity[SID] = free
+	}
+	return capacity
+}
+
+//  Parses a peer's state
+func decodePeerState(frames []string) (name string, state peerState, err error) {
+	if len(frames) != 2 || frames[0] == "" {
+		err = errors.New("Error:BadPeerState")
+		return
+	}
+	name = frames[0]
+	if err = json.Unmarshal([]byte(frames[1]), &state); err != nil {
+		return
+	}
+	if state.Frontend == "" {
+		err = errors.New("Error:BadPeerState:Frontend")
+	}
+	return
+}
+
+//  Receives a peer's state, connecting to the peer if it is new or has
+//  moved
+func (broker *Broker) serveState() {
+	frames, err := broker.state_sub.RecvMessage(0)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	name, state, err := decodePeerState(frames)
+	if err != nil {
+		log.Println("Bad state from peer: ", err)
+		return
+	}
+	if name == broker.peering.Name {
+		return
+	}
+	p, ok := broker.peers[name]
+	if !ok {
+		p = &peer{name: name}
+		broker.peers[name] = p
+		broker.println("Peer ", name, " at ", state.Frontend)
+	}
+	if p.frontend != state.Frontend {
+		if err = broker.connectPeer(p, state.Frontend); err != nil {
+			log.Println("Error connecting to peer ", name, ": ", err)
+			broker.dropPeer(p)
+			return
+		}
+	}
+	p.services = state.Services
+	p.expiry = time.Now().Add(broker.heartbeat_interval * time.Duration(broker.heartbeat_liveness))
+}
+
+//  Connects to a peer's frontend, leaving where it was before
+func (broker *Broker) connectPeer(p *peer, frontend string) (err error) {
+	if p.socket == nil {
+		if p.socket, err = zmq.NewSocket(zmq.DEALER); err != nil {
+			return
+		}
+		p.socket.SetLinger(0)
+		broker.poller.Add(p.socket, zmq.POLLIN)
+	} else {
+		p.socket.Disconnect(p.frontend)
+	}
+	p.frontend = frontend
+	return p.socket.Connect(frontend)
+}
+
+//  Forgets a peer, failing the requests we sent it
+func (broker *Broker) dropPeer(p *peer) {
+	for _, request := range broker.requests {
+		if request.Peer != p.name {
+			continue
+		}
+		broker.metrics.errors.Inc("peer_lost")
+		request.Span.SetError(errors.New("Error:PeerLost"))
+		broker.finishRequest(request)
+		broker.complete(request, rrapi.NewError(request.SID, rrapi.STATUS_UNAVAILABLE, "PeerLost"))
+	}
+	if p.socket != nil {
+		broker.poller.RemoveBySocket(p.socket)
+		p.socket.Close()
+	}
+	delete(broker.peers, p.name)
+	broker.println("Peer ", p.name, " lost")
+}
+
+//  Drops peers that have stopped publishing their state
+func (broker *Broker) purgePeers() {
+	now := time.Now()
+	for _, p := range broker.peers {
+		if now.After(p.expiry) {
+			broker.dropPeer(p)
+		}
+	}
+	broker.metrics.peers.Set(float64(len(broker.peers)))
+}
+
+//  The live peer with the most capacity for a service, or nil if none
+//  has it. Ties go to the first by name.
+func (broker *Broker) choosePeer(SID string) (chosen *peer) {
+	names := make([]string, 0, len(broker.peers))
+	for name := range broker.peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, name := range names {
+		p := broker.peers[name]
+		capacity, ok := p.services[SID]
+		if !ok || now.After(p.expiry) {
+			continue
+		}
+		if chosen == nil || capacity > chosen.services[SID] {
+			chosen = p
+		}
+	}
+	return
+}
+
+//  The peer whose frontend a socket is connected to, if any
+func (broker *Broker) peerFor(socket *zmq.Socket) (*peer, bool) {
+	for _, p := range broker.peers {
+		if p.socket == socket {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+//  Sends a request on to a peer, as a client of its frontend. The client
+//  it came from is named in it, so the peer tells our clients apart.
+func (broker *Broker) forwardToPeer(p *peer, service Service, envelope []string, request rrapi.Request, timeout time.Duration, legacy bool) {
+	record := broker.startRequest(service, envelope, request.Trace(), timeout, legacy)
+	record.Peer = p.name
+	broker.requests[record.ID] = record
+
+	request.SetTrace(record.Span.Context)
+	request.Properties.Del(rrapi.TIMEOUT)
+	if timeout > 0 {
+		request.SetTimeout(timeout)
+	}
+	request.SetVia(broker.peering.Name)
+	if request.Client() == "" {
+		request.SetClient(broker.peering.Name + "/" + clientOf(request, envelope))
+	}
+	if p.services[service.SID] > 0 {
+		p.services[service.SID]--
+	}
+	broker.metrics.forwarded.Inc(service.SID, p.name)
+	p.socket.SendMessage(record.ID, "", request.ClientFrames())
+}
+
+//  Receives a reply from a peer and returns it to the client
+func (broker *Broker) servePeer(p *peer) {
+	frames, err := p.socket.RecvMessage(0)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(frames) < 2 {
+		return
+	}
+	id, frames := frames[0], frames[1:]
+	_, frames = unwrapEnvelope(frames)
+	reply, err := rrapi.ParseClientReply(frames)
+	if err != nil {
+		log.Println("Bad reply from peer ", p.name, ": ", err)
+		return
+	}
+	request, ok := broker.currentRequest(id)
+	if !ok || request.Peer != p.name {
+		broker.metrics.late_replies.Inc(reply.Service)
+		return
+	}
+	broker.finishRequest(request)
+	broker.complete(request, reply)
+}
+
+//  Closes the sockets to and from peers
+func (broker *Broker) closePeering() {
+	for _, p := range broker.peers {
+		if p.socket != nil {
+			p.socket.Close()
+		}
+		delete(broker.peers, p.name)
+	}
+	if broker.state_sub != nil {
+		broker.state_sub.Close()
+		broker.state_sub = nil
+	}
+	if broker.state_pub != nil {
+		broker.state_pub.Close()
+		broker.state_pub = nil
+	}
+}
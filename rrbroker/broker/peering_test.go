@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"rrbroker/rrapi"
+	"testing"
+	"time"
+)
+
+func TestDecodePeerState(t *testing.T) {
+	name, state, err := decodePeerState([]string{"east", `{"Frontend":"tcp://east:5559","Services":{"echo":2}}`})
+	if err != nil || name != "east" || state.Frontend != "tcp://east:5559" || state.Services["echo"] != 2 {
+		t.Fatalf("got %q %+v %v", name, state, err)
+	}
+	for _, frames := range [][]string{
+		{"east"},
+		{"", `{"Frontend":"tcp://east:5559"}`},
+		{"east", "{"},
+		{"east", `{"Services":{"echo":2}}`},
+	} {
+		if _, _, err := decodePeerState(frames); err == nil {
+			t.Errorf("%q accepted", frames)
+		}
+	}
+}
+
+func TestChoosePeer(t *testing.T) {
+	live := time.Now().Add(time.Minute)
+	broker := &Broker{peers: map[string]*peer{
+		"a":    {name: "a", services: map[string]int{"echo": 0, "time": 1}, expiry: live},
+		"b":    {name: "b", services: map[string]int{"echo": 3}, expiry: live},
+		"c":    {name: "c", services: map[string]int{"echo": 3}, expiry: live},
+		"dead": {name: "dead", services: map[string]int{"echo": 9, "gone": 1}, expiry: time.Now().Add(-time.Second)},
+	}}
+	if p := broker.choosePeer("echo"); p == nil || p.name != "b" {
+		t.Fatalf("chose %+v for echo", p)
+	}
+	if p := broker.choosePeer("time"); p == nil || p.name != "a" {
+		t.Fatalf("chose %+v for time", p)
+	}
+	if p := broker.choosePeer("gone"); p != nil {
+		t.Fatalf("chose %+v for a service only a dead peer has", p)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	broker := &Broker{
+		priorities: defaultPriorities(),
+		services: map[string]Service{
+			"legacy": {SID: "legacy"},
+			"idle":   {SID: "idle", Protocol: rrapi.RRPW_WORKER},
+			"busy":   {SID: "busy", Protocol: rrapi.RRPW_WORKER},
+			"none":   {SID: "none", Protocol: rrapi.RRPW_WORKER},
+		},
+		pools: make(map[string]*pool),
+	}
+	broker.getPool("idle").idle = []*worker{{}, {}}
+	busy := broker.getPool("busy")
+	busy.idle = []*worker{{}}
+	busy.queue.push(pending{id: "1", priority: rrapi.PRIORITY_INTERACTIVE})
+	busy.queue.push(pending{id: "2", priority: rrapi.PRIORITY_INTERACTIVE})
+
+	capacity := broker.capacity()
+	want := map[string]int{"legacy": 1, "idle": 2, "busy": 0, "none": 0}
+	for SID, n := range want {
+		if capacity[SID] != n {
+			t.Errorf("%s has capacity %d, want %d", SID, capacity[SID], n)
+		}
+	}
+}
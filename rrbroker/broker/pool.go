@@ -0,0 +1,230 @@
+//
+//  Least-recently-used worker pools for services speaking rrapi.
+//  The broker binds a ROUTER at the service's address and its workers
+//  connect with DEALER sockets and announce themselves with READY. Each
+//  request goes to the worker that has been idle longest, and a worker is
+//  idle again once it replies. While every worker is busy, requests wait
+//  in the service's queue, which shares workers out fairly between
+//  priorities and clients.
+//
+//  The broker and its workers heartbeat each other. A worker the broker
+//  has not heard from within its liveness is dropped, and the request it
+//  held is sent to another worker or failed back to the client.
+//
+
+package broker
+
+import (
+	"log"
+	"rrbroker/rrapi"
+	"time"
+)
+
+//  A worker connected to a service's backend
+type worker struct {
+	identity string    //  Routing identity on the backend socket
+	request  *pending  //  The request it is working on; nil if idle
+	expiry   time.Time //  Expires at unless heartbeat
+}
+
+//  A request waiting for a worker
+type pending struct {
+	id         string //  Keys the broker's in-flight record
+	request    rrapi.Request
+	priority   string
+	client     string    //  Who the request counts against for fairness
+	queued     time.Time //  When it first joined the queue
+	dispatches int       //  Times it has been sent to a worker
+}
+
+//  The workers and waiting requests of one service
+type pool struct {
+	workers map[string]*worker
+	idle    []*worker //  Idle workers, longest idle first
+	queue   *fairQueue
+}
+
+//  Lazy constructor that locates a service's pool, or creates an empty
+//  one if there is none yet
+func (broker *Broker) getPool(SID string) *pool {
+	p, ok := broker.pools[SID]
+	if !ok {
+		p = &pool{workers: make(map[string]*worker), queue: newFairQueue(broker.priorities)}
+		broker.pools[SID] = p
+	}
+	return p
+}
+
+//  Queues a request for a service and sends out whatever work can be.
+//  The request's priority must be one the broker knows.
+func (broker *Broker) enqueue(p *pool, service Service, record inflight, request rrapi.Request) {
+	p.queue.push(pending{
+		id:       record.ID,
+		request:  request,
+		priority: request.Priority(),
+		client:   clientOf(request, record.Envelope),
+		queued:   time.Now(),
+	})
+	broker.dispatch(p, service)
+}
+
+//  Takes a request that has timed out off the queue. If a worker already
+//  has it, the worker's reply will be discarded when it comes.
+func (broker *Broker) cancel(p *pool, service Service, id string) {
+	p.queue.remove(id)
+	broker.report(p, service.SID)
+}
+
+//  Sends queued requests to idle workers, longest idle first
+func (broker *Broker) dispatch(p *pool, service Service) {
+	for len(p.idle) > 0 && p.queue.len() > 0 {
+		w := p.idle[0]
+		p.idle = p.idle[1:]
+		next := p.queue.pop()
+
+		if next.dispatches == 0 {
+			broker.metrics.queue_wait.ObserveSince(next.queued, service.SID, next.priority)
+		}
+		next.dispatches++
+		w.request = &next
+		//  The worker gets what is left of the time, less any spent queueing
+		if record, ok := broker.currentRequest(next.id); ok && !record.Deadline.IsZero() {
+			next.request.SetTimeout(time.Until(record.Deadline))
+		}
+		service.Backend.SendMessage(w.identity, next.request.WorkerFrames())
+	}
+	broker.report(p, service.SID)
+}
+
+//  Updates the pool's metrics
+func (broker *Broker) report(p *pool, SID string) {
+	broker.metrics.queue_depth.Set(float64(p.queue.len()), SID)
+	for priority := range broker.priorities {
+		broker.metrics.priority_queue_depth.Set(float64(p.queue.depth(priority)), SID, priority)
+	}
+	broker.metrics.waiting_workers.Set(float64(len(p.idle)), SID)
+	broker.metrics.workers.Set(float64(len(p.workers)), SID)
+}
+
+//  Drops workers that have missed their heartbeats. A request a dropped
+//  worker held is sent again if it has been dispatched fewer than
+//  1+redispatch times, or else failed back to its client.
+func (broker *Broker) purge(p *pool, service Service) {
+	now := time.Now()
+	for identity, w := range p.workers {
+		if now.Before(w.expiry) {
+			continue
+		}
+		log.Printf("Worker %q for %s expired\n", identity, service.SID)
+		broker.metrics.workers_expired.Inc(service.SID)
+		p.remove(w)
+		if w.request != nil {
+			broker.lost(p, service, *w.request)
+		}
+	}
+	broker.dispatch(p, service)
+}
+
+//  Sends every worker a heartbeat
+func (broker *Broker) heartbeat(p *pool, service Service) {
+	for identity := range p.workers {
+		service.Backend.SendMessage(identity, rrapi.RRPW_WORKER, rrapi.HEARTBEAT)
+	}
+}
+
+func (p *pool) remove(w *worker) {
+	delete(p.workers, w.identity)
+	for i, idle := range p.idle {
+		if idle == w {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			break
+		}
+	}
+}
+
+//  Handles a request whose worker died before replying
+func (broker *Broker) lost(p *pool, service Service, held pending) {
+	request, ok := broker.currentRequest(held.id)
+	if !ok {
+		return //  Already timed out
+	}
+	if held.dispatches <= broker.redispatch {
+		//  Back to the head of the queue, ahead of newer requests
+		p.queue.pushFront(held)
+		return
+	}
+	broker.metrics.errors.Inc("worker_died")
+	broker.finishRequest(request)
+	broker.complete(request, rrapi.NewError(service.SID, rrapi.STATUS_UNAVAILABLE, "WorkerDied"))
+}
+
+//  Handles a message from one of a service's workers. READY adds the
+//  worker to the pool, and a reply goes back to the client the worker was
+//  serving; either way the worker is then idle. Anything from a worker
+//  refreshes its expiry. A worker the broker does not know, perhaps one
+//  it has already given up on, is told to reconnect.
+func (broker *Broker) serveWorker(service Service) {
+	frames, err := service.Backend.RecvMessage(0)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(frames) < 2 {
+		return
+	}
+	identity, frames := frames[0], frames[1:]
+	command := ""
+	if len(frames) == 2 && frames[0] == rrapi.RRPW_WORKER {
+		command = frames[1]
+	}
+	p := broker.getPool(service.SID)
+	w, known := p.workers[identity]
+	if !known {
+		if command != rrapi.READY {
+			service.Backend.SendMessage(identity, rrapi.RRPW_WORKER, rrapi.DISCONNECT)
+			return
+		}
+		w = &worker{identity: identity}
+		p.workers[identity] = w
+		if broker.verbose {
+			log.Printf("Worker %q ready for %s\n", identity, service.SID)
+		}
+	}
+	w.expiry = time.Now().Add(broker.heartbeat_interval * time.Duration(broker.heartbeat_liveness))
+
+	switch {
+	case command == rrapi.HEARTBEAT:
+		return
+	case command == rrapi.READY:
+		//  A worker that restarts with the same identity has lost its request
+		if w.request != nil {
+			log.Printf("Worker %q for %s sent READY while busy\n", identity, service.SID)
+			broker.lost(p, service, *w.request)
+		}
+	case w.request == nil:
+		broker.metrics.errors.Inc("unexpected_reply")
+		log.Printf("Worker %q for %s replied with no request\n", identity, service.SID)
+		return
+	default:
+		reply, err := rrapi.ParseWorkerReply(frames)
+		if err != nil {
+			broker.metrics.errors.Inc("bad_reply")
+			reply = rrapi.NewError(service.SID, rrapi.STATUS_INTERNAL, err.Error())
+		}
+		reply.Service = service.SID
+		request, ok := broker.currentRequest(w.request.id)
+		if ok {
+			broker.finishRequest(request)
+			broker.complete(request, reply)
+		} else {
+			broker.metrics.late_replies.Inc(service.SID)
+			broker.logLateReply(w.request.id, reply)
+		}
+	}
+
+	if w.request != nil || !known {
+		w.request = nil
+		p.idle = append(p.idle, w)
+	}
+	broker.dispatch(p, service)
+}
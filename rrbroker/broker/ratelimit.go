@@ -0,0 +1,50 @@
+//
+//  Rate limits on the broker's frontend.
+//  Every request for a service takes a token from each bucket it falls
+//  under, keyed by client, service or both as described in llibrary.Limit,
+//  and is answered with 429 if any is empty. The "ratelimit" service lists
+//  the limits and changes them while the broker runs.
+//
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	llibrary "llibrary"
+	"rrbroker/rrapi"
+	"strings"
+	"time"
+)
+
+//  The reply to a request over its limit
+func rateLimited(SID string, retry_after time.Duration) rrapi.Reply {
+	return rrapi.Reply{
+		Service: SID,
+		Status:  rrapi.STATUS_RATE_LIMITED,
+		Body:    []string{"RateLimited", llibrary.RetryAfterFrame(retry_after)},
+	}
+}
+
+//  Sets the limit sent as JSON, if any, and replies with the limits in
+//  force
+func (broker *Broker) rateLimitCommand(request rrapi.Request) rrapi.Reply {
+	message := "Limits"
+	if body := strings.Join(request.Body, ""); body != "" {
+		var limit llibrary.Limit
+		decoder := json.NewDecoder(strings.NewReader(body))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&limit)
+		if err == nil {
+			err = broker.limiter.SetLimit(limit)
+		}
+		if err != nil {
+			broker.metrics.errors.Inc("bad_request")
+			return rrapi.NewError(rrapi.RATELIMIT, rrapi.STATUS_BAD_REQUEST, fmt.Sprintf("Failed:%s", err))
+		}
+		broker.println("Rate limit for client ", limit.Client, " service ", limit.Service, " set to ", limit.Rate, "/s")
+		message = "Updated"
+	}
+	limits, _ := json.Marshal(broker.limiter.Limits())
+	return rrapi.Reply{Service: rrapi.RATELIMIT, Status: rrapi.STATUS_OK, Body: []string{message, string(limits)}}
+}
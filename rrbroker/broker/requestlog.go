@@ -0,0 +1,282 @@
+//
+//  Durable requests, in the spirit of the Titanic pattern.
+//  With a request log, a request that carries a request ID is written to
+//  disk before it is forwarded, and its reply is written before it goes
+//  back to the client, so both survive a restart. A restarted broker
+//  sends requests that have no reply yet to their services again, so
+//  delivery is at least once and workers should expect repeats. A client
+//  that lost its connection fetches the reply by ID from "fetch", and one
+//  that sends the same request again gets the logged reply. A request the
+//  broker times out stays pending in the log, and its reply is logged
+//  should it come late.
+//
+//  The log is a file of JSON lines, one per request or reply, synced as
+//  each is written. Replies older than REQUEST_LOG_RETENTION are dropped
+//  when the log is opened.
+//
+
+package broker
+
+import (
+	zmq "github.com/pebbe/zmq4"
+
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"rrbroker/rrapi"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	REQUEST_LOG_FILE      = "requests.log"
+	REQUEST_LOG_RETENTION = 24 * time.Hour
+
+	//  Replayed requests are kept under this prefix and the request ID in
+	//  place of a client identity
+	REPLAY_PREFIX = "replay:"
+)
+
+//  A line of the log: a request, or the reply to one
+type logEntry struct {
+	Time    time.Time
+	ID      string
+	Request *rrapi.Request `json:",omitempty"`
+	Reply   *rrapi.Reply   `json:",omitempty"`
+}
+
+//  What the log holds for one request ID
+type logged struct {
+	time    time.Time
+	request rrapi.Request
+	reply   *rrapi.Reply //  nil until it is answered
+}
+
+type requestLog struct {
+	path    string
+	file    *os.File
+	entries map[string]*logged
+}
+
+//  Opens the log in dir, creating it if need be. What survives the
+//  retention period is written back, and the log then appended to.
+func openRequestLog(dir string) (l *requestLog, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	l = &requestLog{path: filepath.Join(dir, REQUEST_LOG_FILE), entries: make(map[string]*logged)}
+	if err = l.read(); err != nil {
+		return
+	}
+	if err = l.compact(); err != nil {
+		return
+	}
+	l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	return
+}
+
+//  Reads the log. A line cut short by a crash ends it.
+func (l *requestLog) read() error {
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var entry logEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Println("Request log ends in a bad entry: ", err)
+			break
+		}
+		l.apply(entry)
+	}
+	return scanner.Err()
+}
+
+func (l *requestLog) apply(entry logEntry) {
+	switch {
+	case entry.Request != nil:
+		request := *entry.Request
+		if request.Properties == nil {
+			request.Properties = make(map[string][]string)
+		}
+		l.entries[entry.ID] = &logged{time: entry.Time, request: request}
+	case entry.Reply != nil:
+		if held, ok := l.entries[entry.ID]; ok {
+			held.reply = entry.Reply
+		}
+	}
+}
+
+//  Rewrites the log without replies past their retention
+func (l *requestLog) compact() error {
+	cutoff := time.Now().Add(-REQUEST_LOG_RETENTION)
+	temp := l.path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, id := range l.ids() {
+		held := l.entries[id]
+		if held.reply != nil && held.time.Before(cutoff) {
+			delete(l.entries, id)
+			continue
+		}
+		request := held.request
+		encoder.Encode(logEntry{Time: held.time, ID: id, Request: &request})
+		if held.reply != nil {
+			encoder.Encode(logEntry{Time: held.time, ID: id, Reply: held.reply})
+		}
+	}
+	if err = writer.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, l.path)
+}
+
+//  Request IDs, oldest request first
+func (l *requestLog) ids() (ids []string) {
+	for id := range l.entries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return l.entries[ids[i]].time.Before(l.entries[ids[j]].time)
+	})
+	return
+}
+
+//  Appends an entry and waits for it to reach the disk
+func (l *requestLog) write(entry logEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err = l.file.Sync(); err != nil {
+		return err
+	}
+	l.apply(entry)
+	return nil
+}
+
+func (l *requestLog) logRequest(id string, request rrapi.Request) error {
+	return l.write(logEntry{Time: time.Now(), ID: id, Request: &request})
+}
+
+func (l *requestLog) logReply(id string, reply rrapi.Reply) error {
+	return l.write(logEntry{Time: time.Now(), ID: id, Reply: &reply})
+}
+
+func (l *requestLog) lookup(id string) (held *logged, ok bool) {
+	held, ok = l.entries[id]
+	return
+}
+
+//  IDs of the requests with no reply, oldest first
+func (l *requestLog) unanswered() (ids []string) {
+	for _, id := range l.ids() {
+		if l.entries[id].reply == nil {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+func (l *requestLog) close() error {
+	return l.file.Close()
+}
+
+//  How a request the log already holds is answered: with its reply if it
+//  has one, or else 202 to say it is still being worked on
+func loggedReply(held *logged) rrapi.Reply {
+	if held.reply != nil {
+		return *held.reply
+	}
+	return rrapi.Reply{Service: held.request.Service, Status: rrapi.STATUS_ACCEPTED, Body: []string{"Pending"}}
+}
+
+//  Replies to "fetch" with the reply to the request whose ID it is sent
+func (broker *Broker) fetchReply(request rrapi.Request) rrapi.Reply {
+	if broker.request_log == nil {
+		return rrapi.NewError(rrapi.FETCH, rrapi.STATUS_UNAVAILABLE, "NoRequestLog")
+	}
+	held, ok := broker.request_log.lookup(strings.Join(request.Body, ""))
+	if !ok {
+		return rrapi.NewError(rrapi.FETCH, rrapi.STATUS_NOT_FOUND, "UnknownRequest")
+	}
+	return loggedReply(held)
+}
+
+//  Logs a reply that came after its request timed out, if the request
+//  was logged
+func (broker *Broker) logLateReply(id string, reply rrapi.Reply) {
+	request_id, ok := broker.expired[id]
+	if !ok {
+		return
+	}
+	delete(broker.expired, id)
+	if err := broker.request_log.logReply(request_id, reply); err != nil {
+		log.Println("Error logging reply: ", err)
+		broker.metrics.errors.Inc("request_log")
+	}
+}
+
+//  Sends the requests the log holds no reply for to their services again.
+//  There is no client waiting for them, so their replies are only logged.
+//  Run does this as it starts. A service that is not a pool takes a
+//  request only once a worker has connected, until then sending would
+//  block, so its requests are held back and tried again at each
+//  heartbeat.
+func (broker *Broker) replay() {
+	held_back := broker.replays[:0]
+	for _, id := range broker.replays {
+		held, _ := broker.request_log.lookup(id)
+		request := held.request
+		envelope := []string{REPLAY_PREFIX + id, ""}
+		service, ok := broker.services[request.Service]
+		if !ok {
+			broker.complete(inflight{Envelope: envelope, RequestID: id, Replayed: true},
+				rrapi.NewError(request.Service, rrapi.STATUS_NOT_FOUND, "InvalidService"))
+			continue
+		}
+		if service.Protocol != rrapi.RRPW_WORKER {
+			if events, err := service.Backend.GetEvents(); err != nil || events&zmq.POLLOUT == 0 {
+				held_back = append(held_back, id)
+				continue
+			}
+		}
+		broker.println("Replaying request ", id, " for ", request.Service)
+		broker.metrics.replayed.Inc(service.SID)
+		timeout := time.Duration(service.Timeout) * time.Millisecond
+		if timeout == 0 {
+			timeout = broker.default_timeout
+		}
+		request.Properties.Del(rrapi.TIMEOUT)
+		record := broker.startRequest(service, envelope, request.Trace(), timeout, false)
+		record.RequestID = id
+		record.Replayed = true
+		broker.requests[record.ID] = record
+		broker.forward(service, record, request)
+	}
+	broker.replays = held_back
+}
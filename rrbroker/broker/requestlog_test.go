@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"rrbroker/rrapi"
+	"testing"
+	"time"
+)
+
+func TestRequestLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openRequestLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.logRequest("one", rrapi.NewRequest("echo", "Hello"))
+	l.logRequest("two", rrapi.NewRequest("echo", "World"))
+	l.logReply("one", rrapi.Reply{Service: "echo", Status: rrapi.STATUS_OK, Body: []string{"Hello"}})
+	l.close()
+
+	//  A write cut short by a crash is dropped
+	file, _ := os.OpenFile(filepath.Join(dir, REQUEST_LOG_FILE), os.O_WRONLY|os.O_APPEND, 0)
+	file.WriteString(`{"ID":"three","Req`)
+	file.Close()
+
+	if l, err = openRequestLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	if ids := l.unanswered(); len(ids) != 1 || ids[0] != "two" {
+		t.Fatalf("unanswered %q", ids)
+	}
+	held, ok := l.lookup("one")
+	if !ok || held.reply == nil || held.reply.Body[0] != "Hello" {
+		t.Fatalf("got %+v", held)
+	}
+	if reply := loggedReply(held); reply.Status != rrapi.STATUS_OK {
+		t.Fatalf("got %+v", reply)
+	}
+	held, _ = l.lookup("two")
+	if held.request.Body[0] != "World" || loggedReply(held).Status != rrapi.STATUS_ACCEPTED {
+		t.Fatalf("got %+v", held)
+	}
+	if _, ok = l.lookup("three"); ok {
+		t.Fatal("read a partial entry")
+	}
+
+	//  Still appends after a bad entry was cut off
+	l.logReply("two", rrapi.Reply{Service: "echo", Status: rrapi.STATUS_OK})
+	if ids := l.unanswered(); len(ids) != 0 {
+		t.Fatalf("unanswered %q", ids)
+	}
+}
+
+func TestRequestLogRetention(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openRequestLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * REQUEST_LOG_RETENTION)
+	request := rrapi.NewRequest("echo")
+	reply := rrapi.Reply{Service: "echo", Status: rrapi.STATUS_OK}
+	l.write(logEntry{Time: old, ID: "answered", Request: &request})
+	l.write(logEntry{Time: old, ID: "answered", Reply: &reply})
+	l.write(logEntry{Time: old, ID: "unanswered", Request: &request})
+	l.close()
+
+	if l, err = openRequestLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	if _, ok := l.lookup("answered"); ok {
+		t.Fatal("kept a reply past its retention")
+	}
+	if _, ok := l.lookup("unanswered"); !ok {
+		t.Fatal("dropped an unanswered request")
+	}
+}
@@ -0,0 +1,416 @@
+package broker
+
+import (
+	zmq "github.com/pebbe/zmq4"
+
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"rrbroker/rrapi"
+	"strings"
+	"syscall"
+)
+
+//  Services speaking rrapi get a ROUTER to address their pool of workers;
+//  others get a DEALER, which shares requests round-robin
+func getSocket(protocol string) *zmq.Socket {
+	socket_type := zmq.DEALER
+	if protocol == rrapi.RRPW_WORKER {
+		socket_type = zmq.ROUTER
+	}
+	socket, err := zmq.NewSocket(socket_type)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return socket
+}
+
+//  Reads the service list file, one JSON service per line. The services
+//  have no sockets yet.
+func (broker *Broker) readServiceList() (list map[string]Service, err error) {
+	list = make(map[string]Service)
+
+	//read service list from file
+	filepointer, err := os.Open(broker.services_file)
+	if err != nil {
+		return
+	}
+	defer filepointer.Close()
+	if info, e := filepointer.Stat(); e == nil {
+		broker.services_modified = info.ModTime()
+	}
+
+	reader := bufio.NewReader(filepointer)
+	line, err := reader.ReadBytes('\n')
+	for err == nil {
+		///*Decode from JSON
+		var service Service
+		if e := json.Unmarshal(line, &service); e != nil {
+			log.Println("Error decoding from json ", e)
+		} else {
+			list[service.SID] = service
+		}
+		//read next line
+		line, err = reader.ReadBytes('\n')
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+//  Encodes the entire service list to JSON and saves it to file
+func (broker *Broker) saveServiceList() (err error) {
+	if broker.services_file == "" {
+		return
+	}
+	var datab, b []byte
+	for _, value := range broker.services {
+		b, err = json.Marshal(value)
+		if err != nil {
+			log.Println("Error encoding ", value.SID, " to JSON")
+			return
+		}
+		datab = append(datab, append(b, byte('\n'))...)
+	}
+
+	//write to file
+	err = ioutil.WriteFile(broker.services_file, datab, os.ModePerm)
+	if err != nil {
+		log.Println("Error writing service list to file: ", err)
+		return
+	}
+	//  Our own write is not a change to reload
+	if info, e := os.Stat(broker.services_file); e == nil {
+		broker.services_modified = info.ModTime()
+	}
+	return
+}
+
+//  Re-reads the service list file if it has changed since it was last
+//  read or written
+func (broker *Broker) checkServiceList() {
+	if broker.services_file == "" {
+		return
+	}
+	info, err := os.Stat(broker.services_file)
+	if err == nil && !info.ModTime().Equal(broker.services_modified) {
+		broker.reloadServices()
+	}
+}
+
+func (broker *Broker) reloadServices() {
+	if broker.services_file == "" {
+		return
+	}
+	broker.println("\nReloading", broker.services_file, "...")
+	list, err := broker.readServiceList()
+	if err != nil {
+		log.Println("Error reloading service list: ", err)
+		return
+	}
+	broker.applyServiceList(list)
+	broker.listServices()
+}
+
+//  Brings the running services in line with a new service list. Services
+//  no longer listed are removed and new ones added. Services whose
+//  protocol changed are replaced; those whose address changed are
+//  rebound, keeping their queued requests. Other changes apply in place.
+func (broker *Broker) applyServiceList(list map[string]Service) {
+	for SID := range broker.services {
+		if _, ok := list[SID]; !ok {
+			broker.removeService(SID)
+		}
+	}
+	for SID, service := range list {
+		existing, ok := broker.services[SID]
+		switch {
+		case !ok:
+		case existing.Protocol != service.Protocol:
+			broker.removeService(SID)
+		case existing.Address != service.Address:
+			if err := rebindService(&existing, service.Address); err != nil {
+				log.Printf("Whoops, problem rebinding %s: %s\n", SID, err)
+			}
+			fallthrough
+		default:
+			existing.Name = service.Name
+			existing.Timeout = service.Timeout
+			broker.services[SID] = existing
+			continue
+		}
+		if _, err := broker.addService(service); err != nil {
+			log.Printf("Whoops, problem creating binding for %s: %s\n", service.Name, err)
+		}
+	}
+}
+
+//  Creates a service's backend socket, binds it, adds it to the poller
+//  and adds the service to the service list
+func (broker *Broker) addService(service Service) (Service, error) {
+	service.Backend = getSocket(service.Protocol)
+	if service.Backend == nil {
+		return service, errors.New("Failed:Socket Creation")
+	}
+	service.Backend.SetLinger(0)
+	if err := service.Backend.Bind(service.Address); err != nil {
+		service.Backend.Close()
+		return service, err
+	}
+	//  A wildcard address can only be unbound by the endpoint it became
+	service.endpoint, _ = service.Backend.GetLastEndpoint()
+	broker.poller.Add(service.Backend, zmq.POLLIN)
+	broker.services[service.SID] = service
+	return service, nil
+}
+
+//  Moves a service's backend to a new address. Workers must connect to
+//  the new address.
+func rebindService(service *Service, address string) error {
+	service.Backend.Unbind(service.endpoint)
+	if err := service.Backend.Bind(address); err != nil {
+		//  Stay where we were
+		service.Backend.Bind(service.Address)
+		service.endpoint, _ = service.Backend.GetLastEndpoint()
+		return err
+	}
+	service.Address = address
+	service.endpoint, _ = service.Backend.GetLastEndpoint()
+	return nil
+}
+
+//  Unbinds and closes a service's backend and takes the service off the
+//  service list. Requests waiting on it are failed back to their clients,
+//  and in the log if they are logged.
+func (broker *Broker) removeService(SID string) {
+	service, ok := broker.services[SID]
+	if !ok {
+		return
+	}
+	broker.println("\tRemoving", SID, "...")
+	broker.poller.RemoveBySocket(service.Backend)
+	service.Backend.Unbind(service.endpoint)
+	service.Backend.Close()
+	delete(broker.services, SID)
+	delete(broker.pools, SID)
+	broker.metrics.queue_depth.Delete(SID)
+	broker.metrics.waiting_workers.Delete(SID)
+	broker.metrics.workers.Delete(SID)
+
+	for _, request := range broker.requests {
+		if request.SID == SID {
+			broker.metrics.errors.Inc("service_removed")
+			request.Span.SetError(errors.New("Error:ServiceRemoved"))
+			broker.finishRequest(request)
+			broker.complete(request, rrapi.NewError(SID, rrapi.STATUS_UNAVAILABLE, "ServiceRemoved"))
+		}
+	}
+}
+
+//  Registers a new service by:
+//  1. Decoding the JSON "register" message and checking it is complete
+//  2. Checking no other service holds its SID or address
+//  3. Binding its socket, where it asked or wherever the broker chooses,
+//     and adding it to the service list and poller; if the bind fails,
+//     nothing is added
+//  4. Encoding Entire service list to JSON and saving to file
+//  Services registered in the new format get requests in that format too,
+//  unless they name a protocol themselves, and the Registration in the
+//  reply. Old clients get only the message.
+func (broker *Broker) registerService(request rrapi.Request, legacy bool) rrapi.Reply {
+	message := strings.Join(request.Body, "")
+	broker.println("\nProcessing Service Registration Request for ", message, " ...")
+	//Decode Message
+	broker.println("\tDecoding...")
+	newservice, err := decodeService(message)
+	if err != nil {
+		log.Println("Error decoding from JSON ", err)
+		return broker.registrationFailed(rrapi.STATUS_BAD_REQUEST, "Failed:"+err.Error(),
+			rrapi.Registration{SID: newservice.SID}, legacy)
+	}
+	if newservice.Protocol == "" && !legacy {
+		newservice.Protocol = rrapi.RRPW_WORKER
+	}
+
+	//  An old worker cannot be told where the broker bound its service, and
+	//  would connect where it asked
+	allocating := broker.endpoints.allocating()
+	if legacy && allocating {
+		return broker.registrationFailed(rrapi.STATUS_BAD_REQUEST, "Failed:EndpointChosenByBroker",
+			rrapi.Registration{SID: newservice.SID}, legacy)
+	}
+	if newservice.Address == "" && !allocating {
+		return broker.registrationFailed(rrapi.STATUS_BAD_REQUEST, "Failed:Missing Address",
+			rrapi.Registration{SID: newservice.SID}, legacy)
+	}
+
+	//  Every worker registers its service when it starts. If nothing has
+	//  changed, keep the socket and the workers already connected to it.
+	//  Where the broker chooses addresses, the one asked for is ignored.
+	if existing, ok := broker.services[newservice.SID]; ok {
+		moved := existing.Address != newservice.Address && !allocating
+		if moved || existing.Protocol != newservice.Protocol {
+			return broker.registrationFailed(rrapi.STATUS_CONFLICT, "Conflict:SID",
+				rrapi.Registration{SID: newservice.SID, ConflictsWith: existing.SID}, legacy)
+		}
+		broker.println("\tAlready registered")
+		existing.Name = newservice.Name
+		existing.Timeout = newservice.Timeout
+		broker.services[existing.SID] = existing
+		return broker.registered(existing, legacy)
+	}
+	if holder, ok := broker.addressHolder(newservice.Address); ok && !allocating {
+		return broker.registrationFailed(rrapi.STATUS_CONFLICT, "Conflict:Address",
+			rrapi.Registration{SID: newservice.SID, ConflictsWith: holder}, legacy)
+	}
+
+	broker.println("\tRegistering...")
+	//  Add to the active service list, with its socket bound and polled
+	if allocating {
+		newservice, err = broker.allocateService(newservice)
+	} else {
+		newservice, err = broker.addService(newservice)
+	}
+	if err != nil {
+		log.Printf("Whoops, problem creating binding for %s: %s\n", newservice.Name, err)
+		status := rrapi.STATUS_BAD_REQUEST
+		switch {
+		case err == errNoFreeEndpoint:
+			status = rrapi.STATUS_UNAVAILABLE
+		case zmq.AsErrno(err) == zmq.Errno(syscall.EADDRINUSE):
+			status = rrapi.STATUS_CONFLICT
+		}
+		return broker.registrationFailed(status, "Failed:Bind:"+err.Error(),
+			rrapi.Registration{SID: newservice.SID}, legacy)
+	}
+
+	//  Updated service list
+	broker.listServices()
+	return broker.registered(newservice, legacy)
+}
+
+//  Decodes a service description, which must have exactly the fields a
+//  registration may set, and checks it
+func decodeService(message string) (service Service, err error) {
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&service); err != nil {
+		err = errors.New(fmt.Sprintf("Decoding Message:%s", err))
+		return
+	}
+	if decoder.More() {
+		err = errors.New("Decoding Message:trailing data")
+		return
+	}
+	switch {
+	case service.SID == "":
+		err = errors.New("Missing SID")
+	case service.SID == rrapi.REGISTER || service.SID == rrapi.DEREGISTER || service.SID == rrapi.RATELIMIT || service.SID == rrapi.FETCH:
+		err = errors.New("Reserved SID")
+	case strings.Contains(service.SID, ":"):
+		//  Old clients could not name it
+		err = errors.New("SID contains ':'")
+	case service.Protocol != "" && service.Protocol != rrapi.RRPW_WORKER:
+		err = errors.New("Unknown Protocol " + service.Protocol)
+	case service.Timeout < 0:
+		err = errors.New("Negative Timeout")
+	}
+	return
+}
+
+//  Finds the service, if any, registered at an address, or at the
+//  endpoint it bound to. Wildcard ports cannot clash.
+func (broker *Broker) addressHolder(address string) (SID string, ok bool) {
+	if strings.HasSuffix(address, ":*") || strings.HasSuffix(address, "://*") {
+		return
+	}
+	for _, service := range broker.services {
+		if service.Address == address || service.endpoint == address {
+			return service.SID, true
+		}
+	}
+	if address == broker.address {
+		return rrapi.REGISTER, true
+	}
+	return
+}
+
+//  Saves the service list and reports the service as registered
+func (broker *Broker) registered(service Service, legacy bool) rrapi.Reply {
+	broker.println("\tUpdating file...")
+	err := broker.saveServiceList()
+	message := "Registered"
+	if err != nil {
+		message += ":FileWriteFail"
+	}
+	//  Inform service
+	broker.println("\tSuccess! Informing service...")
+	return registrationReply(rrapi.STATUS_OK, message, rrapi.Registration{
+		SID:      service.SID,
+		Endpoint: broker.serviceEndpoint(service),
+		Saved:    err == nil && broker.services_file != "",
+	}, legacy)
+}
+
+func (broker *Broker) registrationFailed(status, message string, registration rrapi.Registration, legacy bool) rrapi.Reply {
+	broker.println("\t" + message)
+	broker.metrics.errors.Inc("registration_failed")
+	return registrationReply(status, message, registration, legacy)
+}
+
+func registrationReply(status, message string, registration rrapi.Registration, legacy bool) rrapi.Reply {
+	reply := rrapi.Reply{Service: rrapi.REGISTER, Status: status, Body: []string{message}}
+	if !legacy {
+		b, _ := json.Marshal(registration)
+		reply.Body = append(reply.Body, string(b))
+	}
+	return reply
+}
+
+//  Deregisters the service named in the request, removing it from the
+//  service list and the file
+func (broker *Broker) deregisterService(request rrapi.Request) rrapi.Reply {
+	SID := strings.Join(request.Body, "")
+	broker.println("\nProcessing Service Deregistration Request for ", SID, " ...")
+	if _, ok := broker.services[SID]; !ok {
+		broker.metrics.errors.Inc("deregistration_failed")
+		return rrapi.NewError(rrapi.DEREGISTER, rrapi.STATUS_NOT_FOUND, "Failed:UnknownService")
+	}
+	broker.removeService(SID)
+	message := "Deregistered"
+	if broker.saveServiceList() != nil {
+		message += ":FileWriteFail"
+	}
+	broker.listServices()
+	return rrapi.Reply{Service: rrapi.DEREGISTER, Status: rrapi.STATUS_OK, Body: []string{message}}
+}
+
+// Lists all available services in the service list including the
+// "register", "deregister", "ratelimit" and "fetch" services that are not
+// in the service list
+func (broker *Broker) listServices() {
+	broker.metrics.services.Set(float64(len(broker.services)))
+	broker.println("\n\n=====================\nAvailable services:\nSID\t\tName\t\t\tAddress")
+	for _, service := range broker.services {
+		broker.println(service.SID, "\t\t", service.Name, "\t\t\t", service.Address)
+	}
+	broker.println("register\tService Registration\t", broker.address)
+	broker.println("deregister\tService Deregistration\t", broker.address)
+	broker.println("ratelimit\tRate Limits\t\t", broker.address)
+	broker.println("fetch\t\tLogged Replies\t\t", broker.address)
+	broker.println("=====================")
+	broker.println()
+}
+
+func (broker *Broker) println(a ...interface{}) {
+	if broker.verbose {
+		fmt.Println(a...)
+	}
+}
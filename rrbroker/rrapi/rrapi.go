@@ -0,0 +1,424 @@
+//
+//  Request-reply protocol spoken through rrbroker.
+//
+//  Every message has a fixed layout, so bodies may hold any bytes:
+//
+//    client to broker:  RRPC01, service, properties, body...
+//    broker to client:  RRPC01, service, status, body...
+//    broker to worker:  RRPW01, service, properties, body...
+//    worker to broker:  RRPW01, status, body...
+//
+//  Workers connect DEALER sockets to their service's address and send
+//  READY once; after that the broker sends each worker one request at a
+//  time and waits for its reply. Broker and worker also send each other
+//  commands, which are always exactly two frames:
+//
+//    worker to broker:  RRPW01, READY | HEARTBEAT
+//    broker to worker:  RRPW01, HEARTBEAT | DISCONNECT
+//
+//  Each side treats the other as dead once it has heard nothing for
+//  HEARTBEAT_LIVENESS heartbeats. A worker told to DISCONNECT, or that
+//  loses the broker, reconnects and sends READY again.
+//
+//  Properties are a single frame in URL query encoding, such as
+//  "traceparent=00-...-...-01", and may be empty. Status is an HTTP-like
+//  code; on any status but 200 the first body frame says what went wrong.
+//  A request with a "timeout" property, in milliseconds, is answered with
+//  504 if no reply comes in that time; otherwise the service's default
+//  timeout applies, if it has one. The broker sets "timeout" on each
+//  request it sends a worker to what is left of that time, so a worker
+//  knows its budget and can pass on what remains to calls of its own.
+//
+//  A request's "priority" property says what kind of work it is, such as
+//  interactive calls a person is waiting on or batch jobs, and defaults
+//  to interactive. While a service's workers are all busy the broker
+//  shares them out between priorities by weight, and between the clients
+//  within each priority in turn, so no one client can starve the rest.
+//  Clients are told apart by their socket, unless they name themselves
+//  with the "client" property; a program that opens many sockets should.
+//
+//  The broker may limit how fast clients send. A request over a limit is
+//  answered with 429, whose body is "RateLimited" and a frame saying how
+//  long to wait before trying again. Limits are listed by sending an empty
+//  request to "ratelimit", and set by sending it a llibrary.Limit as JSON.
+//
+//  A broker with a request log writes each request with a "request-id"
+//  property to disk before forwarding it, and its reply before returning
+//  it, and after a restart sends unanswered requests to their services
+//  again. Sending "fetch" a request ID gets the reply to that request, or
+//  202 if it has none yet, so a client that loses its connection can pick
+//  up where it left off. Resending a request with the same ID does the
+//  same. Without a request log the property is ignored.
+//
+//  Brokers may peer with one another. A request for a service a broker
+//  does not have goes on to a peer that has it, and its reply comes back
+//  the same way. The broker marks a request it passes on with a "via"
+//  property naming itself, and never passes on a request that has one.
+//
+//  A service registers by sending its description as JSON to "register".
+//  The reply's body is a message, such as "Registered", followed by the
+//  Registration as JSON, which says where workers should connect; the
+//  broker may have chosen a different address from the one asked for.
+//
+
+package rrapi
+
+import (
+	zmq "github.com/pebbe/zmq4"
+
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	llibrary "llibrary"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+//  Longest CallContext waits before checking whether ctx is done
+const CALL_POLL_INTERVAL = 50 * time.Millisecond
+
+const (
+	//  Protocol headers
+	RRPC_CLIENT = "RRPC01"
+	RRPW_WORKER = "RRPW01"
+
+	//  Reserved service names
+	REGISTER   = "register"
+	DEREGISTER = "deregister" //  Body is the SID to remove
+	RATELIMIT  = "ratelimit"  //  Body is a limit to set, or empty to list them
+	FETCH      = "fetch"      //  Body is the ID of a logged request
+
+	//  Worker commands
+	READY      = "READY"
+	HEARTBEAT  = "HEARTBEAT"
+	DISCONNECT = "DISCONNECT"
+
+	//  Properties
+	TRACE      = "traceparent"
+	TIMEOUT    = "timeout"    //  Milliseconds the broker waits for a reply
+	PRIORITY   = "priority"   //  Which of the broker's queues the request joins
+	CLIENT     = "client"     //  Who the request counts against for fairness
+	REQUEST_ID = "request-id" //  Logs the request, under this ID
+	VIA        = "via"        //  The broker that passed the request on
+
+	//  Priorities every broker knows
+	PRIORITY_INTERACTIVE = "interactive"
+	PRIORITY_BATCH       = "batch"
+
+	//  Status codes
+	STATUS_OK           = "200"
+	STATUS_ACCEPTED     = "202"
+	STATUS_BAD_REQUEST  = "400"
+	STATUS_NOT_FOUND    = "404"
+	STATUS_CONFLICT     = "409"
+	STATUS_RATE_LIMITED = "429"
+	STATUS_INTERNAL     = "500"
+	STATUS_UNAVAILABLE  = "503"
+	STATUS_TIMEOUT      = "504"
+)
+
+type Request struct {
+	Service    string
+	Properties url.Values
+	Body       []string
+
+	ctx context.Context
+}
+
+type Reply struct {
+	Service string
+	Status  string
+	Body    []string
+}
+
+//  The outcome of a registration
+type Registration struct {
+	SID      string
+	Endpoint string //  Where the service's workers connect
+	Saved    bool   //  Whether the service list was written to disk
+	//  The service already holding the SID or address, on a conflict
+	ConflictsWith string `json:",omitempty"`
+}
+
+func NewRequest(service string, body ...string) Request {
+	return Request{Service: service, Properties: url.Values{}, Body: body}
+}
+
+//  A reply whose status is not 200, explaining why
+func NewError(service, status, message string) Reply {
+	return Reply{service, status, []string{message}}
+}
+
+//  The trace context of the request, if it carries one
+func (request Request) Trace() (sc llibrary.SpanContext) {
+	sc, _ = llibrary.ParseTraceParent(request.Properties.Get(TRACE))
+	return
+}
+
+func (request Request) SetTrace(sc llibrary.SpanContext) {
+	request.Properties.Set(TRACE, sc.String())
+}
+
+//  How long the broker should wait for a reply, or 0 for the service's
+//  default
+func (request Request) Timeout() (timeout time.Duration, err error) {
+	ms := request.Properties.Get(TIMEOUT)
+	if ms == "" {
+		return
+	}
+	n, err := strconv.Atoi(ms)
+	if err != nil || n <= 0 {
+		err = errors.New("Error:BadRequest:timeout:" + ms)
+		return
+	}
+	timeout = time.Duration(n) * time.Millisecond
+	return
+}
+
+//  Sets the timeout, rounded up to whole milliseconds. A timeout that has
+//  already run out is sent as one millisecond, the least there is.
+func (request Request) SetTimeout(timeout time.Duration) {
+	ms := int64((timeout + time.Millisecond - 1) / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	request.Properties.Set(TIMEOUT, strconv.FormatInt(ms, 10))
+}
+
+//  The request's priority, interactive unless it says otherwise
+func (request Request) Priority() string {
+	if priority := request.Properties.Get(PRIORITY); priority != "" {
+		return priority
+	}
+	return PRIORITY_INTERACTIVE
+}
+
+func (request Request) SetPriority(priority string) {
+	request.Properties.Set(PRIORITY, priority)
+}
+
+//  The name the client gave itself, if any
+func (request Request) Client() string {
+	return request.Properties.Get(CLIENT)
+}
+
+func (request Request) SetClient(client string) {
+	request.Properties.Set(CLIENT, client)
+}
+
+//  The ID the request is logged under, if it asks to be
+func (request Request) RequestID() string {
+	return request.Properties.Get(REQUEST_ID)
+}
+
+func (request Request) SetRequestID(id string) {
+	request.Properties.Set(REQUEST_ID, id)
+}
+
+//  The broker that passed the request on from another, if any
+func (request Request) Via() string {
+	return request.Properties.Get(VIA)
+}
+
+func (request Request) SetVia(broker string) {
+	request.Properties.Set(VIA, broker)
+}
+
+//  A random request ID, unique for all practical purposes
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+//  The request's context. A worker hands its handler requests whose
+//  context ends when the request's timeout runs out, or when the worker
+//  stops. Otherwise it is the background context.
+func (request Request) Context() context.Context {
+	if request.ctx == nil {
+		return context.Background()
+	}
+	return request.ctx
+}
+
+//  A copy of the request with its context replaced
+func (request Request) WithContext(ctx context.Context) Request {
+	request.ctx = ctx
+	return request
+}
+
+func (request Request) ClientFrames() []string {
+	return append([]string{RRPC_CLIENT, request.Service, request.Properties.Encode()}, request.Body...)
+}
+
+func (request Request) WorkerFrames() []string {
+	return append([]string{RRPW_WORKER, request.Service, request.Properties.Encode()}, request.Body...)
+}
+
+func (reply Reply) ClientFrames() []string {
+	return append([]string{RRPC_CLIENT, reply.Service, reply.Status}, reply.Body...)
+}
+
+func (reply Reply) WorkerFrames() []string {
+	return append([]string{RRPW_WORKER, reply.Status}, reply.Body...)
+}
+
+func (reply Reply) Err() error {
+	if reply.Status == STATUS_OK {
+		return nil
+	}
+	if len(reply.Body) > 0 {
+		return errors.New(fmt.Sprintf("%s:%s", reply.Status, reply.Body[0]))
+	}
+	return errors.New(reply.Status)
+}
+
+//  How long a client that was rate limited should wait before trying
+//  again. Reports false for any other reply.
+func (reply Reply) RetryAfter() (retry_after time.Duration, ok bool) {
+	if reply.Status != STATUS_RATE_LIMITED || len(reply.Body) < 2 {
+		return
+	}
+	return llibrary.ParseRetryAfterFrame(reply.Body[1])
+}
+
+func ParseClientRequest(frames []string) (Request, error) {
+	return parseRequest(RRPC_CLIENT, frames)
+}
+
+func ParseWorkerRequest(frames []string) (Request, error) {
+	return parseRequest(RRPW_WORKER, frames)
+}
+
+func parseRequest(header string, frames []string) (request Request, err error) {
+	if len(frames) < 3 || frames[0] != header {
+		err = errors.New("Error:BadRequest:expected " + header + ", service, properties, body")
+		return
+	}
+	request.Service = frames[1]
+	request.Properties, err = url.ParseQuery(frames[2])
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Error:BadRequest:properties:%s", err))
+		return
+	}
+	request.Body = frames[3:]
+	return
+}
+
+func ParseClientReply(frames []string) (reply Reply, err error) {
+	if len(frames) < 3 || frames[0] != RRPC_CLIENT {
+		err = errors.New("Error:UnexpectedReply")
+		return
+	}
+	reply = Reply{frames[1], frames[2], frames[3:]}
+	return
+}
+
+func ParseWorkerReply(frames []string) (reply Reply, err error) {
+	if len(frames) < 2 || frames[0] != RRPW_WORKER {
+		err = errors.New("Error:UnexpectedReply")
+		return
+	}
+	reply = Reply{Status: frames[1], Body: frames[2:]}
+	return
+}
+
+//  Sends a request on a REQ socket connected to the broker and waits
+//  for the reply. See CallContext for requests made while handling one.
+func Call(requester *zmq.Socket, request Request) (reply Reply, err error) {
+	_, err = requester.SendMessage(request.ClientFrames())
+	if err != nil {
+		return
+	}
+	var frames []string
+	frames, err = requester.RecvMessage(0)
+	if err != nil {
+		return
+	}
+	return ParseClientReply(frames)
+}
+
+//  Reads the Registration from the reply to a registration. A failed
+//  registration returns the reply's error along with whatever the broker
+//  reported.
+func ParseRegistration(reply Reply) (registration Registration, err error) {
+	if len(reply.Body) > 1 {
+		err = json.Unmarshal([]byte(reply.Body[1]), &registration)
+	} else if reply.Err() == nil {
+		err = errors.New("Error:UnexpectedReply")
+	}
+	if reply.Err() != nil {
+		err = reply.Err()
+	}
+	return
+}
+
+//  Registers a service, described by anything that encodes to the JSON a
+//  registration takes, through a REQ socket connected to the broker
+func Register(requester *zmq.Socket, service interface{}) (registration Registration, err error) {
+	message, err := json.Marshal(service)
+	if err != nil {
+		return
+	}
+	reply, err := Call(requester, NewRequest(REGISTER, string(message)))
+	if err != nil {
+		return
+	}
+	return ParseRegistration(reply)
+}
+
+//  Fetches the reply to a request sent with a request ID. The reply has
+//  status 202 if the request has not been answered yet.
+func Fetch(requester *zmq.Socket, id string) (Reply, error) {
+	return Call(requester, NewRequest(FETCH, id))
+}
+
+//  Like Call, but if ctx has a deadline the request's timeout is cut to
+//  what is left of it, and if ctx holds a span an untraced request joins
+//  its trace. Gives up waiting once ctx is done, after which requester
+//  cannot be used again, like any REQ socket that has missed its reply.
+func CallContext(ctx context.Context, requester *zmq.Socket, request Request) (reply Reply, err error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return reply, context.DeadlineExceeded
+		}
+		if timeout, e := request.Timeout(); e != nil || timeout == 0 || timeout > remaining {
+			request.SetTimeout(remaining)
+		}
+	}
+	if span := llibrary.SpanFromContext(ctx); span != nil && !request.Trace().IsValid() {
+		request.SetTrace(span.Context)
+	}
+	if _, err = requester.SendMessage(request.ClientFrames()); err != nil {
+		return
+	}
+
+	poller := zmq.NewPoller()
+	poller.Add(requester, zmq.POLLIN)
+	for {
+		var polled []zmq.Polled
+		polled, err = poller.Poll(CALL_POLL_INTERVAL)
+		if err != nil {
+			return
+		}
+		if len(polled) > 0 {
+			break
+		}
+		if ctx.Err() != nil {
+			return reply, ctx.Err()
+		}
+	}
+	var frames []string
+	frames, err = requester.RecvMessage(0)
+	if err != nil {
+		return
+	}
+	return ParseClientReply(frames)
+}
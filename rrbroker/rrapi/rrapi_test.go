@@ -0,0 +1,161 @@
+package rrapi
+
+import (
+	"context"
+	llibrary "llibrary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	request := NewRequest("echo", "Hello", "")
+	request.SetTimeout(1500 * time.Millisecond)
+	frames := request.ClientFrames()
+	if frames[0] != RRPC_CLIENT || frames[1] != "echo" {
+		t.Fatalf("got frames %q", frames)
+	}
+
+	parsed, err := ParseClientRequest(frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Service != "echo" || !reflect.DeepEqual(parsed.Body, []string{"Hello", ""}) {
+		t.Fatalf("got %+v", parsed)
+	}
+	timeout, err := parsed.Timeout()
+	if err != nil || timeout != 1500*time.Millisecond {
+		t.Fatalf("got timeout %v, %v", timeout, err)
+	}
+
+	if _, err = ParseWorkerRequest(frames); err == nil {
+		t.Fatal("client frames parsed as a worker request")
+	}
+	if _, err = ParseWorkerRequest(parsed.WorkerFrames()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseRequestErrors(t *testing.T) {
+	for _, frames := range [][]string{
+		nil,
+		{RRPC_CLIENT, "echo"},
+		{"RRPC02", "echo", ""},
+		{RRPC_CLIENT, "echo", "%zz"},
+	} {
+		if _, err := ParseClientRequest(frames); err == nil {
+			t.Errorf("%q parsed without error", frames)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	request := NewRequest("echo")
+	if timeout, err := request.Timeout(); timeout != 0 || err != nil {
+		t.Fatalf("got %v, %v with no timeout", timeout, err)
+	}
+	for _, bad := range []string{"0", "-5", "soon"} {
+		request.Properties.Set(TIMEOUT, bad)
+		if _, err := request.Timeout(); err == nil {
+			t.Errorf("timeout %q accepted", bad)
+		}
+	}
+}
+
+func TestSetTimeoutRounds(t *testing.T) {
+	request := NewRequest("echo")
+	for timeout, want := range map[time.Duration]string{
+		1500 * time.Microsecond: "2",
+		-time.Second:            "1",
+	} {
+		request.SetTimeout(timeout)
+		if got := request.Properties.Get(TIMEOUT); got != want {
+			t.Errorf("got %q for %v", got, timeout)
+		}
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	request := NewRequest("echo")
+	if request.Context() != context.Background() {
+		t.Fatal("request without a context")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if request.WithContext(ctx).Context() != ctx || request.Context() == ctx {
+		t.Fatal("WithContext changed the original")
+	}
+
+	//  A caller that is out of time does not send
+	expired, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	if _, err := CallContext(expired, nil, request); err != context.DeadlineExceeded {
+		t.Fatalf("got %v past the deadline", err)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	request := NewRequest("echo")
+	if request.Trace().IsValid() {
+		t.Fatal("untraced request has a trace")
+	}
+	span := llibrary.StartSpan("test", llibrary.SPAN_KIND_CLIENT, llibrary.SpanContext{})
+	request.SetTrace(span.Context)
+	if request.Trace() != span.Context {
+		t.Fatalf("got %v, want %v", request.Trace(), span.Context)
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	reply := Reply{"echo", STATUS_OK, []string{"World"}}
+	parsed, err := ParseClientReply(reply.ClientFrames())
+	if err != nil || !reflect.DeepEqual(parsed, reply) {
+		t.Fatalf("got %+v, %v", parsed, err)
+	}
+	if parsed.Err() != nil {
+		t.Fatal(parsed.Err())
+	}
+
+	parsed, err = ParseWorkerReply(NewError("echo", STATUS_NOT_FOUND, "Missing").WorkerFrames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Err() == nil || parsed.Err().Error() != "404:Missing" {
+		t.Fatalf("got %v", parsed.Err())
+	}
+	if _, err = ParseWorkerReply([]string{RRPC_CLIENT, STATUS_OK}); err == nil {
+		t.Fatal("client header accepted from a worker")
+	}
+}
+
+func TestParseRegistration(t *testing.T) {
+	reply := Reply{REGISTER, STATUS_OK, []string{"Registered", `{"SID":"echo","Endpoint":"tcp://0.0.0.0:5560","Saved":true}`}}
+	registration, err := ParseRegistration(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registration != (Registration{SID: "echo", Endpoint: "tcp://0.0.0.0:5560", Saved: true}) {
+		t.Fatalf("got %+v", registration)
+	}
+
+	reply = Reply{REGISTER, STATUS_CONFLICT, []string{"Conflict:SID", `{"SID":"echo","ConflictsWith":"echo"}`}}
+	registration, err = ParseRegistration(reply)
+	if err == nil || err.Error() != "409:Conflict:SID" || registration.ConflictsWith != "echo" {
+		t.Fatalf("got %+v, %v", registration, err)
+	}
+
+	if _, err = ParseRegistration(Reply{REGISTER, STATUS_OK, []string{"Registered"}}); err == nil {
+		t.Fatal("parsed a reply with no registration")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	reply := Reply{"echo", STATUS_RATE_LIMITED, []string{"RateLimited", llibrary.RetryAfterFrame(time.Second)}}
+	if retry_after, ok := reply.RetryAfter(); !ok || retry_after != time.Second {
+		t.Fatalf("got %v, %t", retry_after, ok)
+	}
+	reply.Status = STATUS_UNAVAILABLE
+	if _, ok := reply.RetryAfter(); ok {
+		t.Fatal("retry after a reply that was not rate limited")
+	}
+}
@@ -0,0 +1,205 @@
+package rrapi
+
+import (
+	zmq "github.com/pebbe/zmq4"
+
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	HEARTBEAT_LIVENESS = 3                       //  3-5 is reasonable
+	HEARTBEAT_INTERVAL = 2500 * time.Millisecond //  msecs
+	RECONNECT_INTERVAL = 2500 * time.Millisecond //  Delay between attempts
+)
+
+//  Handles one request and returns its reply. The request's Context ends
+//  when the client stops waiting; pass it to CallContext for calls made
+//  on the request's behalf.
+type Handler func(request Request) Reply
+
+//  A worker for a service behind rrbroker. It connects a DEALER socket to
+//  the service's address, sends READY, and then exchanges heartbeats with
+//  the broker, reconnecting if the broker goes quiet. Each request is
+//  handled in its own goroutine so heartbeats keep flowing while it runs.
+type Worker struct {
+	endpoint   string
+	socket     *zmq.Socket //  Socket to broker
+	generation int         //  Connections made so far
+
+	Heartbeat time.Duration //  Heartbeat delay
+	Liveness  int           //  Heartbeats missed before reconnecting
+	Reconnect time.Duration //  Reconnect delay
+}
+
+func NewWorker(endpoint string) *Worker {
+	return &Worker{
+		endpoint:  endpoint,
+		Heartbeat: HEARTBEAT_INTERVAL,
+		Liveness:  HEARTBEAT_LIVENESS,
+		Reconnect: RECONNECT_INTERVAL,
+	}
+}
+
+//  Connect or reconnect to broker and announce readiness
+func (worker *Worker) connect() (err error) {
+	if worker.socket != nil {
+		worker.socket.Close()
+		worker.socket = nil
+	}
+	worker.socket, err = zmq.NewSocket(zmq.DEALER)
+	if err != nil {
+		return
+	}
+	worker.socket.SetLinger(0)
+	//  With the broker gone a DEALER would block on send, and we would
+	//  never notice that ctx is done. READY not sent now is sent again when
+	//  we reconnect.
+	worker.socket.SetSndtimeo(worker.Heartbeat)
+	err = worker.socket.Connect(worker.endpoint)
+	if err != nil {
+		return
+	}
+	worker.generation++
+	_, err = worker.socket.SendMessage(RRPW_WORKER, READY)
+	if zmq.AsErrno(err) == zmq.Errno(syscall.EAGAIN) {
+		err = nil
+	}
+	return
+}
+
+func (worker *Worker) Close() {
+	if worker.socket != nil {
+		worker.socket.Close()
+		worker.socket = nil
+	}
+}
+
+//  Serves requests with handler until the socket fails
+func (worker *Worker) Serve(handler Handler) error {
+	return worker.ServeContext(context.Background(), handler)
+}
+
+//  Serves requests with handler until the socket fails or ctx is done,
+//  which is noticed within one heartbeat. Handlers pass their replies
+//  back over an inproc pipe, tagged with the connection they came in on,
+//  since only this goroutine may use the broker socket. A reply for a
+//  request from before a reconnect is dropped; the broker has already
+//  given up on it.
+func (worker *Worker) ServeContext(ctx context.Context, handler Handler) (err error) {
+	pipe_address := fmt.Sprintf("inproc://rrapi-worker-%p", worker)
+	replies, err := zmq.NewSocket(zmq.PAIR)
+	if err != nil {
+		return
+	}
+	defer replies.Close()
+	if err = replies.Bind(pipe_address); err != nil {
+		return
+	}
+	handlers, err := zmq.NewSocket(zmq.PAIR)
+	if err != nil {
+		return
+	}
+	defer handlers.Close()
+	if err = handlers.Connect(pipe_address); err != nil {
+		return
+	}
+	var handlers_mutex sync.Mutex
+
+	if err = worker.connect(); err != nil {
+		return
+	}
+	defer worker.Close()
+	liveness := worker.Liveness
+	heartbeat_at := time.Now().Add(worker.Heartbeat)
+
+	for ctx.Err() == nil {
+		poller := zmq.NewPoller()
+		poller.Add(worker.socket, zmq.POLLIN)
+		poller.Add(replies, zmq.POLLIN)
+		var polled []zmq.Polled
+		polled, err = poller.Poll(worker.Heartbeat)
+		if err != nil {
+			return //  Interrupted
+		}
+
+		for _, item := range polled {
+			switch item.Socket {
+			case replies:
+				var frames []string
+				frames, err = replies.RecvMessage(0)
+				if err != nil {
+					return
+				}
+				if frames[0] == strconv.Itoa(worker.generation) {
+					worker.socket.SendMessage(frames[1:])
+				}
+
+			case worker.socket:
+				var frames []string
+				frames, err = worker.socket.RecvMessage(0)
+				if err != nil {
+					return
+				}
+				liveness = worker.Liveness
+				if len(frames) == 2 && frames[0] == RRPW_WORKER {
+					switch frames[1] {
+					case HEARTBEAT:
+					case DISCONNECT:
+						if err = worker.connect(); err != nil {
+							return
+						}
+					default:
+						log.Printf("E: invalid input message %q\n", frames)
+					}
+					continue
+				}
+				request, e := ParseWorkerRequest(frames)
+				if e != nil {
+					worker.socket.SendMessage(NewError(request.Service, STATUS_BAD_REQUEST, e.Error()).WorkerFrames())
+					continue
+				}
+				generation := strconv.Itoa(worker.generation)
+				//  The handler has whatever time the broker says is left
+				var request_ctx context.Context
+				var cancel context.CancelFunc
+				if timeout, _ := request.Timeout(); timeout > 0 {
+					request_ctx, cancel = context.WithTimeout(ctx, timeout)
+				} else {
+					request_ctx, cancel = context.WithCancel(ctx)
+				}
+				go func() {
+					defer cancel()
+					reply := handler(request.WithContext(request_ctx))
+					handlers_mutex.Lock()
+					handlers.SendMessage(generation, reply.WorkerFrames())
+					handlers_mutex.Unlock()
+				}()
+			}
+		}
+
+		if len(polled) == 0 {
+			liveness--
+			if liveness == 0 {
+				log.Println("W: disconnected from broker - retrying...")
+				time.Sleep(worker.Reconnect)
+				if err = worker.connect(); err != nil {
+					return
+				}
+				liveness = worker.Liveness
+			}
+		}
+
+		//  Send HEARTBEAT if it's time
+		if time.Now().After(heartbeat_at) {
+			worker.socket.SendMessage(RRPW_WORKER, HEARTBEAT)
+			heartbeat_at = time.Now().Add(worker.Heartbeat)
+		}
+	}
+	return ctx.Err()
+}
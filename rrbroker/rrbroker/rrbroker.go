@@ -1,311 +1,136 @@
 //
 //  Simple request-reply broker.
+//  Runs a broker from the rrbroker/broker package at tcp://*:5559, with
+//  its services listed in services.json. Services that register are
+//  bound at ports the broker chooses. SIGHUP reloads the service list;
+//  SIGINT or SIGTERM stops the broker. Given a -name and -state, it
+//  peers with the brokers whose state it is given in -peers.
 //
 
 package main
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	zmq "github.com/pebbe/zmq4"
-	"io"
-	"io/ioutil"
+	llibrary "llibrary"
 	"log"
 	"os"
+	"os/signal"
+	rrbroker "rrbroker/broker"
+	"rrbroker/rrapi"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
-type Service struct {
-	SID, Name, Address string
-	Backend            *zmq.Socket
-}
-
-var services = make(map[string]Service)
-var poller *zmq.Poller
-var address string
-
 func main() {
-	//  Initialize polling
-	poller = zmq.NewPoller()
-
-	//  Prepare our frontend sockets
-	frontend, _ := zmq.NewSocket(zmq.ROUTER)
-	defer frontend.Close()
-	address = "tcp://*:5559"
-	frontend.Bind(address)
-	//  Initialize frontend poll set
-	poller.Add(frontend, zmq.POLLIN)
-
-	//  Load Service List
-	getServiceList()
-	//Make sure all services in list are closed at end of execution
-	for _, service := range services {
-		defer service.Backend.Close()
+	heartbeat := flag.Duration("heartbeat", rrapi.HEARTBEAT_INTERVAL, "interval between heartbeats to and from workers")
+	liveness := flag.Int("liveness", rrapi.HEARTBEAT_LIVENESS, "heartbeats a worker may miss before it is dropped")
+	redispatch := flag.Int("redispatch", 0, "times to resend a request whose worker died; after that the client gets an error")
+	timeout := flag.Int("timeout", 0, "milliseconds to wait for a reply for services that set no timeout; 0 waits forever")
+	ports := flag.String("ports", "5560-5599", "range of ports to bind registered services at")
+	host := flag.String("host", "localhost", "host at which workers reach the service ports")
+	ipc := flag.String("ipc", "", "directory to bind registered services in, over ipc, instead of ports")
+	requestlog := flag.String("requestlog", "", "directory to log requests with IDs in, to be replayed after a restart")
+	ratelimits := flag.String("ratelimits", "", "JSON file of rate limits to start with; the ratelimit service changes them")
+	priorities := flag.String("priorities", "interactive=8,batch=1", "request priorities and their weights in service queues")
+	name := flag.String("name", "", "name of this broker among its peers; none for no peering")
+	state := flag.String("state", "", "endpoint to publish this broker's state to peers at")
+	peers := flag.String("peers", "", "comma-separated endpoints peers publish their state at")
+	advertise := flag.String("advertise", "tcp://localhost:5559", "endpoint at which peers reach this broker's frontend")
+	flag.Parse()
+
+	var low, high int
+	if _, err := fmt.Sscanf(*ports, "%d-%d", &low, &high); err != nil || low <= 0 || high < low {
+		log.Fatalln("Bad port range", *ports)
 	}
-	//  Initialize polling and binding to addresses
-	initializeServices()
-
-	fmt.Println("Broker at ", address, " waiting for connection...")
-	//  List available services
-	listServices()
-
-	//  Switch messages between sockets
-	for {
-		sockets, _ := poller.Poll(-1)
-		for _, socket := range sockets {
-			switch s := socket.Socket; s {
-			case frontend:
-				backend := serveFrontend(s)
-				//  (For newly registered services)
-				//  Make sure socket is closed at end of execution
-				if backend != nil {
-					defer backend.Close()
-					backend = nil
-				}
-
-			//  All services fall under default
-			default:
-				//fmt.Println("Receiving message from service...")
-				for {
-					msg, _ := s.Recv(0)
-					//fmt.Printf("\tIn-->%s\n", msg)
-					if more, _ := s.GetRcvmore(); more {
-						//fmt.Printf("\tForwarding to client: %s\n", msg)
-						frontend.Send(msg, zmq.SNDMORE)
-					} else {
-						//fmt.Printf("\tForwarding to client: %s\n", msg)
-						frontend.Send(msg, 0)
-						//fmt.Println("\tDone")
-						break
-					}
-				} //end for (receive message from service)
-			} //end switch (sockets polled)
-		} //end for(sockets polled)
-	} //end for(forever)
-}
-
-func getSocket() *zmq.Socket {
-	socket, err := zmq.NewSocket(zmq.DEALER)
+	endpoints := rrbroker.WithPortRange(*host, low, high)
+	if *ipc != "" {
+		endpoints = rrbroker.WithIPCDirectory(*ipc)
+	}
+	weights, err := parseWeights(*priorities)
 	if err != nil {
-		log.Println(err)
-		return nil
+		log.Fatalln("Bad priorities", *priorities)
 	}
-	return socket
-}
-
-// Initializes the list of all services subscribing them to
-// the poller
-// If a service is not mapped to a socket, it is removed from
-// the service list
-func initializeServices() {
-	for _, service := range services {
-		//  Initialize backend poll set
-		//  Delete mappings that didn't successfully bind to a socket
-		if service.Backend == nil {
-			fmt.Printf("Whoops, problem creating binding for %s\n", service.Name)
-			delete(services, service.SID)
-			continue
+	var limits []llibrary.Limit
+	if *ratelimits != "" {
+		if limits, err = readLimits(*ratelimits); err != nil {
+			log.Fatalln(err)
 		}
-		service.Backend.Bind(service.Address)
-		poller.Add(service.Backend, zmq.POLLIN)
 	}
-}
 
-// Populates the services map with mappings for available
-// services - services is a global variable hence no need
-// for return
-func getServiceList() {
-
-	//read service list from file
-	filepointer, err := os.Open("services.json")
-	if err != nil {
-		log.Println(err)
-		return
+	peering := rrbroker.Peering{Name: *name, Frontend: *advertise, State: *state}
+	if *peers != "" {
+		peering.Peers = strings.Split(*peers, ",")
 	}
 
-	defer filepointer.Close()
-	reader := bufio.NewReader(filepointer)
-	line, err := reader.ReadBytes('\n')
-	var service Service
-	for err == nil {
-		///*Decode from JSON
-		err = json.Unmarshal(line, &service)
-		if err != nil {
-			log.Println("Error decoding from json")
-			continue
-		}
-		services[service.SID] = Service{
-			service.SID,
-			service.Name,
-			service.Address,
-			getSocket()}
-		//read next line
-		line, err = reader.ReadBytes('\n')
-	}
-	if err != io.EOF {
+	if err := llibrary.InitTracing("rrbroker"); err != nil {
 		log.Println(err)
 	}
-}
-
-//  Registers a new service by:
-//  1. Decoding the JSON "register" message
-//  2. Adding the decoded service and its socket binding to the service list
-//  3. Initializing the service and adding it to the poller
-//  4. Encoding Entire service list to JSON and saving to file
-func registerService(message string, header []string, frontend *zmq.Socket) *zmq.Socket {
-	if len(services) == 0 {
-		services = make(map[string]Service)
-	}
-	var newservice Service
-	clientmessage := ""
-	fmt.Println("\nProcessing Service Registration Request for ", message, " ...")
-	//Decode Message
-	fmt.Println("\tDecoding...")
-	err := json.Unmarshal([]byte(message), &newservice)
+	llibrary.InitMetrics()
+
+	broker, err := rrbroker.New(
+		rrbroker.WithHeartbeat(*heartbeat, *liveness),
+		rrbroker.WithRedispatch(*redispatch),
+		rrbroker.WithTimeout(time.Duration(*timeout)*time.Millisecond),
+		endpoints,
+		rrbroker.WithPriorities(weights),
+		rrbroker.WithRateLimits(limits...),
+		rrbroker.WithRequestLog(*requestlog),
+		rrbroker.WithPeering(peering),
+		rrbroker.WithRegistry(llibrary.DefaultRegistry),
+		rrbroker.WithVerbose(true),
+	)
 	if err != nil {
-		log.Println("Error decoding from JSON ", err)
-		sendToClient("Failed:Decoding Message", header, "Failed Registration at Message Decode", 0, frontend)
-		return nil
+		log.Fatalln(err)
 	}
-
-	fmt.Println("\tRegistering...")
-	//Add to the active service list
-	services[newservice.SID] = Service{newservice.SID, newservice.Name, newservice.Address, getSocket()}
-
-	//  Initialize backend poll set
-	//  Delete mapping if service didn't successfully bind to a socket
-	if services[newservice.SID].Backend == nil {
-		log.Println(services[newservice.SID])
-		log.Printf("Whoops, problem creating binding for %s\n", newservice.Name)
-		delete(services, newservice.SID)
-		sendToClient("Failed:Socket Creation", header, "Failed Registration at socket creation", 0, frontend)
-		return nil
-	}
-	services[newservice.SID].Backend.Bind(services[newservice.SID].Address)
-	poller.Add(services[newservice.SID].Backend, zmq.POLLIN)
-
-	fmt.Println("\tUpdating file...")
-	//Encode entire service list to JSON
-	var datab, b []byte
-	for _, value := range services {
-		b, err = json.Marshal(value)
-		if err != nil {
-			log.Println("Error encoding ", value.SID, " to JSON")
-			clientmessage = ":FileWriteFail:EncodeError"
+	defer broker.Close()
+
+	//  Reload the service list on SIGHUP, and stop on SIGINT or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				broker.Reload()
+			} else {
+				cancel()
+			}
 		}
-		datab = append(datab, append(b, byte('\n'))...)
-	}
-
-	//write to file
-	err = ioutil.WriteFile("services.json", datab, os.ModePerm)
-	if err != nil {
-		log.Println("Error writing service list to file: ", err)
-		clientmessage = ":FileWriteFail"
-	}
-
-	//  Inform service
-	fmt.Println("\tSuccess! Informing service...")
-	sendToClient("Registered"+clientmessage, header, "Service registered Successfully", 0, frontend)
-
-	//  Updated service list
-	listServices()
-	return services[newservice.SID].Backend
-}
+	}()
 
-// Lists all available services in the service list including the
-// "register" service that is not in the service list
-func listServices() {
-	fmt.Println("\n\n=====================\nAvailable services:\nSID\t\tName\t\t\tAddress")
-	for _, service := range services {
-		fmt.Println(service.SID, "\t\t", service.Name, "\t\t\t", service.Address)
+	if err := broker.Run(ctx); err != context.Canceled {
+		log.Println(err)
 	}
-	fmt.Println("register\tService Registration\t", address)
-	fmt.Println("=====================\n")
 }
 
-func serveFrontend(frontend *zmq.Socket) (back *zmq.Socket) {
-	var header []string
-	var service Service
-	isPresent := false
-	//fmt.Println("\nReceiving message from client...")
-	for {
-		msg, _ := frontend.Recv(0)
-		//fmt.Printf("\tIn-->%s\n", msg)
-		message := strings.SplitN(msg, ":", 2)
-		if more, _ := frontend.GetRcvmore(); more {
-			//  If this part of the message contains no service description
-			//  treat is as a header
-			if len(message) != 2 {
-				header = append(header, msg)
-				continue
-			}
-
-			//  If the service request is to register a service, register it
-			if message[0] == "register" {
-				back = registerService(message[1], header, frontend)
-				return
-			}
-
-			//  If the service requested is not in the service list then assume
-			//  it will be at end of message and treat message as part of header
-			service, isPresent = services[message[0]]
-			if !isPresent {
-				header = append(header, msg)
-				continue
-			}
-
-			//  If the service requested is available send the early parts of
-			//  message at this point
-			for key := range header {
-				//fmt.Printf("\tForwarding to %s at %s: %s\n", service.Name, service.Address, header[key])
-				service.Backend.Send(header[key], zmq.SNDMORE)
-			}
-			header = header[:0] // Empty header to avoid accidental resend below
-			service.Backend.Send(message[1], zmq.SNDMORE)
-		} else {
-			// If the service request is to register a service, register it
-			if message[0] == "register" {
-				back = registerService(message[1], header, frontend)
-				return
-			}
-
-			// Has the service already been discovered? -If not, discover it
-			if !isPresent {
-				service, isPresent = services[message[0]]
-			}
-
-			//  If the service is still not discovered at this point, then we
-			//   have a problem. Report back to client
-			if !isPresent {
-				sendToClient("InvalidService", header, "Invalid Service SID", 0, frontend)
-				break
-			}
-
-			//  Otherwise everything is good fetch the service and send request
-			//  Send the assumed header of the message
-			for key := range header {
-				//fmt.Printf("\tForwarding to %s at %s: %s\n", service.Name, service.Address, header[key])
-				service.Backend.Send(header[key], zmq.SNDMORE)
-			}
-			//  Send the rest of the message
-			//fmt.Printf("\tForwarding to %s at %s: %s\n", service.Name, service.Address, message[1])
-			service.Backend.Send(message[1], 0)
-			//fmt.Println("\tDone")
-			break
+//  Parses weights given as "priority=weight,..."
+func parseWeights(list string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, item := range strings.Split(list, ",") {
+		priority, weight, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("no weight for %q", item)
 		}
+		n, err := strconv.Atoi(weight)
+		if err != nil {
+			return nil, err
+		}
+		weights[priority] = n
 	}
-	return
+	return weights, nil
 }
 
-func sendToClient(message string, header []string, title string, more zmq.Flag, frontend *zmq.Socket) {
-
-	//fmt.Println("\t", title)
-	for key := range header {
-		//fmt.Printf("\tSending to client: %s\n", header[key])
-		frontend.Send(header[key], zmq.SNDMORE)
+//  Reads a JSON list of rate limits
+func readLimits(path string) (limits []llibrary.Limit, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
 	}
-	//fmt.Printf("\tSending to client: %s\n", message)
-	frontend.Send(message, more)
-	//fmt.Println("\tDone")
+	err = json.Unmarshal(data, &limits)
+	return
 }
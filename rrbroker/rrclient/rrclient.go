@@ -7,13 +7,23 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	zmq "github.com/pebbe/zmq4"
+	llibrary "llibrary"
+	"log"
 	"math/rand"
+	"rrbroker/rrapi"
 	"time"
 )
 
 func main() {
+	priority := flag.String("priority", rrapi.PRIORITY_INTERACTIVE, "priority of the requests, such as interactive or batch")
+	flag.Parse()
+	if err := llibrary.InitTracing("rrclient"); err != nil {
+		log.Println(err)
+	}
+
 	requester, _ := zmq.NewSocket(zmq.REQ)
 	defer requester.Close()
 	requester.Connect("tcp://localhost:5559")
@@ -21,13 +31,31 @@ func main() {
 	for request := 0; request < 100; request++ {
 
 		//send message
-		msg := "hello:Hello"
-		fmt.Println("\nSending Message ", request, ": ", msg, "...")
-		requester.Send(msg, 0)
+		msg := rrapi.NewRequest("hello", "Hello")
+		fmt.Println("\nSending Message ", request, ": ", msg.Body, "...")
+		span := llibrary.StartSpan("hello", llibrary.SPAN_KIND_CLIENT, llibrary.SpanContext{})
+		msg.SetTrace(span.Context)
+		//  Rather an error from the broker than waiting forever
+		msg.SetTimeout(5 * time.Second)
+		msg.SetPriority(*priority)
 
 		//receive reply
-		reply, _ := requester.Recv(0)
-		fmt.Printf("\tReceived reply %d [%s]\n", request, reply)
+		reply, err := rrapi.Call(requester, msg)
+		if err == nil {
+			err = reply.Err()
+		}
+		span.SetError(err)
+		span.End()
+		if retry_after, limited := reply.RetryAfter(); limited {
+			fmt.Printf("\tRate limited, waiting %s\n", retry_after)
+			time.Sleep(retry_after)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("\tRequest %d failed: %s\n", request, err)
+		} else {
+			fmt.Printf("\tReceived reply %d %q\n", request, reply.Body)
+		}
 
 		//Sleep for a second
 		fmt.Printf("\tTime to rest :-)\n")
@@ -10,11 +10,18 @@ import (
 	zmq "github.com/pebbe/zmq4"
 
 	"fmt"
+	llibrary "llibrary"
+	"log"
 	"math/rand"
+	"rrbroker/rrapi"
 	"time"
 )
 
 func main() {
+	if err := llibrary.InitTracing("rrtimeclient"); err != nil {
+		log.Println(err)
+	}
+
 	requester, _ := zmq.NewSocket(zmq.REQ)
 	defer requester.Close()
 	requester.Connect("tcp://localhost:5559")
@@ -22,13 +29,25 @@ func main() {
 	for request := 0; request < 100; request++ {
 
 		//send message
-		msg := "time:time"
-		fmt.Println("\nSending Message ", request, ": ", msg, "...")
-		requester.Send(msg, 0)
+		msg := rrapi.NewRequest("time", "time")
+		fmt.Println("\nSending Message ", request, ": ", msg.Body, "...")
+		span := llibrary.StartSpan("time", llibrary.SPAN_KIND_CLIENT, llibrary.SpanContext{})
+		msg.SetTrace(span.Context)
+		//  Rather an error from the broker than waiting forever
+		msg.SetTimeout(5 * time.Second)
 
 		//receive reply
-		reply, _ := requester.Recv(0)
-		fmt.Printf("\tReceived reply %d [%s]\n", request, reply)
+		reply, err := rrapi.Call(requester, msg)
+		if err == nil {
+			err = reply.Err()
+		}
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			fmt.Printf("\tRequest %d failed: %s\n", request, err)
+		} else {
+			fmt.Printf("\tReceived reply %d %q\n", request, reply.Body)
+		}
 
 		//Sleep for a second
 		fmt.Printf("\tTime to rest :-)\n")
@@ -1,6 +1,6 @@
 //
 //  Time Service worker.
-//  Connects REP socket to tcp://*:5580
+//  Connects DEALER socket to wherever the broker binds the service
 //  Expects * from client, replies with the current time
 //
 
@@ -9,76 +9,72 @@ package main
 import (
 	zmq "github.com/pebbe/zmq4"
 
-	"encoding/json"
+	"flag"
 	"fmt"
+	llibrary "llibrary"
 	"log"
 	"math/rand"
+	"rrbroker/rrapi"
 	"time"
 )
 
 type Service struct {
-	SID, Name, Address string
+	SID, Name string
 }
 
-//  Initialize by setting address and registering service with broker
+//  Where the broker has bound our service
+var endpoint string
+
+//  Initialize by registering service with broker, which says where to connect
 func init() {
-	address := "tcp://*:5580"
-	service := Service{"time", "Time Service", address}
+	if err := llibrary.InitTracing("rrtimeservice"); err != nil {
+		log.Println(err)
+	}
+	service := Service{"time", "Time Service"}
 
 	fmt.Println("Registering service...")
-	fmt.Println("\t", sendRequest("register",
-		string(encodeTOJSON(service))))
+	requester, _ := zmq.NewSocket(zmq.REQ)
+	defer requester.Close()
+	requester.Connect("tcp://localhost:5559")
+	registration, err := rrapi.Register(requester, service)
+	if err != nil {
+		log.Fatalln("Registration failed:", err)
+	}
+	fmt.Printf("\tRegistered at %s, saved to disk: %t\n", registration.Endpoint, registration.Saved)
+	endpoint = registration.Endpoint
 }
 
 //  Main function is to serve clients
 func main() {
-	//  Socket to talk to clients
-	address := "tcp://localhost:5580"
-	responder, _ := zmq.NewSocket(zmq.REP)
-	defer responder.Close()
-	responder.Connect(address)
-	fmt.Println("Time Service listening at: ", address)
+	heartbeat := flag.Duration("heartbeat", rrapi.HEARTBEAT_INTERVAL, "interval between heartbeats to and from the broker")
+	liveness := flag.Int("liveness", rrapi.HEARTBEAT_LIVENESS, "heartbeats the broker may miss before reconnecting")
+	flag.Parse()
 
-	for count := 0; ; count++ {
+	//  Connection to the broker, which passes on clients' requests
+	worker := rrapi.NewWorker(endpoint)
+	worker.Heartbeat = *heartbeat
+	worker.Liveness = *liveness
+	fmt.Println("Time Service listening at: ", endpoint)
 
-		//  Wait for next request from client
-		request, _ := responder.Recv(0)
-		fmt.Printf("\nReceived request: [%s]\n", request)
+	count := 0
+	log.Println(worker.Serve(func(request rrapi.Request) rrapi.Reply {
+		fmt.Printf("\nReceived request: %q\n", request.Body)
+		span := llibrary.StartSpan("time", llibrary.SPAN_KIND_SERVER, request.Trace())
+		defer span.End()
 
-		//Do some work
-		time.Sleep(time.Duration(rand.Intn(1e3)) * time.Millisecond)
+		//Do some work, unless the client gives up first
+		select {
+		case <-time.After(time.Duration(rand.Intn(1e3)) * time.Millisecond):
+		case <-request.Context().Done():
+			fmt.Println("\tOut of time, giving up")
+			return rrapi.NewError(request.Service, rrapi.STATUS_TIMEOUT, "Timeout")
+		}
 		msg := time.Now().String()
 
 		//  Send reply back to client
 		fmt.Println("\tSending reply ", count, ": ", msg)
-		responder.Send(msg, 0)
+		count++
 		fmt.Println("\tDone! Next Please")
-	}
-}
-
-//  Send a request to a service through the broker
-func sendRequest(SID, message string) (reply string) {
-	//Bind to broker
-	requester, _ := zmq.NewSocket(zmq.REQ)
-	defer requester.Close()
-	requester.Connect("tcp://localhost:5559")
-
-	//send message
-	msg := SID + ":" + message
-	requester.Send(msg, 0)
-
-	//receive reply
-	reply, _ = requester.Recv(0)
-	return
-}
-
-//  Encode service struct to json
-func encodeTOJSON(service Service) []byte {
-	//Encode to JSON
-	b, err := json.Marshal(service)
-	if err != nil {
-		log.Println("Error encoding ", service.SID, " to JSON")
-		panic(err)
-	}
-	return b
+		return rrapi.Reply{Status: rrapi.STATUS_OK, Body: []string{msg}}
+	}))
 }
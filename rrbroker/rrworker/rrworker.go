@@ -1,6 +1,6 @@
 //
 //  Hello World worker.
-//  Connects REP socket to tcp://*:5560
+//  Connects DEALER socket to wherever the broker binds the service
 //  Expects * from client, replies with "World"
 //
 
@@ -9,77 +9,102 @@ package main
 import (
 	zmq "github.com/pebbe/zmq4"
 
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
+	llibrary "llibrary"
 	"log"
 	"math/rand"
+	"rrbroker/rrapi"
+	"strings"
+	"time"
 )
 
 type Service struct {
-	SID, Name, Address string
+	SID, Name string
 }
 
-//  Initialize by setting address and registering service with broker
+//  Where the broker has bound our service
+var endpoint string
+
+//  Initialize by registering service with broker, which says where to connect
 func init() {
-	service := Service{"hello", "Hello Service", "tcp://*:5560"}
+	if err := llibrary.InitTracing("rrworker"); err != nil {
+		log.Println(err)
+	}
+	service := Service{"hello", "Hello Service"}
 
 	fmt.Println("Registering service...")
-	fmt.Println("\t", sendRequest("register",
-		string(encodeTOJSON(service))))
+	requester, _ := zmq.NewSocket(zmq.REQ)
+	defer requester.Close()
+	requester.Connect("tcp://localhost:5559")
+	registration, err := rrapi.Register(requester, service)
+	if err != nil {
+		log.Fatalln("Registration failed:", err)
+	}
+	fmt.Printf("\tRegistered at %s, saved to disk: %t\n", registration.Endpoint, registration.Saved)
+	endpoint = registration.Endpoint
 }
 
 //  Main function is to serve clients
 func main() {
-	//  Socket to talk to clients
-	responder, _ := zmq.NewSocket(zmq.REP)
-	defer responder.Close()
-	responder.Connect("tcp://localhost:5560")
+	heartbeat := flag.Duration("heartbeat", rrapi.HEARTBEAT_INTERVAL, "interval between heartbeats to and from the broker")
+	liveness := flag.Int("liveness", rrapi.HEARTBEAT_LIVENESS, "heartbeats the broker may miss before reconnecting")
+	flag.Parse()
+
+	//  Connection to the broker, which passes on clients' requests
+	worker := rrapi.NewWorker(endpoint)
+	worker.Heartbeat = *heartbeat
+	worker.Liveness = *liveness
 
 	fmt.Println("hello worker ready for service...")
+	log.Println(worker.Serve(serve))
+}
 
-	for {
-		//  Wait for next request from client
-		request, _ := responder.Recv(0)
-		fmt.Printf("\nReceived request: [%s]\n", request)
-
-		//  Do some 'work'
-		fmt.Println("\tI'm trying to get some work done here...")
-		reply := "World"
-		//  Occasionally just get the time for no apparent reason
-		if rand.Int()%2 == 0 {
-			reply += " -->at " + sendRequest("time", "Give me time bro")
-		}
-
-		//  Send reply back to client
-		fmt.Println("\tSending reply:", reply)
-		responder.Send(reply, 0)
-		fmt.Println("\tDone! Next Please")
+func serve(request rrapi.Request) rrapi.Reply {
+	fmt.Printf("\nReceived request: %q\n", request.Body)
+	span := llibrary.StartSpan("hello", llibrary.SPAN_KIND_SERVER, request.Trace())
+	defer span.End()
+	ctx := llibrary.ContextWithSpan(request.Context(), span)
+	if deadline, ok := ctx.Deadline(); ok {
+		fmt.Println("\tTime left:", time.Until(deadline))
 	}
+
+	//  Do some 'work'
+	fmt.Println("\tI'm trying to get some work done here...")
+	reply := "World"
+	//  Occasionally just get the time for no apparent reason
+	if rand.Int()%2 == 0 {
+		reply += " -->at " + sendRequest(ctx, "time", "Give me time bro")
+	}
+
+	//  Send reply back to client
+	fmt.Println("\tSending reply:", reply)
+	fmt.Println("\tDone! Next Please")
+	return rrapi.Reply{Status: rrapi.STATUS_OK, Body: []string{reply}}
 }
 
-//  Send a request to a service through the broker
-func sendRequest(SID, message string) (reply string) {
+//  Send a request to a service through the broker, as part of the trace
+//  of any span in ctx and within what is left of its deadline
+func sendRequest(ctx context.Context, SID, message string) (reply string) {
+	span := llibrary.StartSpan(SID, llibrary.SPAN_KIND_CLIENT, llibrary.SpanFromContext(ctx).SpanContext())
+	defer span.End()
+
 	//Bind to broker
 	requester, _ := zmq.NewSocket(zmq.REQ)
 	defer requester.Close()
+	requester.SetLinger(0)
 	requester.Connect("tcp://localhost:5559")
 
-	//send message
-	msg := SID + ":" + message
-	requester.Send(msg, 0)
-
-	//receive reply
-	reply, _ = requester.Recv(0)
-	return
-}
-
-//  Encode service struct to json
-func encodeTOJSON(service Service) []byte {
-	//Encode to JSON
-	b, err := json.Marshal(service)
+	//send message and receive reply
+	rep, err := rrapi.CallContext(llibrary.ContextWithSpan(ctx, span), requester, rrapi.NewRequest(SID, message))
+	if err == nil {
+		err = rep.Err()
+	}
 	if err != nil {
-		log.Println("Error encoding ", service.SID, " to JSON")
-		panic(err)
+		span.SetError(err)
+		return err.Error()
 	}
-	return b
+	reply = strings.Join(rep.Body, "")
+	return
 }